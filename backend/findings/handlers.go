@@ -2,6 +2,7 @@ package findings
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,6 +18,8 @@ import (
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/findings/lifecycle"
 )
 
 type Handler struct {
@@ -161,6 +164,10 @@ func HandleGroupedFindings(app *pocketbase.PocketBase) echo.HandlerFunc {
 						dbx.HashExp{"false_positive": false},
 						dbx.HashExp{"remediated": false},
 					))
+				default:
+					if lifecycle.IsStatus(status) {
+						statusConditions = append(statusConditions, dbx.HashExp{"status": status})
+					}
 				}
 			}
 
@@ -318,6 +325,11 @@ func HandleFindings(app *pocketbase.PocketBase) echo.HandlerFunc {
 	}
 }
 
+// HandleBulkUpdateFindings moves findings to a new status. updateData takes
+// a status and an optional comment; the acknowledged, false_positive and
+// remediated flags are still accepted and mapped to the matching status.
+// Every change goes through the status workflow and is recorded in the
+// findings' history.
 func HandleBulkUpdateFindings(app *pocketbase.PocketBase) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var payload struct {
@@ -339,7 +351,7 @@ func HandleBulkUpdateFindings(app *pocketbase.PocketBase) echo.HandlerFunc {
 		}
 
 		// Validate update data fields
-		validFields := []string{"acknowledged", "false_positive", "remediated"}
+		validFields := []string{"status", "comment", "acknowledged", "false_positive", "remediated"}
 		for field := range payload.UpdateData {
 			if !contains(validFields, field) {
 				return c.JSON(http.StatusBadRequest, map[string]interface{}{
@@ -348,28 +360,83 @@ func HandleBulkUpdateFindings(app *pocketbase.PocketBase) echo.HandlerFunc {
 			}
 		}
 
-		// Update records in batch
+		status, err := bulkUpdateStatus(payload.UpdateData)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+		comment, _ := payload.UpdateData["comment"].(string)
+		actor := requestActor(c)
+
+		// Update records one by one, so one finding that can't move doesn't block the others
+		updated := 0
+		failed := make(map[string]string)
+		failedStatus := http.StatusConflict
 		for _, id := range payload.IDs {
-			record, err := app.Dao().FindRecordById("nuclei_findings", id)
+			event, err := lifecycle.Transition(app, id, status, actor, comment)
 			if err != nil {
-				continue // Skip if not found
+				failed[id] = err.Error()
+				if !errors.Is(err, lifecycle.ErrInvalidTransition) {
+					failedStatus = http.StatusInternalServerError
+				}
+				continue
 			}
-
-			for field, value := range payload.UpdateData {
-				record.Set(field, value)
+			if event != nil {
+				updated++
 			}
+		}
 
-			if err := app.Dao().Save(record); err != nil {
-				continue // Skip if update fails
-			}
+		if len(failed) > 0 {
+			return c.JSON(failedStatus, map[string]interface{}{
+				"error":   fmt.Sprintf("%d of %d findings could not be updated", len(failed), len(payload.IDs)),
+				"updated": updated,
+				"failed":  failed,
+			})
 		}
 
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"message": "Findings updated successfully",
+			"updated": updated,
+			"failed":  failed,
 		})
 	}
 }
 
+// bulkUpdateStatus returns the status a bulk update moves findings to
+func bulkUpdateStatus(updateData map[string]interface{}) (string, error) {
+	if status, ok := updateData["status"].(string); ok && status != "" {
+		if !lifecycle.IsStatus(status) {
+			return "", fmt.Errorf("Invalid status: %s", status)
+		}
+		return status, nil
+	}
+
+	// Legacy flags: the most final one set wins. Clearing false_positive or
+	// remediated reopens a finding, clearing acknowledged only moves it back to open.
+	cleared := ""
+	for _, flag := range []string{"false_positive", "remediated", "acknowledged"} {
+		value, exists := updateData[flag]
+		if !exists {
+			continue
+		}
+		if set, _ := value.(bool); set {
+			return legacyStatusFlags[flag], nil
+		}
+		if cleared == "" {
+			cleared = flag
+		}
+	}
+	switch cleared {
+	case "false_positive", "remediated":
+		return lifecycle.StatusReopened, nil
+	case "acknowledged":
+		return lifecycle.StatusOpen, nil
+	}
+
+	return "", fmt.Errorf("A status is required")
+}
+
 // Helper function to check if a slice contains a value
 func contains(slice []string, value string) bool {
 	for _, v := range slice {
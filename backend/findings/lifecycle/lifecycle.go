@@ -0,0 +1,228 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// Finding statuses stored in nuclei_findings.status
+const (
+	StatusOpen          = "open"
+	StatusTriaged       = "triaged"
+	StatusInProgress    = "in_progress"
+	StatusFixed         = "fixed"
+	StatusVerified      = "verified"
+	StatusReopened      = "reopened"
+	StatusRiskAccepted  = "risk_accepted"
+	StatusFalsePositive = "false_positive"
+)
+
+// ActorSystem is recorded for transitions that aren't triggered by a user
+const ActorSystem = "system"
+
+// ErrInvalidTransition is returned when a finding can't move from its current status to the requested one
+var ErrInvalidTransition = errors.New("invalid finding status transition")
+
+// transitions lists the statuses a finding may move to from each status.
+// Triaged and in progress findings can be moved back to open, which is what
+// un-acknowledging them does. Closed findings (verified, risk accepted, false
+// positive) and fixed ones can only be reopened.
+var transitions = map[string][]string{
+	StatusOpen:          {StatusTriaged, StatusInProgress, StatusFixed, StatusRiskAccepted, StatusFalsePositive},
+	StatusTriaged:       {StatusOpen, StatusInProgress, StatusFixed, StatusRiskAccepted, StatusFalsePositive},
+	StatusInProgress:    {StatusOpen, StatusTriaged, StatusFixed, StatusRiskAccepted, StatusFalsePositive},
+	StatusFixed:         {StatusVerified, StatusReopened},
+	StatusVerified:      {StatusReopened},
+	StatusReopened:      {StatusTriaged, StatusInProgress, StatusFixed, StatusRiskAccepted, StatusFalsePositive},
+	StatusRiskAccepted:  {StatusReopened},
+	StatusFalsePositive: {StatusReopened},
+}
+
+// TransitionEvent describes a status change that has been saved
+type TransitionEvent struct {
+	Finding *models.Record
+	From    string
+	To      string
+	Actor   string
+	Comment string
+	Time    time.Time
+}
+
+// Statuses returns every finding status
+func Statuses() []string {
+	return []string{
+		StatusOpen,
+		StatusTriaged,
+		StatusInProgress,
+		StatusFixed,
+		StatusVerified,
+		StatusReopened,
+		StatusRiskAccepted,
+		StatusFalsePositive,
+	}
+}
+
+// IsStatus reports whether status is a known finding status
+func IsStatus(status string) bool {
+	_, exists := transitions[status]
+	return exists
+}
+
+// CanTransition reports whether a finding may move from one status to another
+func CanTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NextStatuses returns the statuses a finding may move to from the given one
+func NextStatuses(from string) []string {
+	return append([]string{}, transitions[StatusOf(from)]...)
+}
+
+// StatusOf returns a stored status, treating findings saved before statuses existed as open
+func StatusOf(status string) string {
+	if status == "" {
+		return StatusOpen
+	}
+	return status
+}
+
+// Transition moves a finding to a new status in its own transaction and
+// records the change in nuclei_findings_history. See TransitionWithDao.
+func Transition(app *pocketbase.PocketBase, findingID, to, actor, comment string, updates ...func(record *models.Record)) (*TransitionEvent, error) {
+	var event *TransitionEvent
+
+	err := app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		record, err := txDao.FindRecordById("nuclei_findings", findingID)
+		if err != nil {
+			return fmt.Errorf("failed to find finding: %v", err)
+		}
+
+		event, err = TransitionWithDao(txDao, record, to, actor, comment, updates...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if event != nil {
+		log.Printf("[Findings] Finding %s: %s -> %s (actor: %s)", findingID, event.From, event.To, actor)
+	}
+	return event, nil
+}
+
+// TransitionWithDao moves a finding to a new status with the given dao, which
+// should be a transaction's so the finding and its history entry are saved
+// together. The acknowledged, false_positive and remediated flags are kept in
+// line with the status, and every field that changed is recorded with its old
+// and new value. Optional update funcs can set other fields that must be saved
+// together with the new status.
+//
+// Moving a finding to the status it already has is a no-op and returns a nil event.
+func TransitionWithDao(dao *daos.Dao, record *models.Record, to, actor, comment string, updates ...func(record *models.Record)) (*TransitionEvent, error) {
+	if !IsStatus(to) {
+		return nil, fmt.Errorf("%w: unknown status %q", ErrInvalidTransition, to)
+	}
+
+	from := StatusOf(record.GetString("status"))
+	if from == to {
+		return nil, nil
+	}
+	if !CanTransition(from, to) {
+		return nil, fmt.Errorf("%w: %q -> %q", ErrInvalidTransition, from, to)
+	}
+
+	before := fieldValues(record)
+
+	now := time.Now()
+	record.Set("status", to)
+	record.Set("status_changed", now)
+	record.Set("acknowledged", to != StatusOpen && to != StatusReopened)
+	record.Set("false_positive", to == StatusFalsePositive)
+	record.Set("remediated", to == StatusFixed || to == StatusVerified)
+	for _, update := range updates {
+		update(record)
+	}
+
+	if err := dao.SaveRecord(record); err != nil {
+		return nil, fmt.Errorf("failed to save finding status: %v", err)
+	}
+
+	collection, err := dao.FindCollectionByNameOrId("nuclei_findings_history")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find nuclei_findings_history collection: %v", err)
+	}
+
+	entry := models.NewRecord(collection)
+	entry.Set("finding", record.Id)
+	entry.Set("from_status", from)
+	entry.Set("to_status", to)
+	entry.Set("changes", changedFields(before, fieldValues(record)))
+	entry.Set("actor", actor)
+	entry.Set("comment", comment)
+	if err := dao.SaveRecord(entry); err != nil {
+		return nil, fmt.Errorf("failed to record finding history: %v", err)
+	}
+
+	return &TransitionEvent{
+		Finding: record,
+		From:    from,
+		To:      to,
+		Actor:   actor,
+		Comment: comment,
+		Time:    now,
+	}, nil
+}
+
+// History returns the audit entries of a finding, oldest first
+func History(app *pocketbase.PocketBase, findingID string) ([]*models.Record, error) {
+	records, err := app.Dao().FindRecordsByFilter(
+		"nuclei_findings_history",
+		"finding = {:finding}",
+		"created",
+		0,
+		0,
+		dbx.Params{
+			"finding": findingID,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find history of finding %s: %v", findingID, err)
+	}
+	return records, nil
+}
+
+// fieldValues returns the values of a record's schema fields
+func fieldValues(record *models.Record) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, field := range record.Collection().Schema.Fields() {
+		values[field.Name] = record.Get(field.Name)
+	}
+	return values
+}
+
+// changedFields returns the old and new value of every field that differs
+func changedFields(before, after map[string]interface{}) map[string]map[string]interface{} {
+	changes := make(map[string]map[string]interface{})
+	for name, value := range after {
+		if !reflect.DeepEqual(before[name], value) {
+			changes[name] = map[string]interface{}{
+				"old": before[name],
+				"new": value,
+			}
+		}
+	}
+	return changes
+}
@@ -38,8 +38,13 @@ func RegisterRoutes(app *pocketbase.PocketBase, e *core.ServeEvent, findingManag
 	findingsGroup.GET("/grouped", HandleGroupedFindings(app))
 	findingsGroup.GET("", HandleFindings(app))
 	findingsGroup.POST("/bulk-update", HandleBulkUpdateFindings(app))
+	findingsGroup.POST("/:id/status", HandleUpdateFindingStatus(app))
+	findingsGroup.GET("/:id/timeline", HandleGetFindingTimeline(app))
 	findingsGroup.GET("/by-client", HandleVulnerabilitiesByClient(app))
 	findingsGroup.GET("/recent", HandleRecentFindings(app))
+	findingsGroup.GET("/overdue", HandleOverdueFindings(app))
+	findingsGroup.GET("/due-soon", HandleDueSoonFindings(app))
+	findingsGroup.GET("/sla-policy", HandleGetSLAPolicy(app))
 
 	// Admin-only routes
 	adminGroup := e.Router.Group("/api/findings", apis.RequireAdminAuth())
@@ -47,6 +52,7 @@ func RegisterRoutes(app *pocketbase.PocketBase, e *core.ServeEvent, findingManag
 	adminGroup.DELETE("/orphaned", routes.deleteOrphanedFindings)
 	adminGroup.POST("/migrate-batch", routes.migrateFindingsBatch)
 	adminGroup.GET("/migration-status", routes.getMigrationStatus)
+	adminGroup.POST("/sla/recompute", HandleRecomputeDueDates(app))
 }
 
 type FindingsRoutes struct {
@@ -0,0 +1,133 @@
+package findings
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/services"
+)
+
+// defaultDueSoonDays is the window of /api/findings/due-soon without a days parameter
+const defaultDueSoonDays = 7
+
+// HandleOverdueFindings returns the unresolved findings past their SLA due
+// date: GET /api/findings/overdue?client=&severity=
+func HandleOverdueFindings(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		now := time.Now()
+
+		findings, err := services.OverdueFindings(app.Dao(), slaQuery(c), now)
+		if err != nil {
+			log.Printf("Failed to get overdue findings: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to get overdue findings",
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"as_of":      now,
+			"totalItems": len(findings),
+			"items":      findings,
+		})
+	}
+}
+
+// HandleDueSoonFindings returns the unresolved findings due within the next
+// days, 7 by default: GET /api/findings/due-soon?days=&client=&severity=
+func HandleDueSoonFindings(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		days := defaultDueSoonDays
+		if daysParam := c.QueryParam("days"); daysParam != "" {
+			parsed, err := strconv.Atoi(daysParam)
+			if err != nil || parsed <= 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": "days must be a positive number",
+				})
+			}
+			days = parsed
+		}
+
+		now := time.Now()
+		findings, err := services.DueSoonFindings(app.Dao(), slaQuery(c), now, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			log.Printf("Failed to get findings due soon: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to get findings due soon",
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"as_of":      now,
+			"days":       days,
+			"totalItems": len(findings),
+			"items":      findings,
+		})
+	}
+}
+
+// HandleGetSLAPolicy returns the days findings of each severity may stay
+// unresolved, for a client if given: GET /api/findings/sla-policy?client=
+func HandleGetSLAPolicy(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		clientID := c.QueryParam("client")
+
+		policy, err := services.LoadSLAPolicy(app.Dao(), clientID)
+		if err != nil {
+			log.Printf("Failed to load SLA policy of client %s: %v", clientID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to load SLA policy",
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"client": clientID,
+			"days":   policy,
+		})
+	}
+}
+
+// HandleRecomputeDueDates sets the due dates of unresolved findings from the
+// current SLA policies, after the policies changed:
+// POST /api/findings/sla/recompute?client=
+func HandleRecomputeDueDates(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		clientID := c.QueryParam("client")
+
+		updated, err := services.RecomputeDueDates(app, clientID)
+		if err != nil {
+			log.Printf("Failed to recompute due dates of client %s: %v", clientID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to recompute due dates",
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"client":  clientID,
+			"updated": updated,
+		})
+	}
+}
+
+// slaQuery builds the SLA query of a request. Users other than admins only
+// see the findings they created, like in the recent findings.
+func slaQuery(c echo.Context) services.SLAQuery {
+	query := services.SLAQuery{
+		ClientIDs:  c.QueryParams()["client"],
+		Severities: c.QueryParams()["severity"],
+	}
+
+	admin, _ := c.Get(apis.ContextAdminKey).(*models.Admin)
+	user, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if admin == nil && user != nil {
+		query.CreatedBy = user.Id
+	}
+
+	return query
+}
@@ -0,0 +1,127 @@
+package findings
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/findings/lifecycle"
+)
+
+// legacyStatusFlags maps the flags findings had before the status workflow to
+// the status setting them moves a finding to
+var legacyStatusFlags = map[string]string{
+	"acknowledged":   lifecycle.StatusTriaged,
+	"false_positive": lifecycle.StatusFalsePositive,
+	"remediated":     lifecycle.StatusFixed,
+}
+
+// HandleUpdateFindingStatus moves a finding to a new status:
+// POST /api/findings/:id/status {status, comment}
+func HandleUpdateFindingStatus(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var request struct {
+			Status  string `json:"status"`
+			Comment string `json:"comment"`
+		}
+		if err := c.Bind(&request); err != nil || request.Status == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Status is required",
+			})
+		}
+
+		if _, err := app.Dao().FindRecordById("nuclei_findings", c.PathParam("id")); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Finding not found",
+			})
+		}
+
+		event, err := lifecycle.Transition(app, c.PathParam("id"), request.Status, requestActor(c), request.Comment)
+		if err != nil {
+			if errors.Is(err, lifecycle.ErrInvalidTransition) {
+				return c.JSON(http.StatusConflict, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			log.Printf("Failed to update status of finding %s: %v", c.PathParam("id"), err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to update finding status",
+			})
+		}
+
+		response := map[string]interface{}{
+			"id":      c.PathParam("id"),
+			"status":  request.Status,
+			"changed": event != nil,
+		}
+		if event != nil {
+			response["from"] = event.From
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// HandleGetFindingTimeline returns the status history of a finding, oldest
+// first, starting with its creation: GET /api/findings/:id/timeline
+func HandleGetFindingTimeline(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		finding, err := app.Dao().FindRecordById("nuclei_findings", c.PathParam("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Finding not found",
+			})
+		}
+
+		history, err := lifecycle.History(app, finding.Id)
+		if err != nil {
+			log.Printf("Failed to get timeline of finding %s: %v", finding.Id, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to get finding timeline",
+			})
+		}
+
+		events := make([]map[string]interface{}, 0, len(history)+1)
+		events = append(events, map[string]interface{}{
+			"type":      "created",
+			"to_status": lifecycle.StatusOpen,
+			"actor":     finding.GetString("created_by"),
+			"timestamp": finding.GetString("created"),
+		})
+		for _, entry := range history {
+			events = append(events, map[string]interface{}{
+				"id":          entry.Id,
+				"type":        "status_change",
+				"from_status": entry.GetString("from_status"),
+				"to_status":   entry.GetString("to_status"),
+				"changes":     entry.Get("changes"),
+				"actor":       entry.GetString("actor"),
+				"comment":     entry.GetString("comment"),
+				"timestamp":   entry.GetString("created"),
+			})
+		}
+
+		status := lifecycle.StatusOf(finding.GetString("status"))
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"finding_id":    finding.Id,
+			"status":        status,
+			"next_statuses": lifecycle.NextStatuses(status),
+			"events":        events,
+		})
+	}
+}
+
+// requestActor returns the ID of the admin or user making the request
+func requestActor(c echo.Context) string {
+	if admin, _ := c.Get(apis.ContextAdminKey).(*models.Admin); admin != nil {
+		return admin.Id
+	}
+	if record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record); record != nil {
+		return record.Id
+	}
+	return lifecycle.ActorSystem
+}
@@ -0,0 +1,100 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection := &models.Collection{
+			Name:   "scan_jobs",
+			Type:   models.CollectionTypeBase,
+			System: false,
+			Schema: schema.NewSchema(
+				&schema.SchemaField{
+					Name:     "scan",
+					Type:     schema.FieldTypeRelation,
+					Required: true,
+					Options: &schema.RelationOptions{
+						CollectionId:  "zqdmvqo2mym808a",
+						CascadeDelete: true,
+						MaxSelect:     types.Pointer(1),
+					},
+				},
+				&schema.SchemaField{
+					Name:     "status",
+					Type:     schema.FieldTypeSelect,
+					Required: true,
+					Options: &schema.SelectOptions{
+						MaxSelect: 1,
+						Values:    []string{"queued", "running", "done", "failed", "cancelled"},
+					},
+				},
+				&schema.SchemaField{
+					Name:     "phase",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "source",
+					Type:     schema.FieldTypeSelect,
+					Required: false,
+					Options: &schema.SelectOptions{
+						MaxSelect: 1,
+						Values:    []string{"manual", "scheduled", "retry"},
+					},
+				},
+				&schema.SchemaField{
+					Name:     "attempt",
+					Type:     schema.FieldTypeNumber,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "retry_of",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "requested_by",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "error",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "started_at",
+					Type:     schema.FieldTypeDate,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "finished_at",
+					Type:     schema.FieldTypeDate,
+					Required: false,
+				},
+			),
+			ListRule: types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "nuclei_scans" || @request.auth.group.permissions.read ~ "*")`),
+			ViewRule: types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "nuclei_scans" || @request.auth.group.permissions.read ~ "*")`),
+		}
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_jobs")
+		if err != nil {
+			return nil
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
@@ -0,0 +1,92 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("zqdmvqo2mym808a")
+		if err != nil {
+			return err
+		}
+
+		// update
+		edit_status := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "elcbhext",
+			"name": "status",
+			"type": "select",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSelect": 1,
+				"values": [
+					"Manual",
+					"Created",
+					"Started",
+					"Generating",
+					"Deploying",
+					"Running",
+					"Finished",
+					"Failed",
+					"Stopping",
+					"Stopped",
+					"Destroyed"
+				]
+			}
+		}`), edit_status); err != nil {
+			return err
+		}
+		collection.Schema.AddField(edit_status)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("zqdmvqo2mym808a")
+		if err != nil {
+			return err
+		}
+
+		// update
+		edit_status := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "elcbhext",
+			"name": "status",
+			"type": "select",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSelect": 1,
+				"values": [
+					"Manual",
+					"Created",
+					"Started",
+					"Generating",
+					"Deploying",
+					"Running",
+					"Finished",
+					"Failed",
+					"Stopped"
+				]
+			}
+		}`), edit_status); err != nil {
+			return err
+		}
+		collection.Schema.AddField(edit_status)
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,67 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection := &models.Collection{
+			Name:   "scan_transitions",
+			Type:   models.CollectionTypeBase,
+			System: false,
+			Schema: schema.NewSchema(
+				&schema.SchemaField{
+					Name:     "scan",
+					Type:     schema.FieldTypeRelation,
+					Required: true,
+					Options: &schema.RelationOptions{
+						CollectionId:  "zqdmvqo2mym808a",
+						CascadeDelete: true,
+						MaxSelect:     types.Pointer(1),
+					},
+				},
+				&schema.SchemaField{
+					Name:     "from_status",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "to_status",
+					Type:     schema.FieldTypeText,
+					Required: true,
+				},
+				&schema.SchemaField{
+					Name:     "actor",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "reason",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+			),
+			ListRule: types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "nuclei_scans" || @request.auth.group.permissions.read ~ "*")`),
+			ViewRule: types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "nuclei_scans" || @request.auth.group.permissions.read ~ "*")`),
+		}
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_transitions")
+		if err != nil {
+			return nil
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
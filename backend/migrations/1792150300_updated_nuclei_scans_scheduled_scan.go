@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("zqdmvqo2mym808a")
+		if err != nil {
+			return err
+		}
+
+		// add
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "scheduled_scan",
+			Type:     schema.FieldTypeRelation,
+			Required: false,
+			Options: &schema.RelationOptions{
+				CollectionId:  "64vh0u4fmvdmw8v",
+				CascadeDelete: false,
+				MaxSelect:     types.Pointer(1),
+			},
+		})
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("zqdmvqo2mym808a")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		if field := collection.Schema.GetFieldByName("scheduled_scan"); field != nil {
+			collection.Schema.RemoveField(field.Id)
+		}
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,105 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection := &models.Collection{
+			Name:   "scan_policies",
+			Type:   models.CollectionTypeBase,
+			System: false,
+			Schema: schema.NewSchema(
+				&schema.SchemaField{
+					Name:     "client",
+					Type:     schema.FieldTypeRelation,
+					Required: true,
+					Options: &schema.RelationOptions{
+						CollectionId:  "2hmr3iu22ww6uih",
+						CascadeDelete: true,
+						MaxSelect:     types.Pointer(1),
+					},
+				},
+				&schema.SchemaField{
+					Name:     "enabled",
+					Type:     schema.FieldTypeBool,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "timezone",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "allowed_windows",
+					Type:     schema.FieldTypeJson,
+					Required: false,
+					Options: &schema.JsonOptions{
+						MaxSize: 2000000,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "blocked_windows",
+					Type:     schema.FieldTypeJson,
+					Required: false,
+					Options: &schema.JsonOptions{
+						MaxSize: 2000000,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "freeze_dates",
+					Type:     schema.FieldTypeJson,
+					Required: false,
+					Options: &schema.JsonOptions{
+						MaxSize: 2000000,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "manual_action",
+					Type:     schema.FieldTypeSelect,
+					Required: false,
+					Options: &schema.SelectOptions{
+						MaxSelect: 1,
+						Values:    []string{"refuse", "defer"},
+					},
+				},
+				&schema.SchemaField{
+					Name:     "scheduled_action",
+					Type:     schema.FieldTypeSelect,
+					Required: false,
+					Options: &schema.SelectOptions{
+						MaxSelect: 1,
+						Values:    []string{"skip", "shift"},
+					},
+				},
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX `idx_scan_policies_client` ON `scan_policies` (`client`)",
+			},
+			ListRule:   types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "clients" || @request.auth.group.permissions.read ~ "*")`),
+			ViewRule:   types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "clients" || @request.auth.group.permissions.read ~ "*")`),
+			CreateRule: types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.write ~ "clients" || @request.auth.group.permissions.write ~ "*")`),
+			UpdateRule: types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.write ~ "clients" || @request.auth.group.permissions.write ~ "*")`),
+			DeleteRule: types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.delete ~ "clients" || @request.auth.group.permissions.delete ~ "*")`),
+		}
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_policies")
+		if err != nil {
+			return nil
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_jobs")
+		if err != nil {
+			return err
+		}
+
+		// add
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "not_before",
+			Type:     schema.FieldTypeDate,
+			Required: false,
+		})
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_jobs")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		if field := collection.Schema.GetFieldByName("not_before"); field != nil {
+			collection.Schema.RemoveField(field.Id)
+		}
+
+		return dao.SaveCollection(collection)
+	})
+}
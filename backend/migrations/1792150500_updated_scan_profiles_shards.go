@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_profiles")
+		if err != nil {
+			return err
+		}
+
+		// add
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "shards",
+			Type:     schema.FieldTypeNumber,
+			Required: false,
+			Options: &schema.NumberOptions{
+				Min:       types.Pointer(1.0),
+				Max:       types.Pointer(20.0),
+				NoDecimal: true,
+			},
+		})
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_profiles")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		if field := collection.Schema.GetFieldByName("shards"); field != nil {
+			collection.Schema.RemoveField(field.Id)
+		}
+
+		return dao.SaveCollection(collection)
+	})
+}
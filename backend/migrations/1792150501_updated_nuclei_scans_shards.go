@@ -0,0 +1,74 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("nuclei_scans")
+		if err != nil {
+			return err
+		}
+
+		// add
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "shard_of",
+			Type:     schema.FieldTypeRelation,
+			Required: false,
+			Options: &schema.RelationOptions{
+				CollectionId:  "zqdmvqo2mym808a",
+				CascadeDelete: true,
+				MaxSelect:     types.Pointer(1),
+			},
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "shard_index",
+			Type:     schema.FieldTypeNumber,
+			Required: false,
+			Options: &schema.NumberOptions{
+				NoDecimal: true,
+			},
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "shard_count",
+			Type:     schema.FieldTypeNumber,
+			Required: false,
+			Options: &schema.NumberOptions{
+				NoDecimal: true,
+			},
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "target_count",
+			Type:     schema.FieldTypeNumber,
+			Required: false,
+			Options: &schema.NumberOptions{
+				NoDecimal: true,
+			},
+		})
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("nuclei_scans")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		for _, name := range []string{"shard_of", "shard_index", "shard_count", "target_count"} {
+			if field := collection.Schema.GetFieldByName(name); field != nil {
+				collection.Schema.RemoveField(field.Id)
+			}
+		}
+
+		return dao.SaveCollection(collection)
+	})
+}
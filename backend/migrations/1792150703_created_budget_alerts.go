@@ -0,0 +1,80 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection := &models.Collection{
+			Name:   "budget_alerts",
+			Type:   models.CollectionTypeBase,
+			System: false,
+			Schema: schema.NewSchema(
+				&schema.SchemaField{
+					Name:     "scope",
+					Type:     schema.FieldTypeSelect,
+					Required: true,
+					Options: &schema.SelectOptions{
+						MaxSelect: 1,
+						Values:    []string{"global", "provider", "client"},
+					},
+				},
+				&schema.SchemaField{
+					Name:     "scope_id",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "month",
+					Type:     schema.FieldTypeText,
+					Required: true,
+					Options: &schema.TextOptions{
+						Pattern: `^\d{4}-\d{2}$`,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "threshold",
+					Type:     schema.FieldTypeNumber,
+					Required: true,
+					Options: &schema.NumberOptions{
+						NoDecimal: true,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "spent",
+					Type:     schema.FieldTypeNumber,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "budget",
+					Type:     schema.FieldTypeNumber,
+					Required: false,
+				},
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX `idx_budget_alerts_scope_month_threshold` ON `budget_alerts` (`scope`, `scope_id`, `month`, `threshold`)",
+			},
+			ListRule: types.Pointer(`@request.auth.id != "" && @request.auth.group.name = "admin"`),
+			ViewRule: types.Pointer(`@request.auth.id != "" && @request.auth.group.name = "admin"`),
+		}
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("budget_alerts")
+		if err != nil {
+			return nil
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
@@ -0,0 +1,110 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection := &models.Collection{
+			Name:   "scan_uploads",
+			Type:   models.CollectionTypeBase,
+			System: false,
+			Schema: schema.NewSchema(
+				&schema.SchemaField{
+					Name:     "scan",
+					Type:     schema.FieldTypeRelation,
+					Required: true,
+					Options: &schema.RelationOptions{
+						CollectionId:  "zqdmvqo2mym808a",
+						CascadeDelete: true,
+						MaxSelect:     types.Pointer(1),
+					},
+				},
+				&schema.SchemaField{
+					Name:     "client",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "created_by",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "total_size",
+					Type:     schema.FieldTypeNumber,
+					Required: true,
+					Options: &schema.NumberOptions{
+						Min:       types.Pointer(1.0),
+						NoDecimal: true,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "chunk_size",
+					Type:     schema.FieldTypeNumber,
+					Required: true,
+					Options: &schema.NumberOptions{
+						Min:       types.Pointer(1.0),
+						NoDecimal: true,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "total_chunks",
+					Type:     schema.FieldTypeNumber,
+					Required: true,
+					Options: &schema.NumberOptions{
+						Min:       types.Pointer(1.0),
+						NoDecimal: true,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "sha256",
+					Type:     schema.FieldTypeText,
+					Required: true,
+					Options: &schema.TextOptions{
+						Pattern: `^[0-9a-f]{64}$`,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "received_chunks",
+					Type:     schema.FieldTypeJson,
+					Required: false,
+					Options: &schema.JsonOptions{
+						MaxSize: 2000000,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "status",
+					Type:     schema.FieldTypeSelect,
+					Required: true,
+					Options: &schema.SelectOptions{
+						MaxSelect: 1,
+						Values:    []string{"uploading", "complete"},
+					},
+				},
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE INDEX `idx_scan_uploads_scan` ON `scan_uploads` (`scan`)",
+			},
+		}
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_uploads")
+		if err != nil {
+			return nil
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
@@ -0,0 +1,144 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection := &models.Collection{
+			Name:   "scan_imports",
+			Type:   models.CollectionTypeBase,
+			System: false,
+			Schema: schema.NewSchema(
+				&schema.SchemaField{
+					Name:     "scan",
+					Type:     schema.FieldTypeRelation,
+					Required: true,
+					Options: &schema.RelationOptions{
+						CollectionId:  "zqdmvqo2mym808a",
+						CascadeDelete: true,
+						MaxSelect:     types.Pointer(1),
+					},
+				},
+				&schema.SchemaField{
+					Name:     "client",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "created_by",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "source",
+					Type:     schema.FieldTypeSelect,
+					Required: true,
+					Options: &schema.SelectOptions{
+						MaxSelect: 1,
+						Values:    []string{"upload", "chunked", "session", "local"},
+					},
+				},
+				&schema.SchemaField{
+					Name:     "status",
+					Type:     schema.FieldTypeSelect,
+					Required: true,
+					Options: &schema.SelectOptions{
+						MaxSelect: 1,
+						Values:    []string{"queued", "parsing", "processing", "done", "failed"},
+					},
+				},
+				&schema.SchemaField{
+					Name:     "sha256",
+					Type:     schema.FieldTypeText,
+					Required: true,
+				},
+				&schema.SchemaField{
+					Name:     "idempotency_key",
+					Type:     schema.FieldTypeText,
+					Required: true,
+				},
+				&schema.SchemaField{
+					Name:     "parsed_count",
+					Type:     schema.FieldTypeNumber,
+					Required: false,
+					Options: &schema.NumberOptions{
+						NoDecimal: true,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "unique_count",
+					Type:     schema.FieldTypeNumber,
+					Required: false,
+					Options: &schema.NumberOptions{
+						NoDecimal: true,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "new_count",
+					Type:     schema.FieldTypeNumber,
+					Required: false,
+					Options: &schema.NumberOptions{
+						NoDecimal: true,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "duplicate_count",
+					Type:     schema.FieldTypeNumber,
+					Required: false,
+					Options: &schema.NumberOptions{
+						NoDecimal: true,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "error_count",
+					Type:     schema.FieldTypeNumber,
+					Required: false,
+					Options: &schema.NumberOptions{
+						NoDecimal: true,
+					},
+				},
+				&schema.SchemaField{
+					Name:     "error",
+					Type:     schema.FieldTypeText,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "started_at",
+					Type:     schema.FieldTypeDate,
+					Required: false,
+				},
+				&schema.SchemaField{
+					Name:     "finished_at",
+					Type:     schema.FieldTypeDate,
+					Required: false,
+				},
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX `idx_scan_imports_idempotency_key` ON `scan_imports` (`idempotency_key`)",
+				"CREATE INDEX `idx_scan_imports_scan` ON `scan_imports` (`scan`)",
+			},
+			ListRule: types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "nuclei_scans" || @request.auth.group.permissions.read ~ "*")`),
+			ViewRule: types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "nuclei_scans" || @request.auth.group.permissions.read ~ "*")`),
+		}
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_imports")
+		if err != nil {
+			return nil
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
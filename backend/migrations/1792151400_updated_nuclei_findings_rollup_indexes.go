@@ -0,0 +1,71 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// rollupIndexes are the indexes the finding rollups are computed with
+var rollupIndexes = map[string][]string{
+	"nuclei_findings": {
+		"CREATE INDEX `idx_nuclei_findings_scan_id` ON `nuclei_findings` (`scan_id`)",
+		"CREATE INDEX `idx_nuclei_findings_client_hash` ON `nuclei_findings` (`client`, `hash`)",
+	},
+	"nuclei_findings_rollups": {
+		"CREATE INDEX `idx_nuclei_findings_rollups_scan_id` ON `nuclei_findings_rollups` (`scan_id`)",
+	},
+}
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		for name, indexes := range rollupIndexes {
+			collection, err := dao.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+
+			collection.Indexes = append(collection.Indexes, indexes...)
+
+			if err := dao.SaveCollection(collection); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		for name, indexes := range rollupIndexes {
+			collection, err := dao.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+
+			kept := collection.Indexes[:0]
+			for _, index := range collection.Indexes {
+				if !containsIndex(indexes, index) {
+					kept = append(kept, index)
+				}
+			}
+			collection.Indexes = kept
+
+			if err := dao.SaveCollection(collection); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func containsIndex(indexes []string, index string) bool {
+	for _, i := range indexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("sgc6cuzt2qx3tmo")
+		if err != nil {
+			return err
+		}
+
+		// add
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "status",
+			Type:     schema.FieldTypeSelect,
+			Required: false,
+			Options: &schema.SelectOptions{
+				MaxSelect: 1,
+				Values: []string{
+					"open",
+					"triaged",
+					"in_progress",
+					"fixed",
+					"verified",
+					"reopened",
+					"risk_accepted",
+					"false_positive",
+				},
+			},
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "status_changed",
+			Type:     schema.FieldTypeDate,
+			Required: false,
+		})
+		collection.Indexes = append(collection.Indexes,
+			"CREATE INDEX `idx_nuclei_findings_status` ON `nuclei_findings` (`status`)",
+		)
+
+		if err := dao.SaveCollection(collection); err != nil {
+			return err
+		}
+
+		// Derive the status of existing findings from their flags
+		_, err = db.NewQuery(`
+			UPDATE nuclei_findings SET status = CASE
+				WHEN false_positive = TRUE THEN 'false_positive'
+				WHEN remediated = TRUE THEN 'fixed'
+				WHEN acknowledged = TRUE THEN 'triaged'
+				ELSE 'open'
+			END
+			WHERE status = '' OR status IS NULL
+		`).Execute()
+		return err
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("sgc6cuzt2qx3tmo")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		for _, name := range []string{"status", "status_changed"} {
+			if field := collection.Schema.GetFieldByName(name); field != nil {
+				collection.Schema.RemoveField(field.Id)
+			}
+		}
+		kept := collection.Indexes[:0]
+		for _, index := range collection.Indexes {
+			if index != "CREATE INDEX `idx_nuclei_findings_status` ON `nuclei_findings` (`status`)" {
+				kept = append(kept, index)
+			}
+		}
+		collection.Indexes = kept
+
+		return dao.SaveCollection(collection)
+	})
+}
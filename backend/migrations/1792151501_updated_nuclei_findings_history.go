@@ -0,0 +1,141 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// legacyHistoryFields were required when nuclei_findings_history was meant to
+// hold snapshots of findings; audit entries don't set them
+var legacyHistoryFields = []string{
+	"hash",
+	"client_id",
+	"first_seen",
+	"last_seen",
+	"scan_ids",
+	"severity",
+	"title",
+	"description",
+	"target",
+	"type",
+	"tool",
+}
+
+// auditHistoryFields are the fields of a finding's audit entries
+var auditHistoryFields = []string{
+	"finding",
+	"from_status",
+	"to_status",
+	"changes",
+	"actor",
+	"comment",
+}
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		// The collection was created and then dropped by earlier migrations,
+		// so it only exists on some installs
+		collection, err := dao.FindCollectionByNameOrId("nuclei_findings_history")
+		if err != nil {
+			collection = &models.Collection{
+				Name:   "nuclei_findings_history",
+				Type:   models.CollectionTypeBase,
+				System: false,
+				Schema: schema.NewSchema(),
+			}
+		}
+
+		// update
+		for _, name := range legacyHistoryFields {
+			if field := collection.Schema.GetFieldByName(name); field != nil {
+				field.Required = false
+			}
+		}
+
+		// add
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "finding",
+			Type:     schema.FieldTypeRelation,
+			Required: false,
+			Options: &schema.RelationOptions{
+				CollectionId:  "sgc6cuzt2qx3tmo",
+				CascadeDelete: true,
+				MaxSelect:     types.Pointer(1),
+			},
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "from_status",
+			Type:     schema.FieldTypeText,
+			Required: false,
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "to_status",
+			Type:     schema.FieldTypeText,
+			Required: false,
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "changes",
+			Type:     schema.FieldTypeJson,
+			Required: false,
+			Options: &schema.JsonOptions{
+				MaxSize: 2000000,
+			},
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "actor",
+			Type:     schema.FieldTypeText,
+			Required: false,
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "comment",
+			Type:     schema.FieldTypeText,
+			Required: false,
+		})
+
+		collection.Indexes = append(collection.Indexes,
+			"CREATE INDEX `idx_nuclei_findings_history_finding` ON `nuclei_findings_history` (`finding`, `created`)",
+		)
+		collection.ListRule = types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "nuclei_findings" || @request.auth.group.permissions.read ~ "*")`)
+		collection.ViewRule = types.Pointer(`@request.auth.id != "" && (@request.auth.group.name = "admin" || @request.auth.group.permissions.read ~ "nuclei_findings" || @request.auth.group.permissions.read ~ "*")`)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("nuclei_findings_history")
+		if err != nil {
+			return nil
+		}
+
+		// remove
+		for _, name := range auditHistoryFields {
+			if field := collection.Schema.GetFieldByName(name); field != nil {
+				collection.Schema.RemoveField(field.Id)
+			}
+		}
+
+		kept := collection.Indexes[:0]
+		for _, index := range collection.Indexes {
+			if index != "CREATE INDEX `idx_nuclei_findings_history_finding` ON `nuclei_findings_history` (`finding`, `created`)" {
+				kept = append(kept, index)
+			}
+		}
+		collection.Indexes = kept
+		collection.ListRule = nil
+		collection.ViewRule = nil
+
+		// Drop the collection if this migration created it
+		if len(collection.Schema.Fields()) == 0 {
+			return dao.DeleteCollection(collection)
+		}
+
+		// The legacy fields can't be required again while audit entries exist
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,83 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("sgc6cuzt2qx3tmo")
+		if err != nil {
+			return err
+		}
+
+		// add
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "first_seen",
+			Type:     schema.FieldTypeDate,
+			Required: false,
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "due_at",
+			Type:     schema.FieldTypeDate,
+			Required: false,
+		})
+		collection.Indexes = append(collection.Indexes,
+			"CREATE INDEX `idx_nuclei_findings_due_at` ON `nuclei_findings` (`due_at`)",
+		)
+
+		if err := dao.SaveCollection(collection); err != nil {
+			return err
+		}
+
+		// Existing findings were first seen when they were created
+		if _, err := db.NewQuery(`
+			UPDATE nuclei_findings SET first_seen = created
+			WHERE first_seen = '' OR first_seen IS NULL
+		`).Execute(); err != nil {
+			return err
+		}
+
+		// Give existing findings the due date of the default SLA policy
+		// (services.DefaultSLADays); info findings have no SLA
+		_, err = db.NewQuery(`
+			UPDATE nuclei_findings SET due_at = strftime('%Y-%m-%d %H:%M:%fZ', first_seen, CASE LOWER(severity)
+				WHEN 'critical' THEN '+7 days'
+				WHEN 'high' THEN '+30 days'
+				WHEN 'medium' THEN '+90 days'
+				ELSE '+180 days'
+			END)
+			WHERE (due_at = '' OR due_at IS NULL)
+			AND LOWER(severity) IN ('critical', 'high', 'medium', 'low')
+		`).Execute()
+		return err
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("sgc6cuzt2qx3tmo")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		for _, name := range []string{"first_seen", "due_at"} {
+			if field := collection.Schema.GetFieldByName(name); field != nil {
+				collection.Schema.RemoveField(field.Id)
+			}
+		}
+		kept := collection.Indexes[:0]
+		for _, index := range collection.Indexes {
+			if index != "CREATE INDEX `idx_nuclei_findings_due_at` ON `nuclei_findings` (`due_at`)" {
+				kept = append(kept, index)
+			}
+		}
+		collection.Indexes = kept
+
+		return dao.SaveCollection(collection)
+	})
+}
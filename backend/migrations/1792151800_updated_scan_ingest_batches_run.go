@@ -0,0 +1,61 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Batch sequence numbers restart with every run of a scan, so they are unique per run
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_ingest_batches")
+		if err != nil {
+			return err
+		}
+
+		// add
+		collection.Schema.AddField(&schema.SchemaField{
+			Name:     "run",
+			Type:     schema.FieldTypeText,
+			Required: false,
+		})
+		collection.Indexes = types.JsonArray[string]{
+			"CREATE UNIQUE INDEX `idx_scan_ingest_batches_scan_run_sequence` ON `scan_ingest_batches` (`scan`, `run`, `sequence`)",
+		}
+
+		if err := dao.SaveCollection(collection); err != nil {
+			return err
+		}
+
+		// Batches streamed so far belong to the current run of their scan
+		_, err = db.NewQuery("UPDATE scan_ingest_batches SET run = (SELECT start_time FROM nuclei_scans WHERE nuclei_scans.id = scan_ingest_batches.scan)").Execute()
+		return err
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("scan_ingest_batches")
+		if err != nil {
+			return err
+		}
+
+		// Only the latest run of each scan fits the old index
+		if _, err := db.NewQuery("DELETE FROM scan_ingest_batches WHERE run != (SELECT start_time FROM nuclei_scans WHERE nuclei_scans.id = scan_ingest_batches.scan)").Execute(); err != nil {
+			return err
+		}
+
+		// remove
+		if field := collection.Schema.GetFieldByName("run"); field != nil {
+			collection.Schema.RemoveField(field.Id)
+		}
+		collection.Indexes = types.JsonArray[string]{
+			"CREATE UNIQUE INDEX `idx_scan_ingest_batches_scan_sequence` ON `scan_ingest_batches` (`scan`, `sequence`)",
+		}
+
+		return dao.SaveCollection(collection)
+	})
+}
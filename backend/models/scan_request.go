@@ -16,4 +16,7 @@ type ScanRequest struct {
 	// Optional settings overrides
 	StatefilePath string `json:"statefile_path,omitempty"` // Override default statefile path
 	ScansPath     string `json:"scans_path,omitempty"`     // Override default scans path
+
+	// Start the scan even if it would exceed a monthly budget; admins only
+	BudgetOverride bool `json:"budget_override,omitempty"`
 }
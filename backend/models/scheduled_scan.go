@@ -11,6 +11,14 @@ type ScheduleDetails struct {
 	MonthlyDate  int      `json:"monthlyDate,omitempty"`
 	MonthlyDay   string   `json:"monthlyDay,omitempty"`
 	MonthlyWeek  string   `json:"monthlyWeek,omitempty"`
+
+	// StartTime is the time of day the scan starts at, as "HH:MM" (24h). Midnight if empty.
+	StartTime string `json:"startTime,omitempty"`
+	// Timezone is the IANA timezone StartTime is in. Server local time if empty.
+	Timezone string `json:"timezone,omitempty"`
+	// AllowedDuration is how many minutes after the start time a run may still
+	// start, for example when it waits in the scan queue. 0 means no limit.
+	AllowedDuration int `json:"allowedDuration,omitempty"`
 }
 
 type ScheduleRequest struct {
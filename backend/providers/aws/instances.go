@@ -0,0 +1,129 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/pocketbase/pocketbase"
+)
+
+// ScanInstance is an EC2 instance created by Bitor for a scan
+type ScanInstance struct {
+	ID         string
+	Name       string
+	ScanID     string
+	State      string
+	LaunchTime time.Time
+}
+
+// newEC2Client creates an EC2 client for a provider in a region
+func newEC2Client(ctx context.Context, app *pocketbase.PocketBase, providerID string, region string) (*ec2.Client, error) {
+	accessKeyID, secretAccessKey, err := getAWSCredentials(app, providerID)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := createAWSConfig(ctx, accessKeyID, secretAccessKey, region)
+	if err != nil {
+		return nil, err
+	}
+
+	return ec2.NewFromConfig(cfg), nil
+}
+
+// ListScanInstances lists the instances in a region that the terraform
+// templates tagged as managed by Bitor, and haven't been terminated
+func ListScanInstances(ctx context.Context, app *pocketbase.PocketBase, providerID string, region string) ([]ScanInstance, error) {
+	ec2Client, err := newEC2Client(ctx, app, providerID, region)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:ManagedBy"), Values: []string{"Bitor"}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	}
+
+	var instances []ScanInstance
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %w", err)
+		}
+
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				scanInstance := ScanInstance{
+					ID:         aws.ToString(instance.InstanceId),
+					LaunchTime: aws.ToTime(instance.LaunchTime),
+				}
+				if instance.State != nil {
+					scanInstance.State = string(instance.State.Name)
+				}
+				for _, tag := range instance.Tags {
+					switch aws.ToString(tag.Key) {
+					case "Name":
+						scanInstance.Name = aws.ToString(tag.Value)
+					case "ScanID":
+						scanInstance.ScanID = aws.ToString(tag.Value)
+					}
+				}
+				instances = append(instances, scanInstance)
+			}
+		}
+	}
+
+	return instances, nil
+}
+
+// TerminateScanInstance terminates an instance created for a scan and
+// releases the Elastic IPs tagged with the same scan ID, which would
+// otherwise keep being billed after the instance is gone
+func TerminateScanInstance(ctx context.Context, app *pocketbase.PocketBase, providerID string, region string, instanceID string, scanID string) error {
+	ec2Client, err := newEC2Client(ctx, app, providerID, region)
+	if err != nil {
+		return err
+	}
+
+	if scanID != "" {
+		addresses, err := ec2Client.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+			Filters: []types.Filter{
+				{Name: aws.String("tag:ManagedBy"), Values: []string{"Bitor"}},
+				{Name: aws.String("tag:ScanID"), Values: []string{scanID}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to describe addresses: %w", err)
+		}
+
+		for _, address := range addresses.Addresses {
+			if address.AssociationId != nil {
+				if _, err := ec2Client.DisassociateAddress(ctx, &ec2.DisassociateAddressInput{
+					AssociationId: address.AssociationId,
+				}); err != nil {
+					return fmt.Errorf("failed to disassociate address %s: %w", aws.ToString(address.PublicIp), err)
+				}
+			}
+			if _, err := ec2Client.ReleaseAddress(ctx, &ec2.ReleaseAddressInput{
+				AllocationId: address.AllocationId,
+			}); err != nil {
+				return fmt.Errorf("failed to release address %s: %w", aws.ToString(address.PublicIp), err)
+			}
+		}
+	}
+
+	if _, err := ec2Client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []string{instanceID},
+	}); err != nil {
+		return fmt.Errorf("failed to terminate instance %s: %w", instanceID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package digitalocean
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	// ScanTag is set on every droplet the terraform templates create
+	ScanTag = "bitor"
+	// scanIDTagPrefix prefixes the tag holding the ID of a droplet's scan
+	scanIDTagPrefix = "bitor-scan-"
+)
+
+// ScanDroplet is a droplet created by Bitor for a scan
+type ScanDroplet struct {
+	ID      int
+	Name    string
+	ScanID  string
+	Region  string
+	Created time.Time
+}
+
+// ListScanDroplets lists the droplets the terraform templates tagged as
+// created by Bitor
+func ListScanDroplets(ctx context.Context, apiKey string) ([]ScanDroplet, error) {
+	client := godo.NewFromToken(apiKey)
+
+	opt := &godo.ListOptions{
+		Page:    1,
+		PerPage: 200, // Maximum allowed by DigitalOcean API
+	}
+
+	var droplets []ScanDroplet
+	for {
+		page, resp, err := client.Droplets.ListByTag(ctx, ScanTag, opt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list droplets: %w", err)
+		}
+
+		for _, droplet := range page {
+			scanDroplet := ScanDroplet{
+				ID:   droplet.ID,
+				Name: droplet.Name,
+			}
+			if droplet.Region != nil {
+				scanDroplet.Region = droplet.Region.Slug
+			}
+			if created, err := time.Parse(time.RFC3339, droplet.Created); err == nil {
+				scanDroplet.Created = created
+			}
+			for _, tag := range droplet.Tags {
+				if strings.HasPrefix(tag, scanIDTagPrefix) {
+					scanDroplet.ScanID = strings.TrimPrefix(tag, scanIDTagPrefix)
+				}
+			}
+			droplets = append(droplets, scanDroplet)
+		}
+
+		// Check if we've reached the last page
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		current, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current page: %w", err)
+		}
+		opt.Page = current + 1
+	}
+
+	return droplets, nil
+}
+
+// DeleteScanDroplet deletes a droplet created for a scan
+func DeleteScanDroplet(ctx context.Context, apiKey string, dropletID int) error {
+	client := godo.NewFromToken(apiKey)
+
+	if _, err := client.Droplets.Delete(ctx, dropletID); err != nil {
+		return fmt.Errorf("failed to delete droplet %d: %w", dropletID, err)
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -11,6 +12,7 @@ import (
 	"bitor/providers/aws"
 	"bitor/providers/digitalocean"
 	"bitor/scan"
+	scanHandlers "bitor/scan/handlers"
 	"bitor/scan/profiles"
 	scanTemplates "bitor/scan/templates"
 	"bitor/scheduler"
@@ -24,7 +26,14 @@ import (
 	"github.com/pocketbase/pocketbase/core"
 )
 
-var scanScheduler *scheduler.ScanScheduler
+var (
+	scanScheduler  *scheduler.ScanScheduler
+	scanQueue      *services.ScanQueue
+	scanReconciler *services.ScanReconciler
+	scanEnforcer   *services.ScanWindowEnforcer
+	scanWatchdog   *services.ScanRuntimeWatchdog
+	vmReaper       *services.VMReaper
+)
 
 // InitNotificationService initializes the notification service with settings from the database
 func InitNotificationService(app *pocketbase.PocketBase) (*notification.NotificationService, error) {
@@ -217,12 +226,36 @@ func RegisterRoutes(app *pocketbase.PocketBase, ansibleBasePath string, notifica
 	// Register findings routes
 	RegisterFindingsRoutes(app, e, findingManager)
 
+	// Create the scan job queue shared by the start endpoint and the scheduler
+	scanQueue = services.NewScanQueue(app, scanHandlers.RunScanJob(app, ansibleBasePath))
+
+	// Create the reconciler for scans left unfinished by a restart
+	scanReconciler = services.NewScanReconciler(app, ansibleBasePath, notificationService)
+
+	// Create the enforcer that stops scans when their client's scan window closes
+	scanEnforcer = services.NewScanWindowEnforcer(app, ansibleBasePath, scanQueue)
+	services.RegisterScanPolicyValidation(app)
+
+	// Create the watchdog that times out scans running past their profile's max runtime
+	scanWatchdog = services.NewScanRuntimeWatchdog(app, ansibleBasePath, scanQueue)
+
+	// Create the reaper for cloud VMs that outlived their scans
+	vmReaper = services.NewVMReaper(app, notificationService)
+	services.RegisterShardHooks(app, ansibleBasePath)
+
+	// Create the budget service that keeps scans within the monthly budgets
+	budgetService := services.NewBudgetService(app, notificationService)
+	budgetService.RegisterHooks()
+
+	// Create the scan scheduler; it is started once the routes are registered
+	scanScheduler = scheduler.NewScanScheduler(app, ansibleBasePath, scanQueue, budgetService)
+
 	// Create a base group for API routes
 	apiGroup := e.Router.Group("/api")
 
 	// Register all routes
 	providers.RegisterRoutes(app, apiGroup)
-	scan.RegisterRoutes(app, e, ansibleBasePath, notificationService)
+	scan.RegisterRoutes(app, e, ansibleBasePath, notificationService, scanQueue, scanReconciler, scanScheduler, budgetService, vmReaper)
 	findings.RegisterRoutes(app, e, findingManager)
 	templates.RegisterRoutes(app, e)
 	scanTemplates.RegisterRoutes(app, apiGroup)
@@ -255,17 +288,48 @@ func RegisterRoutes(app *pocketbase.PocketBase, ansibleBasePath string, notifica
 		log.Printf("Failed to apply email settings: %v", err)
 	}
 
+	// Fail scan imports interrupted by the last shutdown, so their results can be uploaded again
+	if recovered, err := services.RecoverInterruptedScanImports(app); err != nil {
+		log.Printf("Error recovering interrupted scan imports: %v", err)
+	} else if recovered > 0 {
+		log.Printf("Failed %d scan imports interrupted by the last shutdown", recovered)
+	}
+
+	// Reconcile scans left unfinished by the last shutdown, then start the
+	// scan queue workers. The workers only start once reconciliation is done,
+	// so the reconciler never fails or destroys a scan a job is deploying.
+	// Destroying VMs can take minutes, so this runs in the background.
+	go func() {
+		if _, err := scanReconciler.Run(context.Background()); err != nil {
+			log.Printf("Error reconciling unfinished scans: %v", err)
+		}
+
+		scanQueue.Start()
+		log.Println("Scan queue started.")
+	}()
+
+	// Start enforcing client scan windows on running scans
+	scanEnforcer.Start()
+	log.Println("Scan window enforcer started.")
+
+	// Start timing out scans that run past their max runtime
+	scanWatchdog.Start()
+	log.Println("Scan runtime watchdog started.")
+
+	// Start looking for cloud VMs that outlived their scans
+	vmReaper.Start()
+	log.Println("Orphaned VM reaper started.")
+
 	// Start the scan scheduler with the ansible base path
-	scanScheduler = scheduler.NewScanScheduler(app, ansibleBasePath)
 	log.Printf("Starting scan scheduler with ansible base path: %s", ansibleBasePath)
 	scanScheduler.Start()
 	log.Println("Scan Scheduler started.")
 
-	// Start the cost calculation scheduler
-	if _, err := scheduler.StartScheduler(app); err != nil {
-		log.Printf("Error starting cost calculation scheduler: %v", err)
+	// Start the scheduler for scan costs and overdue findings
+	if _, err := scheduler.StartScheduler(app, notificationService); err != nil {
+		log.Printf("Error starting periodic task scheduler: %v", err)
 	} else {
-		log.Println("Cost calculation scheduler started.")
+		log.Println("Periodic task scheduler started.")
 	}
 
 	return nil
@@ -277,4 +341,20 @@ func StopScheduler() {
 		scanScheduler.Stop()
 		log.Println("Scan Scheduler stopped.")
 	}
+	if scanEnforcer != nil {
+		scanEnforcer.Stop()
+		log.Println("Scan window enforcer stopped.")
+	}
+	if scanWatchdog != nil {
+		scanWatchdog.Stop()
+		log.Println("Scan runtime watchdog stopped.")
+	}
+	if vmReaper != nil {
+		vmReaper.Stop()
+		log.Println("Orphaned VM reaper stopped.")
+	}
+	if scanQueue != nil {
+		scanQueue.Stop()
+		log.Println("Scan queue stopped.")
+	}
 }
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v5"
+
+	"bitor/services"
+)
+
+// HandleGetBudgetReport returns this month's spending and projected cost
+// against the global, provider and client budgets
+func HandleGetBudgetReport(budget *services.BudgetService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		report, err := budget.Report(time.Now())
+		if err != nil {
+			log.Printf("Failed to compute budget report: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to compute budget report",
+			})
+		}
+
+		return c.JSON(http.StatusOK, report)
+	}
+}
@@ -1,16 +1,17 @@
 package handlers
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase"
 
 	"bitor/models"
+	"bitor/scan/lifecycle"
 	"bitor/scan/utils"
 )
 
@@ -40,6 +41,14 @@ func HandleDestroyScan(app *pocketbase.PocketBase, ansibleBasePath string) echo.
 			})
 		}
 
+		// Check that the scan can be destroyed from its current status before touching its VM
+		currentStatus := record.GetString("status")
+		if currentStatus != lifecycle.StatusDestroyed && !lifecycle.CanTransition(currentStatus, lifecycle.StatusDestroyed) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": fmt.Sprintf("Scan cannot be destroyed while it is %s", currentStatus),
+			})
+		}
+
 		// Define the path to the destroy playbook
 		playbookPath := filepath.Join(ansibleBasePath, "scans", scanReq.ScanID, "destroy.yml")
 		logDir := filepath.Join(ansibleBasePath, "scans", scanReq.ScanID, "logs")
@@ -62,15 +71,8 @@ func HandleDestroyScan(app *pocketbase.PocketBase, ansibleBasePath string) echo.
 			})
 		}
 
-		// Get current time in RFC3339 format
-		currentTime := time.Now().Format(time.RFC3339)
-
-		// Update the scan record to set destroyed=true, end_time, and vm_stop_time
-		record.Set("destroyed", true)
-		record.Set("end_time", currentTime)
-		record.Set("vm_stop_time", currentTime)
-
-		if err := app.Dao().SaveRecord(record); err != nil {
+		// Destroyed sets destroyed, end_time and vm_stop_time with the status
+		if _, err := lifecycle.Transition(app, scanReq.ScanID, lifecycle.StatusDestroyed, requestActor(c), "VM destroyed on request"); err != nil {
 			log.Printf("Failed to update scan record: %v", err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{
 				"error": "Failed to update scan record",
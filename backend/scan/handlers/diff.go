@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+
+	"bitor/services"
+)
+
+// HandleScanDiff compares the findings of two scans of the same client:
+// GET /api/scan/diff?base=<scan>&head=<scan>[&format=csv]
+func HandleScanDiff(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// A scan API key only authorizes calls about its own scan
+		if requestActor(c) == "api-key-auth" {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "Scans cannot be compared with a scan API key",
+			})
+		}
+
+		baseID := c.QueryParam("base")
+		headID := c.QueryParam("head")
+		if baseID == "" || headID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "base and head scan IDs are required",
+			})
+		}
+
+		format := c.QueryParam("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "format must be json or csv",
+			})
+		}
+
+		for _, scanID := range []string{baseID, headID} {
+			if _, err := app.Dao().FindRecordById("nuclei_scans", scanID); err != nil {
+				return c.JSON(http.StatusNotFound, map[string]string{
+					"error": fmt.Sprintf("Scan %s not found", scanID),
+				})
+			}
+		}
+
+		diff, err := services.DiffScans(app, baseID, headID)
+		if err != nil {
+			if errors.Is(err, services.ErrScanDiffClientMismatch) {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": "Scans belong to different clients and can't be compared",
+				})
+			}
+			log.Printf("Failed to diff scans %s and %s: %v", baseID, headID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to compare scans",
+			})
+		}
+
+		if format == "csv" {
+			return writeScanDiffCSV(c, diff)
+		}
+		return c.JSON(http.StatusOK, diff)
+	}
+}
+
+// writeScanDiffCSV writes one row per finding of a scan diff
+func writeScanDiffCSV(c echo.Context, diff *services.ScanDiff) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv")
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=\"scan-diff-%s-%s.csv\"", diff.Base.ID, diff.Head.ID))
+	c.Response().WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(c.Response())
+	rows := [][]string{{"change", "severity", "host", "name", "template_id", "matched_at", "status", "hash", "finding_id"}}
+	for _, finding := range diff.Findings() {
+		rows = append(rows, []string{
+			finding.Change,
+			finding.Severity,
+			finding.Host,
+			finding.Name,
+			finding.TemplateID,
+			finding.MatchedAt,
+			finding.Status,
+			finding.Hash,
+			finding.ID,
+		})
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		log.Printf("Failed to write scan diff CSV: %v", err)
+		return err
+	}
+	return nil
+}
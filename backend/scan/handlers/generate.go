@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"path/filepath"
@@ -9,6 +11,7 @@ import (
 	"github.com/pocketbase/pocketbase"
 
 	"bitor/models"
+	"bitor/scan/lifecycle"
 	"bitor/scan/utils"
 )
 
@@ -34,7 +37,7 @@ func HandleGenerateScan(app *pocketbase.PocketBase, ansibleBasePath string) echo
 			})
 		}
 
-		// Update scan status to "Running"
+		// Update scan status to "Generating"
 		record, err := app.Dao().FindRecordById("nuclei_scans", scanReq.ScanID)
 		if err != nil {
 			return c.JSON(http.StatusNotFound, map[string]string{
@@ -42,8 +45,12 @@ func HandleGenerateScan(app *pocketbase.PocketBase, ansibleBasePath string) echo
 			})
 		}
 
-		record.Set("status", "Generating")
-		if err := app.Dao().SaveRecord(record); err != nil {
+		if _, err := lifecycle.Transition(app, scanReq.ScanID, lifecycle.StatusGenerating, requestActor(c), "scan code generation requested"); err != nil {
+			if errors.Is(err, lifecycle.ErrInvalidTransition) {
+				return c.JSON(http.StatusConflict, map[string]string{
+					"error": fmt.Sprintf("Scan cannot be generated while it is %s", record.GetString("status")),
+				})
+			}
 			return c.JSON(http.StatusInternalServerError, map[string]string{
 				"error": "Failed to update scan status",
 			})
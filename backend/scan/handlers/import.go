@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,9 +11,11 @@ import (
 	"bitor/services/notification"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase"
@@ -22,50 +25,35 @@ import (
 	bitorModels "bitor/models"
 )
 
-// chunkInfo stores information about uploaded chunks
-type chunkInfo struct {
-	TotalChunks int
-	Chunks      map[int]bool
-	FilePath    string
-}
+// scanImportLocks serializes the imports into the same scan, like those of
+// shards that share a parent scan or streamed batches, since they all update
+// the same rollup
+var scanImportLocks sync.Map
 
-// In-memory store for chunk tracking
-var (
-	chunkTracker = make(map[string]*chunkInfo)
-	chunkMutex   sync.Mutex
-)
+// findingBatchSize is the number of findings persisted per transaction
+const findingBatchSize = 500
 
 // Initialize services
 var (
 	findingManager      *services.FindingManager
 	scanEventService    *services.ScanEventService
 	notificationService *notification.NotificationService
+	scanUploadService   *services.ScanUploadService
 )
 
 // InitHandlers initializes the handlers with required services
 func InitHandlers(app *pocketbase.PocketBase, ns *notification.NotificationService) {
 	notificationService = ns
 	findingManager = services.NewFindingManager(app, notificationService)
+	findingManager.RegisterResolutionHooks()
 	scanEventService = services.NewScanEventService(app, findingManager)
+	scanUploadService = services.NewScanUploadService(app)
+	registerLifecycleNotifications()
 }
 
 func HandleImportNucleiScanResults(app *pocketbase.PocketBase) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		// Get the current user or admin from context
-		admin, _ := c.Get(apis.ContextAdminKey).(*pbModels.Admin)
-		record, _ := c.Get(apis.ContextAuthRecordKey).(*pbModels.Record)
-
-		// Get user ID (either from admin, regular user, or fallback for API key auth)
-		var userID string
-		if admin != nil {
-			userID = admin.Id
-		} else if record != nil {
-			userID = record.Id
-		} else {
-			// If neither admin nor user is set, this request was authenticated via API key
-			// by the middleware, so we'll use the scan's created_by field later
-			userID = "api-key-auth"
-		}
+		userID := importUserID(c)
 
 		// Retrieve form values
 		clientID := c.FormValue("client_id")
@@ -115,17 +103,20 @@ func HandleImportNucleiScanResults(app *pocketbase.PocketBase) echo.HandlerFunc
 				})
 			}
 
-			chunkMutex.Lock()
-			info, exists := chunkTracker[scanID]
-			if !exists {
-				info = &chunkInfo{
-					TotalChunks: totalChunks,
-					Chunks:      make(map[int]bool),
-					FilePath:    filepath.Join(tempDir, fmt.Sprintf("%s.json", scanID)),
-				}
-				chunkTracker[scanID] = info
+			if chunkIndex < 0 || totalChunks < 1 {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": "Invalid chunk_index or total_chunks",
+				})
+			}
+
+			// Chunks are stored by index, so chunks that arrive out of order or
+			// are retried don't corrupt the file
+			chunkDir := filepath.Join(tempDir, fmt.Sprintf("%s.chunks", scanID))
+			if err := os.MkdirAll(chunkDir, 0755); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{
+					"error": "Failed to create chunk directory",
+				})
 			}
-			chunkMutex.Unlock()
 
 			// Open chunk file
 			src, err := file.Open()
@@ -136,36 +127,40 @@ func HandleImportNucleiScanResults(app *pocketbase.PocketBase) echo.HandlerFunc
 			}
 			defer src.Close()
 
-			// Open or create the destination file in append mode
-			dest, err := os.OpenFile(info.FilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-			if err != nil {
+			if err := writeChunkFile(chunkDir, chunkIndex, src); err != nil {
+				log.Printf("Failed to write chunk %d of scan %s: %v", chunkIndex, scanID, err)
 				return c.JSON(http.StatusInternalServerError, map[string]string{
-					"error": "Failed to create destination file",
+					"error": "Failed to write chunk",
 				})
 			}
-			defer dest.Close()
 
-			// Copy chunk data
-			if _, err := io.Copy(dest, src); err != nil {
+			chunkIndexes, err := storedChunkIndexes(chunkDir)
+			if err != nil {
 				return c.JSON(http.StatusInternalServerError, map[string]string{
-					"error": "Failed to write chunk",
+					"error": "Failed to read chunks",
 				})
 			}
-
-			// Mark chunk as received
-			chunkMutex.Lock()
-			info.Chunks[chunkIndex] = true
-			receivedChunks := len(info.Chunks)
-			isComplete := receivedChunks == info.TotalChunks
-			chunkMutex.Unlock()
+			receivedChunks := len(chunkIndexes)
 
 			// If all chunks received, process the file
-			if isComplete {
+			if receivedChunks == totalChunks {
+				filePath := uploadFilePath(tempDir, scanID)
+				assembled, err := assembleChunks(chunkDir, chunkIndexes, filePath)
+				if err != nil {
+					log.Printf("Failed to assemble chunks of scan %s: %v", scanID, err)
+					return c.JSON(http.StatusInternalServerError, map[string]string{
+						"error": "Failed to assemble chunks",
+					})
+				}
+				// Another request completing at the same time assembles the file
+				if !assembled {
+					return c.JSON(http.StatusOK, map[string]string{
+						"status": "All chunks received and processing started",
+					})
+				}
+
 				log.Printf("All chunks received for scan %s, starting processing", scanID)
-				go processFile(app, info.FilePath, scanID, clientID, userID)
-				return c.JSON(http.StatusOK, map[string]string{
-					"status": "All chunks received and processing started",
-				})
+				return respondQueuedImport(c, app, filePath, scanID, clientID, userID, services.ScanImportSourceChunked, "")
 			}
 
 			return c.JSON(http.StatusOK, map[string]string{
@@ -173,7 +168,7 @@ func HandleImportNucleiScanResults(app *pocketbase.PocketBase) echo.HandlerFunc
 			})
 		} else {
 			// Handle single file upload
-			filePath := filepath.Join(tempDir, fmt.Sprintf("%s.json", scanID))
+			filePath := uploadFilePath(tempDir, scanID)
 
 			// Open the uploaded file
 			src, err := file.Open()
@@ -195,23 +190,196 @@ func HandleImportNucleiScanResults(app *pocketbase.PocketBase) echo.HandlerFunc
 
 			// Copy file data
 			if _, err := io.Copy(dest, src); err != nil {
+				os.Remove(filePath)
 				return c.JSON(http.StatusInternalServerError, map[string]string{
 					"error": "Failed to write file",
 				})
 			}
+			dest.Close()
 
 			log.Printf("Processing file for scan %s", scanID)
-			processFile(app, filePath, scanID, clientID, userID)
+			return respondQueuedImport(c, app, filePath, scanID, clientID, userID, services.ScanImportSourceUpload, "")
+		}
+	}
+}
 
-			return c.JSON(http.StatusOK, map[string]string{
-				"status": "File processed successfully",
+// HandleGetImport returns the state and counts of an import:
+// GET /api/imports/:id[?scan_id=<scan>]
+func HandleGetImport(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		status, err := services.GetScanImport(app, c.PathParam("id"))
+		// API key requests are authorized for the scan they name only
+		if err != nil || (c.QueryParam("scan_id") != "" && c.QueryParam("scan_id") != status.ScanID) {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Import not found",
 			})
 		}
+
+		return c.JSON(http.StatusOK, status)
+	}
+}
+
+// queueImport registers the import of a results file and processes it in the
+// background. A file that was already imported into the scan's current run
+// isn't processed again: its import is returned with true and the file is
+// removed. An empty checksum is computed from the file.
+func queueImport(app *pocketbase.PocketBase, filePath, scanID, clientID, userID, source, checksum string) (*pbModels.Record, bool, error) {
+	imp, duplicate, err := registerImport(app, filePath, scanID, clientID, userID, source, checksum)
+	if err != nil || duplicate {
+		os.Remove(filePath)
+		return imp, duplicate, err
 	}
+
+	go processFile(app, imp.Id, filePath, scanID, clientID, userID)
+	return imp, false, nil
 }
 
-// processFile handles the processing of the complete file
-func processFile(app *pocketbase.PocketBase, filePath string, scanID string, clientID string, userID string) {
+// registerImport creates the import record of a results file without processing it
+func registerImport(app *pocketbase.PocketBase, filePath, scanID, clientID, userID, source, checksum string) (*pbModels.Record, bool, error) {
+	scan, err := app.Dao().FindRecordById("nuclei_scans", scanID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to find scan: %v", err)
+	}
+
+	if checksum == "" {
+		if checksum, err = services.FileSHA256(filePath); err != nil {
+			return nil, false, fmt.Errorf("failed to hash results file: %v", err)
+		}
+	}
+
+	return services.QueueScanImport(app, scan, clientID, userID, source, checksum)
+}
+
+// respondQueuedImport queues the import of a results file and answers with
+// the import the client can poll
+func respondQueuedImport(c echo.Context, app *pocketbase.PocketBase, filePath, scanID, clientID, userID, source, checksum string) error {
+	imp, duplicate, err := queueImport(app, filePath, scanID, clientID, userID, source, checksum)
+	if err != nil {
+		log.Printf("Failed to queue import for scan %s: %v", scanID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to queue import",
+		})
+	}
+	return respondImport(c, imp, duplicate)
+}
+
+// respondImport answers with a queued import, or with the earlier import of
+// the same file if it is a duplicate
+func respondImport(c echo.Context, imp *pbModels.Record, duplicate bool) error {
+	status := "Import queued"
+	if duplicate {
+		status = "File already imported"
+	}
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"status":    status,
+		"import_id": imp.Id,
+		"duplicate": duplicate,
+		"import":    services.ScanImportStatusOf(imp),
+	})
+}
+
+// uploadFilePath returns a new file name for an uploaded results file, so
+// uploads for the same scan waiting to be processed don't overwrite each other
+func uploadFilePath(tempDir, scanID string) string {
+	return filepath.Join(tempDir, fmt.Sprintf("%s_%d.json", scanID, time.Now().UnixNano()))
+}
+
+// importUserID returns the user an import is made for: the current user or
+// admin, or "api-key-auth" for a request authenticated with the scan's API
+// key, in which case findings are attributed to the scan's creator
+func importUserID(c echo.Context) string {
+	// Get the current user or admin from context
+	admin, _ := c.Get(apis.ContextAdminKey).(*pbModels.Admin)
+	record, _ := c.Get(apis.ContextAuthRecordKey).(*pbModels.Record)
+
+	if admin != nil {
+		return admin.Id
+	}
+	if record != nil {
+		return record.Id
+	}
+	return "api-key-auth"
+}
+
+// writeChunkFile stores a chunk under its index. The chunk is written to a
+// temporary file first, so a retried chunk replaces the previous attempt whole.
+func writeChunkFile(chunkDir string, chunkIndex int, src io.Reader) error {
+	tmp, err := os.CreateTemp(chunkDir, "upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(chunkDir, fmt.Sprintf("%d.part", chunkIndex)))
+}
+
+// storedChunkIndexes returns the indexes of the chunks stored in chunkDir, in order
+func storedChunkIndexes(chunkDir string) ([]int, error) {
+	entries, err := os.ReadDir(chunkDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []int
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".part")
+		if !ok {
+			continue
+		}
+		if index, err := strconv.Atoi(name); err == nil {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+// assembleChunks concatenates the chunks in index order into filePath and
+// removes chunkDir. Only one caller assembles a set of chunks: the others get
+// false.
+func assembleChunks(chunkDir string, indexes []int, filePath string) (bool, error) {
+	// Claim the chunks by moving them out of the way of other requests
+	claimed := chunkDir + ".assembling"
+	if err := os.Rename(chunkDir, claimed); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer os.RemoveAll(claimed)
+
+	dest, err := os.Create(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer dest.Close()
+
+	for _, index := range indexes {
+		chunk, err := os.Open(filepath.Join(claimed, fmt.Sprintf("%d.part", index)))
+		if err != nil {
+			return false, err
+		}
+		_, err = io.Copy(dest, chunk)
+		chunk.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// processFile handles the processing of the complete file and records the
+// progress and outcome on its import
+func processFile(app *pocketbase.PocketBase, importID string, filePath string, scanID string, clientID string, userID string) {
 	var logger *log.Logger
 
 	// Create logs directory if it doesn't exist
@@ -238,17 +406,28 @@ func processFile(app *pocketbase.PocketBase, filePath string, scanID string, cli
 
 	defer os.Remove(filePath)
 
-	// Get the scan record to check its status
+	failImport := func(err error) {
+		logger.Printf("[ERROR] %v", err)
+		if err := services.FailScanImport(app, importID, err); err != nil {
+			logger.Printf("[ERROR] Failed to record import failure: %v", err)
+		}
+	}
+
+	if err := services.StartScanImportParsing(app, importID); err != nil {
+		logger.Printf("[ERROR] Failed to update import %s: %v", importID, err)
+	}
+
+	// Get the scan record
 	record, err := app.Dao().FindRecordById("nuclei_scans", scanID)
 	if err != nil {
-		logger.Printf("[ERROR] Failed to find scan record: %v", err)
+		failImport(fmt.Errorf("failed to find scan record: %v", err))
 		return
 	}
 
 	// Read the complete file
 	jsonData, err := os.ReadFile(filePath)
 	if err != nil {
-		logger.Printf("[ERROR] Failed to read complete file: %v", err)
+		failImport(fmt.Errorf("failed to read complete file: %v", err))
 		return
 	}
 
@@ -264,12 +443,16 @@ func processFile(app *pocketbase.PocketBase, filePath string, scanID string, cli
 		// Try to parse as single finding
 		var singleFinding bitorModels.NucleiFinding
 		if err := json.Unmarshal(jsonData, &singleFinding); err != nil {
-			logger.Printf("[ERROR] Failed to parse JSON as single finding: %v", err)
+			failImport(fmt.Errorf("failed to parse JSON as single finding: %v", err))
 			return
 		}
 		findings = []bitorModels.NucleiFinding{singleFinding}
 	}
 
+	if err := services.StartScanImportProcessing(app, importID, len(findings)); err != nil {
+		logger.Printf("[ERROR] Failed to update import %s: %v", importID, err)
+	}
+
 	// Log the actual number of findings
 	logger.Printf("[DEBUG] ===== Findings Summary =====")
 	logger.Printf("[DEBUG] Raw JSON size: %d bytes", len(jsonData))
@@ -285,16 +468,6 @@ func processFile(app *pocketbase.PocketBase, filePath string, scanID string, cli
 	}
 	logger.Printf("[DEBUG] =========================")
 
-	// Only update status if it's not a manual scan
-	currentStatus := record.GetString("status")
-	if currentStatus != "Manual" {
-		record.Set("status", "Finished")
-		if err := app.Dao().SaveRecord(record); err != nil {
-			logger.Printf("[ERROR] Failed to update scan status: %v", err)
-			return
-		}
-	}
-
 	// Get the created_by from the scan record
 	scanCreatedBy := record.GetString("created_by")
 	if scanCreatedBy == "" || userID == "api-key-auth" {
@@ -306,16 +479,35 @@ func processFile(app *pocketbase.PocketBase, filePath string, scanID string, cli
 	}
 	logger.Printf("[DEBUG] Using created_by: %s for findings", userID)
 
+	// Findings of a shard belong to the scan it was split from
+	resultsScanID := resultsScanIDOf(record)
+	if resultsScanID != scanID {
+		logger.Printf("[INFO] Scan %s is a shard, importing findings into scan %s", scanID, resultsScanID)
+	}
+	unlock := lockScanImport(resultsScanID)
+	defer unlock()
+
 	// Process findings in parallel
-	processFindings(app, findings, clientID, scanID, logger, userID)
+	counts := processFindings(app, findings, clientID, resultsScanID, logger, userID, false)
+
+	// Create user message about import completion
+	notifyImportCompleted(app, clientID, resultsScanID, counts, logger)
 
-	// Trigger scan finished event to create nuclei_findings_rollup
+	// Trigger scan finished event to mark the scan as finished and create nuclei_findings_rollup
 	if err := scanEventService.HandleScanFinished(scanID); err != nil {
 		logger.Printf("[ERROR] Error triggering scan finished event: %v", err)
 	}
 
 	// Clean up the scan tracker after processing is complete
-	findingManager.FinalizeScan(scanID)
+	findingManager.FinalizeScan(resultsScanID)
+
+	if err := services.FinishScanImport(app, importID, counts); err != nil {
+		logger.Printf("[ERROR] Failed to update import %s: %v", importID, err)
+	}
+
+	// Resolution waits for the imports of a finished scan, the last one triggers it
+	findingManager.ResolveFinishedScan(resultsScanID)
+
 	logger.Printf("[INFO] Import process completed for scan %s", scanID)
 }
 
@@ -337,8 +529,9 @@ func getSeverityOrder(severity string) int {
 	}
 }
 
-// Process findings in parallel
-func processFindings(app *pocketbase.PocketBase, findings []bitorModels.NucleiFinding, clientID string, scanID string, logger *log.Logger, userID string) {
+// Process findings in parallel. With notify set, new findings are notified as
+// they are saved instead of only being summed up when the scan completes.
+func processFindings(app *pocketbase.PocketBase, findings []bitorModels.NucleiFinding, clientID string, scanID string, logger *log.Logger, userID string, notify bool) services.ScanImportCounts {
 	logger.Printf("[DEBUG] Starting processFindings for scan %s with %d total findings", scanID, len(findings))
 	logger.Printf("[DEBUG] Using userID %s for created_by field", userID)
 
@@ -351,11 +544,16 @@ func processFindings(app *pocketbase.PocketBase, findings []bitorModels.NucleiFi
 	// Map to track duplicate counts by template
 	duplicatesByTemplate := make(map[string]int)
 
+	// Findings that couldn't be converted or saved, and those only failing to save
+	processingErrors := 0
+	unsaved := 0
+
 	// First pass: identify unique findings and check for hash collisions
 	for _, finding := range findings {
 		newFinding, err := bitorModels.NewFindingFromNuclei(finding, clientID, scanID, userID)
 		if err != nil {
 			logger.Printf("[ERROR] Error creating finding: %v", err)
+			processingErrors++
 			continue
 		}
 
@@ -412,39 +610,50 @@ func processFindings(app *pocketbase.PocketBase, findings []bitorModels.NucleiFi
 		logger.Printf("[DEBUG]   - %s: %d duplicates", templateID, count)
 	}
 
-	// Process each unique finding and track counts
+	// Persist the unique findings in batches, each in its own transaction
+	unique := make([]*bitorModels.Finding, 0, len(findingsMap))
+	for _, entry := range findingsMap {
+		unique = append(unique, entry.finding)
+	}
+
 	totalNew := 0
 	duplicatesInDB := 0
-	totalProcessed := len(findingsMap)
+	totalProcessed := 0
 
-	// Process each unique finding once
-	for hash, entry := range findingsMap {
-		logger.Printf("[DEBUG] Processing hash %s", hash[:8])
+	for start := 0; start < len(unique); start += findingBatchSize {
+		end := start + findingBatchSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+		batch := unique[start:end]
 
-		// Process finding through manager
-		isDuplicate, err := findingManager.ProcessFinding(entry.finding)
+		result, err := findingManager.ProcessFindings(batch)
 		if err != nil {
-			logger.Printf("[ERROR] Error processing finding: %v", err)
+			logger.Printf("[ERROR] Error processing batch of %d findings: %v", len(batch), err)
+			processingErrors += len(batch)
+			unsaved += len(batch)
 			continue
 		}
-		logger.Printf("[DEBUG] Hash %s isDuplicate: %v", hash[:8], isDuplicate)
-
-		if isDuplicate {
-			duplicatesInDB++
-			logger.Printf("[DEBUG] Hash %s is duplicate in DB, total duplicatesInDB: %d", hash[:8], duplicatesInDB)
-		} else {
-			totalNew++
-			logger.Printf("[DEBUG] Hash %s is new, total new: %d", hash[:8], totalNew)
+		totalProcessed += len(batch)
+		totalNew += len(result.New)
+		duplicatesInDB += result.Duplicates
+		logger.Printf("[DEBUG] Batch of %d findings: %d new, %d duplicates in DB", len(batch), len(result.New), result.Duplicates)
+
+		if notify {
+			for _, finding := range result.New {
+				if err := findingManager.NotifyNewFinding(context.Background(), finding); err != nil {
+					logger.Printf("[ERROR] Error notifying finding: %v", err)
+				}
+			}
 		}
-	}
 
-	// Get scan name for the notification
-	scanRecord, err := app.Dao().FindRecordById("nuclei_scans", scanID)
-	if err != nil {
-		logger.Printf("[ERROR] Error getting scan name: %v", err)
-		return
+		// Regressions are notified even when new findings are only summed up
+		for _, finding := range result.Reopened {
+			if err := findingManager.NotifyRegression(context.Background(), finding); err != nil {
+				logger.Printf("[ERROR] Error notifying regression: %v", err)
+			}
+		}
 	}
-	scanName := scanRecord.GetString("name")
 
 	// Verify our counts add up
 	if totalNew+duplicatesInDB != totalProcessed {
@@ -459,9 +668,28 @@ func processFindings(app *pocketbase.PocketBase, findings []bitorModels.NucleiFi
 	logger.Printf("[DEBUG] - New findings: %d", totalNew)
 	logger.Printf("[DEBUG] - Duplicates in database: %d", duplicatesInDB)
 
-	// Create user message about import completion
+	return services.ScanImportCounts{
+		Parsed:     len(findings),
+		Unique:     len(findingsMap),
+		New:        totalNew,
+		Duplicates: duplicatesInDB,
+		Errors:     processingErrors,
+		Unsaved:    unsaved,
+	}
+}
+
+// notifyImportCompleted tells the scan's creator how many findings the scan produced
+func notifyImportCompleted(app *pocketbase.PocketBase, clientID string, scanID string, counts services.ScanImportCounts, logger *log.Logger) {
+	// Get scan name for the notification
+	scanRecord, err := app.Dao().FindRecordById("nuclei_scans", scanID)
+	if err != nil {
+		logger.Printf("[ERROR] Error getting scan name: %v", err)
+		return
+	}
+	scanName := scanRecord.GetString("name")
+
 	message := fmt.Sprintf("Scan '%s' completed: %d total findings (%d new, %d duplicates in database)",
-		scanName, len(findings), totalNew, duplicatesInDB)
+		scanName, counts.Parsed, counts.New, counts.Duplicates)
 
 	if err := createUserMessage(app, clientID, scanID, message, "info"); err != nil {
 		logger.Printf("[ERROR] Error creating user message: %v", err)
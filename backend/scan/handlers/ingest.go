@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	pbModels "github.com/pocketbase/pocketbase/models"
+
+	bitorModels "bitor/models"
+	"bitor/services"
+)
+
+// maxIngestLineSize bounds a single nuclei result, which can embed a full
+// request and response
+const maxIngestLineSize = 16 * 1024 * 1024
+
+// HandleIngestFindings imports a JSONL batch of nuclei results while the scan
+// is still running. Batches carry a sequence number starting at 1 on every
+// run of the scan; a batch that was already ingested is acknowledged without
+// being processed again, so the VM can safely retry. A batch whose findings
+// couldn't all be saved fails and isn't recorded, so its retry is processed.
+func HandleIngestFindings(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		scanID := c.FormValue("scan_id")
+		sequence, err := strconv.Atoi(c.FormValue("sequence"))
+		if scanID == "" || err != nil || sequence < 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "scan_id and a sequence number of at least 1 are required",
+			})
+		}
+
+		record, err := app.Dao().FindRecordById("nuclei_scans", scanID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Scan not found",
+			})
+		}
+
+		file, err := c.FormFile("file")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid file",
+			})
+		}
+		src, err := file.Open()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to open uploaded file",
+			})
+		}
+		defer src.Close()
+
+		// Parse the batch, one nuclei result per line
+		var findings []bitorModels.NucleiFinding
+		invalid := 0
+		scanner := bufio.NewScanner(src)
+		scanner.Buffer(make([]byte, 64*1024), maxIngestLineSize)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var finding bitorModels.NucleiFinding
+			if err := json.Unmarshal([]byte(line), &finding); err != nil {
+				log.Printf("Skipping invalid result in batch %d of scan %s: %v", sequence, scanID, err)
+				invalid++
+				continue
+			}
+			findings = append(findings, finding)
+		}
+		if err := scanner.Err(); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Failed to read batch: %v", err),
+			})
+		}
+
+		resultsScanID := resultsScanIDOf(record)
+		unlock := lockScanImport(resultsScanID)
+		defer unlock()
+
+		existing, err := services.FindIngestBatch(app, record, sequence)
+		if err != nil {
+			log.Printf("Failed to look up batch %d of scan %s: %v", sequence, scanID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to ingest batch",
+			})
+		}
+		if existing != nil {
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"sequence":   sequence,
+				"duplicate":  true,
+				"findings":   existing.GetInt("findings_count"),
+				"new":        existing.GetInt("new_count"),
+				"duplicates": existing.GetInt("duplicate_count"),
+			})
+		}
+
+		counts := processFindings(app, findings, record.GetString("client"), resultsScanID, log.Default(), findingsCreator(record), true)
+
+		// The batch is only recorded once all of it is saved, so the VM
+		// retries it instead of being told it is a duplicate
+		if counts.Unsaved > 0 {
+			log.Printf("Failed to save %d findings of batch %d of scan %s", counts.Unsaved, sequence, scanID)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": fmt.Sprintf("Failed to save %d findings of the batch, retry it", counts.Unsaved),
+			})
+		}
+
+		if _, err := services.SaveIngestBatch(app, record, sequence, counts.Parsed, counts.New, counts.Duplicates); err != nil {
+			log.Printf("Failed to record batch %d of scan %s: %v", sequence, scanID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to record batch",
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"sequence":   sequence,
+			"duplicate":  false,
+			"findings":   counts.Parsed,
+			"new":        counts.New,
+			"duplicates": counts.Duplicates,
+			"invalid":    invalid,
+		})
+	}
+}
+
+// HandleCompleteIngestFindings closes out a streamed import once the VM has
+// sent its last batch: it finishes the scan and its rollup. When the number of
+// batches sent is given, the scan only completes once all of them arrived.
+func HandleCompleteIngestFindings(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var request struct {
+			ScanID  string `json:"scan_id"`
+			Batches int    `json:"batches"`
+		}
+		if err := c.Bind(&request); err != nil || request.ScanID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Scan ID is required",
+			})
+		}
+
+		record, err := app.Dao().FindRecordById("nuclei_scans", request.ScanID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Scan not found",
+			})
+		}
+
+		missing, err := services.MissingIngestBatches(app, record, request.Batches)
+		if err != nil {
+			log.Printf("Failed to check batches of scan %s: %v", record.Id, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to check ingested batches",
+			})
+		}
+		if len(missing) > 0 {
+			return c.JSON(http.StatusConflict, map[string]interface{}{
+				"error":   "Some batches have not been ingested",
+				"missing": missing,
+			})
+		}
+
+		totals, err := services.GetIngestBatchTotals(app, record)
+		if err != nil {
+			log.Printf("Failed to sum batches of scan %s: %v", record.Id, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to sum ingested batches",
+			})
+		}
+
+		resultsScanID := resultsScanIDOf(record)
+		unlock := lockScanImport(resultsScanID)
+		defer unlock()
+
+		// Mark the scan as finished and close out its rollup
+		if err := scanEventService.HandleScanFinished(record.Id); err != nil {
+			log.Printf("Error triggering scan finished event for scan %s: %v", record.Id, err)
+		}
+		findingManager.FinalizeScan(resultsScanID)
+
+		notifyImportCompleted(app, record.GetString("client"), resultsScanID, services.ScanImportCounts{
+			Parsed:     totals.Findings,
+			New:        totals.New,
+			Duplicates: totals.Duplicates,
+		}, log.Default())
+
+		return c.JSON(http.StatusOK, totals)
+	}
+}
+
+// resultsScanIDOf returns the scan findings are imported into: findings of a
+// shard belong to the scan it was split from
+func resultsScanIDOf(record *pbModels.Record) string {
+	if parentID := record.GetString("shard_of"); parentID != "" {
+		return parentID
+	}
+	return record.Id
+}
+
+// lockScanImport serializes imports into the same scan and returns the unlock func
+func lockScanImport(scanID string) func() {
+	lock, _ := scanImportLocks.LoadOrStore(scanID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// findingsCreator returns the user findings of a scan are attributed to
+func findingsCreator(record *pbModels.Record) string {
+	if createdBy := record.GetString("created_by"); createdBy != "" {
+		return createdBy
+	}
+	return "system"
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	pbModels "github.com/pocketbase/pocketbase/models"
+
+	"bitor/services"
+)
+
+// requestActor returns the ID of the admin or user making the request,
+// or "api-key-auth" when the request was authenticated with a scan API key
+func requestActor(c echo.Context) string {
+	if admin, _ := c.Get(apis.ContextAdminKey).(*pbModels.Admin); admin != nil {
+		return admin.Id
+	}
+	if record, _ := c.Get(apis.ContextAuthRecordKey).(*pbModels.Record); record != nil {
+		return record.Id
+	}
+	return "api-key-auth"
+}
+
+// isAdminRequest reports whether a request was made by a PocketBase admin or
+// a user in the admin group
+func isAdminRequest(app *pocketbase.PocketBase, c echo.Context) bool {
+	if admin, _ := c.Get(apis.ContextAdminKey).(*pbModels.Admin); admin != nil {
+		return true
+	}
+	record, _ := c.Get(apis.ContextAuthRecordKey).(*pbModels.Record)
+	if record == nil || record.GetString("group") == "" {
+		return false
+	}
+	group, err := app.Dao().FindRecordById("groups", record.GetString("group"))
+	return err == nil && group.GetString("name") == "admin"
+}
+
+// HandleGetScanJob returns the status, phase and queue position of a scan job.
+func HandleGetScanJob(scanQueue *services.ScanQueue) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// A scan API key only authorizes calls about its own scan
+		if requestActor(c) == "api-key-auth" {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "Jobs cannot be retried with a scan API key",
+			})
+		}
+
+		jobID := c.PathParam("id")
+		if jobID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Job ID is required",
+			})
+		}
+
+		status, err := scanQueue.GetJobStatus(jobID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Job not found",
+			})
+		}
+
+		return c.JSON(http.StatusOK, status)
+	}
+}
+
+// HandleRetryScanJob enqueues a new attempt of a failed or finished scan job.
+func HandleRetryScanJob(scanQueue *services.ScanQueue) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jobID := c.PathParam("id")
+		if jobID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Job ID is required",
+			})
+		}
+
+		job, err := scanQueue.Retry(jobID, requestActor(c))
+		if err != nil {
+			if errors.Is(err, services.ErrScanJobActive) {
+				return c.JSON(http.StatusConflict, map[string]string{
+					"error": "Scan is already queued or running",
+				})
+			}
+			log.Printf("Failed to retry job %s: %v", jobID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to retry job",
+			})
+		}
+
+		return c.JSON(http.StatusAccepted, map[string]string{
+			"status": "Scan queued",
+			"job_id": job.Id,
+		})
+	}
+}
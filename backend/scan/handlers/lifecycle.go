@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"bitor/scan/lifecycle"
+)
+
+var lifecycleNotificationsOnce sync.Once
+
+// registerLifecycleNotifications sends the scan started, finished, failed,
+// stopped and timed out notifications from the scan lifecycle hook, so every path that
+// changes a scan's status notifies the same way
+func registerLifecycleNotifications() {
+	lifecycleNotificationsOnce.Do(func() {
+		lifecycle.OnTransition().Add(func(e *lifecycle.TransitionEvent) error {
+			if notificationService == nil {
+				return nil
+			}
+
+			ctx := context.Background()
+			scanName := e.Scan.GetString("name")
+
+			var err error
+			switch e.To {
+			case lifecycle.StatusGenerating:
+				err = notificationService.NotifyScanStarted(ctx, e.Scan.Id, scanName)
+			case lifecycle.StatusFinished:
+				err = notificationService.NotifyScanFinished(ctx, e.Scan.Id, scanName)
+			case lifecycle.StatusFailed:
+				err = notificationService.NotifyScanFailed(ctx, e.Scan.Id, scanName, e.Reason)
+			case lifecycle.StatusStopped:
+				err = notificationService.NotifyScanStopped(ctx, e.Scan.Id, scanName)
+			case lifecycle.StatusTimedOut:
+				err = notificationService.NotifyScanTimedOut(ctx, e.Scan.Id, scanName, e.Reason)
+			}
+			if err != nil {
+				log.Printf("Failed to send %s notification for scan %s: %v", e.To, e.Scan.Id, err)
+			}
+
+			return nil
+		})
+	})
+}
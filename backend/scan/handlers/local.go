@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	pbModels "github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+	"bitor/scan/utils"
+	"bitor/services"
+)
+
+// Execution modes of a scan profile
+const (
+	ExecutionModeCloud = "cloud"
+	ExecutionModeLocal = "local"
+)
+
+// nucleiBinary returns the nuclei command used by local scans. NUCLEI_BINARY
+// can point to a wrapper that runs nuclei in a worker container.
+func nucleiBinary() string {
+	if binary := os.Getenv("NUCLEI_BINARY"); binary != "" {
+		return binary
+	}
+	return "nuclei"
+}
+
+// runLocalScan runs nuclei on the Bitor host instead of a cloud VM. It uses
+// the same profile and targets files as a VM would, and imports the results
+// through the same pipeline as an uploaded scan. Local scans cost nothing.
+func runLocalScan(ctx context.Context, app *pocketbase.PocketBase, ansibleBasePath string, deployment scanDeployment) error {
+	scanID := deployment.ScanID
+	setPhase := deployment.SetPhase
+	if setPhase == nil {
+		setPhase = func(string) {}
+	}
+
+	setPhase("generating")
+	if _, err := lifecycle.Transition(app, scanID, lifecycle.StatusGenerating, deployment.Actor, deployment.Reason, func(record *pbModels.Record) {
+		record.Set("execution_mode", ExecutionModeLocal)
+		record.Set("start_time", time.Now().Format(time.RFC3339))
+		record.Set("cost", 0)
+	}); err != nil {
+		return fmt.Errorf("failed to update scan status: %v", err)
+	}
+
+	// failScan marks the scan as failed unless the job was cancelled on purpose
+	failScan := func(cause error) error {
+		if ctx.Err() != nil {
+			return cause
+		}
+		if _, updateErr := lifecycle.Transition(app, scanID, lifecycle.StatusFailed, lifecycle.ActorSystem, cause.Error()); updateErr != nil {
+			log.Printf("Failed to update scan status to Failed: %v", updateErr)
+		}
+		return cause
+	}
+
+	scanDir := filepath.Join(ansibleBasePath, "scans", scanID)
+	logDir := filepath.Join(scanDir, "logs")
+	targetsFile := filepath.Join(scanDir, "targets.json")
+	profileFile := filepath.Join(scanDir, "nuclei_profile.yaml")
+	hostsFile := filepath.Join(scanDir, "hosts")
+	resultsFile := filepath.Join(scanDir, "results.json")
+	nucleiLogFile := filepath.Join(logDir, "nuclei.log")
+
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return failScan(fmt.Errorf("failed to create log directory: %v", err))
+	}
+
+	// Generate the same targets and profile files a VM would receive
+	if deployment.Targets != nil {
+		if err := writeTargetsJSON(targetsFile, deployment.Targets); err != nil {
+			return failScan(err)
+		}
+	} else if err := utils.GenerateTargetsJSON(app, scanID, targetsFile); err != nil {
+		return failScan(fmt.Errorf("failed to generate targets JSON: %v", err))
+	}
+	if err := utils.GenerateNucleiProfileYAML(app, scanID, profileFile); err != nil {
+		return failScan(fmt.Errorf("failed to generate nuclei profile YAML: %v", err))
+	}
+
+	targets, err := readTargetsJSON(targetsFile)
+	if err != nil {
+		return failScan(err)
+	}
+	if err := os.WriteFile(hostsFile, []byte(strings.Join(targets, "\n")+"\n"), 0644); err != nil {
+		return failScan(fmt.Errorf("failed to write hosts file: %v", err))
+	}
+
+	// There is no VM to deploy, so the scan passes straight through Deploying
+	setPhase("deploying")
+	if _, err := lifecycle.Transition(app, scanID, lifecycle.StatusDeploying, lifecycle.ActorSystem, "running nuclei locally, no VM to deploy"); err != nil {
+		return fmt.Errorf("failed to update scan status: %v", err)
+	}
+
+	binary := nucleiBinary()
+	if _, err := exec.LookPath(binary); err != nil {
+		return failScan(fmt.Errorf("nuclei not found on the Bitor host: %v", err))
+	}
+
+	nucleiStart := time.Now().UTC()
+	if _, err := lifecycle.Transition(app, scanID, lifecycle.StatusRunning, lifecycle.ActorSystem, "nuclei started locally", func(record *pbModels.Record) {
+		record.Set("nuclei_start_time", nucleiStart.Format(time.RFC3339))
+	}); err != nil {
+		return fmt.Errorf("failed to update scan status: %v", err)
+	}
+
+	logFile, err := os.Create(nucleiLogFile)
+	if err != nil {
+		return failScan(fmt.Errorf("failed to create nuclei log file: %v", err))
+	}
+	defer logFile.Close()
+
+	args := []string{
+		"-config", profileFile,
+		"-l", hostsFile,
+		"-je", resultsFile,
+		"-o", filepath.Join(scanDir, "results.txt"),
+		"-elog", filepath.Join(logDir, "nuclei_errors.log"),
+		"-duc",
+	}
+	log.Printf("Running local scan %s: %s %s", scanID, binary, strings.Join(args, " "))
+
+	// The job context is cancelled when the scan is stopped, which kills nuclei
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	runErr := cmd.Run()
+	nucleiStop := time.Now().UTC()
+
+	// Save the times and the nuclei output whatever the outcome
+	record, err := app.Dao().FindRecordById("nuclei_scans", scanID)
+	if err != nil {
+		return fmt.Errorf("failed to find scan: %v", err)
+	}
+	record.Set("nuclei_start_time", nucleiStart.Format(time.RFC3339))
+	record.Set("nuclei_stop_time", nucleiStop.Format(time.RFC3339))
+	if output, err := os.ReadFile(nucleiLogFile); err != nil {
+		log.Printf("Failed to read nuclei log of scan %s: %v", scanID, err)
+	} else {
+		appendScanLogs(record, string(output))
+	}
+	if err := app.Dao().SaveRecord(record); err != nil {
+		log.Printf("Failed to save nuclei times and logs of scan %s: %v", scanID, err)
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if runErr != nil {
+		return failScan(fmt.Errorf("nuclei failed: %v", runErr))
+	}
+
+	// nuclei only writes the export when something was found
+	if _, err := os.Stat(resultsFile); os.IsNotExist(err) {
+		if err := os.WriteFile(resultsFile, []byte("[]"), 0644); err != nil {
+			return failScan(fmt.Errorf("failed to write empty results: %v", err))
+		}
+	}
+
+	// Import the results like an uploaded scan; this also finishes the scan
+	userID := record.GetString("created_by")
+	if userID == "" {
+		userID = "system"
+	}
+	imp, duplicate, err := registerImport(app, resultsFile, scanID, record.GetString("client"), userID, services.ScanImportSourceLocal, "")
+	if err != nil {
+		return failScan(fmt.Errorf("failed to register results import: %v", err))
+	}
+	if duplicate {
+		os.Remove(resultsFile)
+	} else {
+		processFile(app, imp.Id, resultsFile, scanID, record.GetString("client"), userID)
+	}
+
+	// processFile logs its own errors; a scan it couldn't finish has failed
+	record, err = app.Dao().FindRecordById("nuclei_scans", scanID)
+	if err != nil {
+		return fmt.Errorf("failed to find scan: %v", err)
+	}
+	if record.GetString("status") == lifecycle.StatusRunning {
+		return failScan(fmt.Errorf("failed to import nuclei results"))
+	}
+
+	return nil
+}
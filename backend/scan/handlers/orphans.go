@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+
+	"bitor/services"
+)
+
+// HandleGetOrphanedVMs lists the VMs at the cloud providers that outlived
+// their scans, without terminating them
+func HandleGetOrphanedVMs(reaper *services.VMReaper) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		report := reaper.Check(c.Request().Context(), services.OrphanedVMActionReport)
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+// HandleReapOrphanedVMs terminates the VMs at the cloud providers that
+// outlived their scans
+func HandleReapOrphanedVMs(reaper *services.VMReaper) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		report := reaper.Check(c.Request().Context(), services.OrphanedVMActionTerminate)
+		return c.JSON(http.StatusOK, report)
+	}
+}
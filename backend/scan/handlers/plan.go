@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	pbModels "github.com/pocketbase/pocketbase/models"
+
+	"bitor/models"
+	"bitor/scan/lifecycle"
+	"bitor/scan/utils"
+	"bitor/services"
+)
+
+// Outcomes of the terraform plan step of a scan plan
+const (
+	TerraformPlanPassed  = "passed"
+	TerraformPlanFailed  = "failed"
+	TerraformPlanSkipped = "skipped"
+)
+
+// ScanPlan is what a scan would do if it were started now
+type ScanPlan struct {
+	ScanID           string                 `json:"scan_id"`
+	TargetsCount     int                    `json:"targets_count"`
+	NucleiProfile    map[string]string      `json:"nuclei_profile"`
+	Estimate         *services.ScanEstimate `json:"estimate"`
+	TerraformPlan    string                 `json:"terraform_plan"`
+	ValidationErrors []string               `json:"validation_errors"`
+}
+
+// HandlePlanScan runs a scan as far as it can go without creating anything:
+// the scan files are generated, the playbooks validated and terraform planned.
+// Problems found along the way are reported rather than failing the request.
+func HandlePlanScan(app *pocketbase.PocketBase, ansibleBasePath string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var scanReq models.ScanRequest
+		if err := c.Bind(&scanReq); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid request",
+			})
+		}
+
+		if scanReq.ScanID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Scan ID is required",
+			})
+		}
+
+		record, err := app.Dao().FindRecordById("nuclei_scans", scanReq.ScanID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Scan not found",
+			})
+		}
+
+		// Planning regenerates the scan files, which a running scan still uses
+		if status := record.GetString("status"); lifecycle.IsActive(status) {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": fmt.Sprintf("Scan cannot be planned while it is %s", status),
+			})
+		}
+
+		scanProfile, err := app.Dao().FindRecordById("scan_profiles", record.GetString("scan_profile"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Failed to find scan profile",
+			})
+		}
+
+		plan := planScan(c.Request().Context(), app, ansibleBasePath, record, scanProfile)
+		return c.JSON(http.StatusOK, plan)
+	}
+}
+
+// planScan generates the files of a scan and runs every check short of deploying it
+func planScan(ctx context.Context, app *pocketbase.PocketBase, ansibleBasePath string, record, scanProfile *pbModels.Record) *ScanPlan {
+	scanID := record.Id
+	plan := &ScanPlan{
+		ScanID:           scanID,
+		TerraformPlan:    TerraformPlanSkipped,
+		ValidationErrors: []string{},
+	}
+	addError := func(format string, args ...interface{}) {
+		plan.ValidationErrors = append(plan.ValidationErrors, fmt.Sprintf(format, args...))
+	}
+
+	if profile, err := app.Dao().FindRecordById("nuclei_profiles", record.GetString("nuclei_profile")); err != nil {
+		addError("nuclei profile not found: %v", err)
+	} else {
+		plan.NucleiProfile = map[string]string{
+			"id":   profile.Id,
+			"name": profile.GetString("name"),
+		}
+	}
+
+	scanDir := filepath.Join(ansibleBasePath, "scans", scanID)
+	yamlFile := filepath.Join(scanDir, "scan.yaml")
+	targetsFile := filepath.Join(scanDir, "targets.json")
+	profileFile := filepath.Join(scanDir, "nuclei_profile.yaml")
+	logDir := filepath.Join(scanDir, "logs")
+	inventoryPath := filepath.Join(scanDir, "inventory")
+	generateYamlFile := filepath.Join(ansibleBasePath, "generate.yml")
+	planPlaybookPath := filepath.Join(scanDir, "plan.yml")
+
+	// estimate fills in the runtime and cost once the targets are known
+	estimate := func() *ScanPlan {
+		if targets, err := readTargetsJSON(targetsFile); err == nil {
+			plan.TargetsCount = len(targets)
+		}
+		scanEstimate, err := services.EstimateScan(app, record, scanProfile, plan.TargetsCount)
+		if err != nil {
+			addError("failed to estimate cost: %v", err)
+		}
+		plan.Estimate = scanEstimate
+		return plan
+	}
+
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		addError("failed to create scan directory: %v", err)
+		return plan
+	}
+
+	// Local scans have nothing to generate beyond the targets and profile
+	if scanProfile.GetString("execution_mode") == ExecutionModeLocal {
+		if err := utils.GenerateTargetsJSON(app, scanID, targetsFile); err != nil {
+			addError("failed to generate targets JSON: %v", err)
+		}
+		if err := utils.GenerateNucleiProfileYAML(app, scanID, profileFile); err != nil {
+			addError("failed to generate nuclei profile YAML: %v", err)
+		}
+		return estimate()
+	}
+
+	// The generated vars are encrypted with the scan's API key
+	if record.GetString("api_key") == "" {
+		record.Set("api_key", utils.GenerateAPIKey())
+		if err := app.Dao().SaveRecord(record); err != nil {
+			addError("failed to save scan API key: %v", err)
+			return estimate()
+		}
+	}
+
+	yamlContent, err := utils.GenerateYAMLVars(app, scanID)
+	if err != nil {
+		addError("failed to generate YAML: %v", err)
+		return estimate()
+	}
+	if err := utils.SetupScanFiles(yamlContent, yamlFile, targetsFile, profileFile, logDir, app, scanID); err != nil {
+		addError("%v", err)
+		return estimate()
+	}
+
+	if err := validatePlaybook(generateYamlFile, scanID, app); err != nil {
+		addError("failed to validate generate playbook: %v", err)
+		return estimate()
+	}
+	if err := utils.ExecuteAnsiblePlaybookContext(ctx, generateYamlFile, logDir, yamlFile, inventoryPath, ansibleBasePath, app, scanID); err != nil {
+		addError("failed to run generate playbook: %v", err)
+		return estimate()
+	}
+
+	for _, playbook := range []string{"deploy.yml", "destroy.yml", "plan.yml"} {
+		if err := validatePlaybook(filepath.Join(scanDir, playbook), scanID, app); err != nil {
+			addError("failed to validate %s: %v", playbook, err)
+		}
+	}
+	if len(plan.ValidationErrors) > 0 {
+		return estimate()
+	}
+
+	// plan.yml runs the terraform role in check mode, which plans without applying
+	plan.TerraformPlan = TerraformPlanPassed
+	if err := utils.ExecuteAnsiblePlaybookContext(ctx, planPlaybookPath, logDir, yamlFile, inventoryPath, ansibleBasePath, app, scanID); err != nil {
+		log.Printf("Terraform plan failed for scan %s: %v", scanID, err)
+		plan.TerraformPlan = TerraformPlanFailed
+		addError("terraform plan failed: %v", err)
+	}
+
+	return estimate()
+}
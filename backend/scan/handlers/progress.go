@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+
+	"bitor/services"
+)
+
+// HandleUpdateScanProgress stores the latest nuclei stats reported by a scan
+// VM. Dashboards follow the scan record through PocketBase realtime.
+func HandleUpdateScanProgress(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Bind the request payload
+		var progressUpdate struct {
+			ScanID string                 `json:"scan_id"`
+			Stats  map[string]interface{} `json:"stats"`
+		}
+		if err := c.Bind(&progressUpdate); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid request",
+			})
+		}
+
+		// Ensure scan ID and stats are provided
+		if progressUpdate.ScanID == "" || len(progressUpdate.Stats) == 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Scan ID and stats are required",
+			})
+		}
+
+		record, err := app.Dao().FindRecordById("nuclei_scans", progressUpdate.ScanID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Scan not found",
+			})
+		}
+
+		progress, err := services.ParseNucleiStats(progressUpdate.Stats)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+
+		if err := services.SaveScanProgress(app, record.Id, progress); err != nil {
+			if errors.Is(err, services.ErrScanNotRunning) {
+				return c.JSON(http.StatusConflict, map[string]string{
+					"error": "Scan is no longer running",
+				})
+			}
+			log.Printf("Failed to update progress of scan %s: %v", record.Id, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to update scan progress",
+			})
+		}
+
+		return c.JSON(http.StatusOK, progress)
+	}
+}
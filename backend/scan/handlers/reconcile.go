@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+
+	"bitor/services"
+)
+
+// HandleGetReconcileReport returns what the startup reconciler did with unfinished scans
+func HandleGetReconcileReport(reconciler *services.ScanReconciler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		report := reconciler.LastReport()
+		if report == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Reconciliation has not completed yet",
+			})
+		}
+
+		return c.JSON(http.StatusOK, report)
+	}
+}
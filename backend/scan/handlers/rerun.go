@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	pbModels "github.com/pocketbase/pocketbase/models"
+
+	"bitor/services"
+)
+
+// HandleRerunScan runs the configuration of a scan again as a new scan, so the
+// status, times, logs and cost of earlier runs are kept. The new run is
+// started like a manual start; if it is refused, it is removed again.
+func HandleRerunScan(app *pocketbase.PocketBase, scanQueue *services.ScanQueue, budget *services.BudgetService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// A scan API key only authorizes calls about its own scan
+		if requestActor(c) == "api-key-auth" {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "Scans cannot be rerun with a scan API key",
+			})
+		}
+
+		var req struct {
+			BudgetOverride bool `json:"budget_override"`
+		}
+		if c.Request().ContentLength > 0 {
+			if err := c.Bind(&req); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": "Invalid request body",
+				})
+			}
+		}
+
+		source, err := app.Dao().FindRecordById("nuclei_scans", c.PathParam("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Scan not found",
+			})
+		}
+
+		// Shards are run by their parent scan, and imported scans have nothing to run
+		if source.GetString("shard_of") != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Shards can't be rerun on their own, rerun the parent scan instead",
+			})
+		}
+		if source.GetString("scan_profile") == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Scan has no scan profile to rerun",
+			})
+		}
+
+		run, err := services.CreateRerun(app, source, requestActor(c))
+		if err != nil {
+			log.Printf("Failed to create rerun of scan %s: %v", source.Id, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to create scan run",
+			})
+		}
+
+		// The new run belongs to whoever asked for it
+		if user, _ := c.Get(apis.ContextAuthRecordKey).(*pbModels.Record); user != nil {
+			run.Set("created_by", user.Id)
+			if err := app.Dao().SaveRecord(run); err != nil {
+				log.Printf("Failed to set the creator of scan run %s: %v", run.Id, err)
+			}
+		}
+
+		status, response := startScan(app, c, scanQueue, budget, run, req.BudgetOverride)
+		if status >= http.StatusBadRequest {
+			if err := app.Dao().DeleteRecord(run); err != nil {
+				log.Printf("Failed to remove refused scan run %s: %v", run.Id, err)
+			}
+			return c.JSON(status, response)
+		}
+
+		if body, ok := response.(map[string]interface{}); ok {
+			body["scan_id"] = run.Id
+			body["parent_scan"] = run.GetString("parent_scan")
+		}
+		return c.JSON(status, response)
+	}
+}
+
+// HandleGetScanRuns returns every run of a scan's configuration, newest first
+func HandleGetScanRuns(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		scan, err := app.Dao().FindRecordById("nuclei_scans", c.PathParam("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Scan not found",
+			})
+		}
+
+		runs, err := services.FindScanRuns(app, scan)
+		if err != nil {
+			log.Printf("Failed to find runs of scan %s: %v", scan.Id, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to find scan runs",
+			})
+		}
+
+		result := make([]map[string]interface{}, 0, len(runs))
+		for _, run := range runs {
+			result = append(result, map[string]interface{}{
+				"id":          run.Id,
+				"name":        run.GetString("name"),
+				"status":      run.GetString("status"),
+				"parent_scan": run.GetString("parent_scan"),
+				"start_time":  run.GetString("start_time"),
+				"end_time":    run.GetString("end_time"),
+				"cost":        run.GetFloat("cost"),
+				"created":     run.GetString("created"),
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"scan_id": scan.Id,
+			"runs":    result,
+		})
+	}
+}
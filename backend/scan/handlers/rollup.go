@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+)
+
+// HandleRecomputeScanRollup rebuilds the finding rollup of a scan from its
+// stored findings: POST /api/scan/:id/rollup/recompute
+func HandleRecomputeScanRollup(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		record, err := app.Dao().FindRecordById("nuclei_scans", c.PathParam("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Scan not found",
+			})
+		}
+
+		scanID := resultsScanIDOf(record)
+		counts, err := findingManager.RecomputeRollup(scanID)
+		if err != nil {
+			log.Printf("Failed to recompute rollup for scan %s: %v", scanID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to recompute rollup",
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"scan_id": scanID,
+			"rollup":  counts,
+		})
+	}
+}
+
+// HandleRecomputeAllRollups rebuilds the finding rollups of all scans, for
+// instance after upgrading from a release that kept the counts in memory:
+// POST /api/scan/rollups/recompute
+func HandleRecomputeAllRollups(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		recomputed, err := findingManager.RecomputeAllRollups()
+		if err != nil {
+			log.Printf("Failed to recompute rollups: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+				"error":      "Failed to recompute rollups",
+				"recomputed": recomputed,
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]int{
+			"recomputed": recomputed,
+		})
+	}
+}
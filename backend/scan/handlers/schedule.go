@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo/v5"
@@ -9,6 +11,7 @@ import (
 	pbModels "github.com/pocketbase/pocketbase/models"
 
 	"bitor/models"
+	"bitor/scheduler"
 )
 
 func HandleScheduleScan(app *pocketbase.PocketBase) echo.HandlerFunc {
@@ -28,6 +31,13 @@ func HandleScheduleScan(app *pocketbase.PocketBase) echo.HandlerFunc {
 			})
 		}
 
+		// Validate the start time and timezone
+		if err := scheduler.ValidateScheduleDetails(scheduleReq.ScheduleDetails); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+
 		// Use the StartDate directly
 		startDate := scheduleReq.StartDate
 		if startDate.IsZero() {
@@ -113,6 +123,47 @@ func HandleGetScheduledScans(app *pocketbase.PocketBase) echo.HandlerFunc {
 	}
 }
 
+// HandleGetScheduledScanNextRuns previews the next fire times of a scheduled scan
+func HandleGetScheduledScanNextRuns(scanScheduler *scheduler.ScanScheduler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.PathParam("id")
+		if id == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Scheduled scan ID is required",
+			})
+		}
+
+		// Number of fire times to return, 5 by default and at most 100
+		count := 5
+		if n := c.QueryParam("n"); n != "" {
+			parsed, err := strconv.Atoi(n)
+			if err != nil || parsed < 1 {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": "n must be a positive number",
+				})
+			}
+			count = min(parsed, 100)
+		}
+
+		runs, err := scanScheduler.NextRuns(id, count)
+		if err != nil {
+			if errors.Is(err, scheduler.ErrScheduleNotFound) {
+				return c.JSON(http.StatusNotFound, map[string]string{
+					"error": "Scheduled scan not found",
+				})
+			}
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"id":        id,
+			"next_runs": runs,
+		})
+	}
+}
+
 func HandleDeleteScheduledScan(app *pocketbase.PocketBase) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		id := c.PathParam("id")
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	pbModels "github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+	"bitor/scan/utils"
+	"bitor/services"
+)
+
+// runShardedScan splits the targets of a scan across several VMs. Each shard
+// is a scan of its own that goes through the usual generate and deploy
+// pipeline, while the parent scan tracks them. If any shard fails to deploy,
+// the VMs of all shards are destroyed and the scan fails.
+func runShardedScan(ctx context.Context, app *pocketbase.PocketBase, ansibleBasePath string, job *services.ScanJob, scanProfile *pbModels.Record, shardCount int) error {
+	scanID := job.ScanID
+	if shardCount > services.MaxScanShards {
+		shardCount = services.MaxScanShards
+	}
+
+	job.SetPhase("generating")
+	if _, err := lifecycle.Transition(app, scanID, lifecycle.StatusGenerating, job.RequestedBy, fmt.Sprintf("%s scan job started", job.Source), func(record *pbModels.Record) {
+		if vmSize := scanProfile.Get("vm_size"); vmSize != nil {
+			record.Set("vm_size", vmSize)
+		}
+		record.Set("start_time", time.Now().Format(time.RFC3339))
+	}); err != nil {
+		return fmt.Errorf("failed to update scan status: %v", err)
+	}
+
+	// failScan marks the scan as failed unless the job was cancelled on purpose
+	failScan := func(cause error) error {
+		if ctx.Err() != nil {
+			return cause
+		}
+		if _, updateErr := lifecycle.Transition(app, scanID, lifecycle.StatusFailed, lifecycle.ActorSystem, cause.Error()); updateErr != nil {
+			log.Printf("Failed to update scan status to Failed: %v", updateErr)
+		}
+		return cause
+	}
+
+	parent, err := app.Dao().FindRecordById("nuclei_scans", scanID)
+	if err != nil {
+		return failScan(fmt.Errorf("scan not found: %v", err))
+	}
+
+	// Load the full target list and split it
+	scanDir := filepath.Join(ansibleBasePath, "scans", scanID)
+	if err := os.MkdirAll(scanDir, 0755); err != nil {
+		return failScan(fmt.Errorf("failed to create scan directory: %v", err))
+	}
+	targetsFile := filepath.Join(scanDir, "targets.json")
+	if err := utils.GenerateTargetsJSON(app, scanID, targetsFile); err != nil {
+		return failScan(fmt.Errorf("failed to generate targets JSON: %v", err))
+	}
+	targets, err := readTargetsJSON(targetsFile)
+	if err != nil {
+		return failScan(err)
+	}
+
+	shards := services.SplitTargets(targets, shardCount)
+	if len(shards) == 0 {
+		return failScan(fmt.Errorf("scan has no targets to split into shards"))
+	}
+
+	shardScans := make([]*pbModels.Record, len(shards))
+	for i, shardTargets := range shards {
+		shard, err := services.NewScanShard(app, parent, i, len(shards), len(shardTargets))
+		if err != nil {
+			return failScan(fmt.Errorf("failed to create shard %d: %v", i+1, err))
+		}
+		shardScans[i] = shard
+	}
+
+	job.SetPhase("deploying")
+	if _, err := lifecycle.Transition(app, scanID, lifecycle.StatusDeploying, lifecycle.ActorSystem, fmt.Sprintf("deploying %d shards", len(shards)), func(record *pbModels.Record) {
+		record.Set("shard_count", len(shards))
+		record.Set("target_count", len(targets))
+	}); err != nil {
+		return fmt.Errorf("failed to update scan status: %v", err)
+	}
+
+	// Deploy the shards in parallel; the first failure cancels the others
+	shardCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(shardScans))
+	for i, shard := range shardScans {
+		wg.Add(1)
+		go func(i int, shard *pbModels.Record) {
+			defer wg.Done()
+			err := deployScan(shardCtx, app, ansibleBasePath, scanDeployment{
+				ScanID:  shard.Id,
+				Actor:   job.RequestedBy,
+				Reason:  fmt.Sprintf("shard %d/%d of scan %s", i+1, len(shardScans), scanID),
+				Profile: scanProfile,
+				Targets: shards[i],
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("shard %d: %v", i+1, err)
+				cancel()
+			}
+		}(i, shard)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		// A cancelled job is torn down by whoever cancelled it
+		if ctx.Err() != nil {
+			return err
+		}
+
+		// One failed shard fails the whole scan, and no shard VM may be left behind
+		if tearDownErr := services.TearDownShards(context.Background(), app, ansibleBasePath, scanID, lifecycle.ActorSystem, "another shard failed to deploy"); tearDownErr != nil {
+			err = fmt.Errorf("%v; tear down failed: %v", err, tearDownErr)
+		}
+		return failScan(err)
+	}
+
+	// Every shard reports Running on its own; the parent runs once all are deployed
+	if _, err := lifecycle.Transition(app, scanID, lifecycle.StatusRunning, lifecycle.ActorSystem, fmt.Sprintf("all %d shards deployed", len(shards))); err != nil {
+		return fmt.Errorf("failed to update scan status: %v", err)
+	}
+
+	// Shards that already ended while the others were deploying were ignored until now
+	services.SettleShardedScan(app, ansibleBasePath, scanID)
+
+	return nil
+}
+
+// readTargetsJSON reads the target list written by utils.GenerateTargetsJSON
+func readTargetsJSON(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets.json: %v", err)
+	}
+
+	var targets []string
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("failed to parse targets.json: %v", err)
+	}
+	return targets, nil
+}
+
+// writeTargetsJSON replaces the target list of a scan
+func writeTargetsJSON(path string, targets []string) error {
+	data, err := json.Marshal(targets)
+	if err != nil {
+		return fmt.Errorf("failed to encode targets: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write targets.json: %w", err)
+	}
+	return nil
+}
+
+// HandleGetScanShards returns the progress and cost of each shard of a scan.
+func HandleGetScanShards(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		scanID := c.PathParam("id")
+		if scanID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Scan ID is required",
+			})
+		}
+
+		if _, err := app.Dao().FindRecordById("nuclei_scans", scanID); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Scan not found",
+			})
+		}
+
+		summary, err := services.GetShardSummary(app, scanID)
+		if err != nil {
+			log.Printf("Failed to get shards of scan %s: %v", scanID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to get scan shards",
+			})
+		}
+
+		return c.JSON(http.StatusOK, summary)
+	}
+}
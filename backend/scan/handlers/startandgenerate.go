@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,51 +15,14 @@ import (
 
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase"
+	pbModels "github.com/pocketbase/pocketbase/models"
 
 	"bitor/models"
+	"bitor/scan/lifecycle"
 	"bitor/scan/utils"
-	"bitor/services/notification"
+	"bitor/services"
 )
 
-// updateScanStatus safely updates the scan status by fetching a fresh copy first
-func updateScanStatus(app *pocketbase.PocketBase, scanID string, status string) error {
-	// Always fetch a fresh copy of the record to preserve all fields
-	record, err := app.Dao().FindRecordById("nuclei_scans", scanID)
-	if err != nil {
-		return fmt.Errorf("failed to fetch record: %v", err)
-	}
-
-	// Get existing logs to preserve them
-	var existingLogs interface{}
-	if logsValue := record.Get("ansible_logs"); logsValue != nil {
-		existingLogs = logsValue
-	}
-
-	// Update the status
-	record.Set("status", status)
-
-	// If status is Failed or Destroyed, set end time and destroyed flag
-	if status == "Failed" || status == "Destroyed" {
-		currentTime := time.Now().Format(time.RFC3339)
-		record.Set("end_time", currentTime)
-		record.Set("vm_stop_time", currentTime)
-		if status == "Destroyed" {
-			record.Set("destroyed", true)
-		}
-	}
-
-	// Preserve existing logs if they exist
-	if existingLogs != nil {
-		record.Set("ansible_logs", existingLogs)
-	}
-
-	if err := app.Dao().SaveRecord(record); err != nil {
-		return fmt.Errorf("failed to update status: %v", err)
-	}
-
-	return nil
-}
-
 // validatePlaybook runs ansible-playbook --syntax-check to catch parsing errors
 func validatePlaybook(playbookPath string, scanID string, app *pocketbase.PocketBase) error {
 	// Create a buffer to capture error output
@@ -117,25 +81,11 @@ func validatePlaybook(playbookPath string, scanID string, app *pocketbase.Pocket
 	return nil
 }
 
-func HandleStartAndGenerateScan(app *pocketbase.PocketBase, ansibleBasePath string, notificationService *notification.NotificationService) echo.HandlerFunc {
+// HandleStartAndGenerateScan validates the scan and places it on the scan queue.
+// The generate and deploy playbooks are run by the queue workers, so the
+// request returns as soon as the job has been stored.
+func HandleStartAndGenerateScan(app *pocketbase.PocketBase, scanQueue *services.ScanQueue, budget *services.BudgetService) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		// Initialize the database path
-		utils.InitDBPath(app)
-
-		// Get the absolute path of the working directory
-		workDir, err := os.Getwd()
-		if err != nil {
-			log.Printf("Failed to get working directory: %v", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to initialize environment",
-			})
-		}
-
-		// Ensure ansible base path is absolute
-		if !filepath.IsAbs(ansibleBasePath) {
-			ansibleBasePath = filepath.Join(workDir, ansibleBasePath)
-		}
-
 		var scanReq models.ScanRequest
 		if err := json.NewDecoder(c.Request().Body).Decode(&scanReq); err != nil {
 			return c.JSON(http.StatusBadRequest, map[string]string{
@@ -143,17 +93,6 @@ func HandleStartAndGenerateScan(app *pocketbase.PocketBase, ansibleBasePath stri
 			})
 		}
 
-		// Ensure ansible base path is provided
-		if ansibleBasePath == "" {
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Ansible base path is not configured",
-			})
-		}
-
-		// Log the absolute paths being used
-		log.Printf("Working Directory: %s", workDir)
-		log.Printf("Ansible Base Path: %s", ansibleBasePath)
-
 		// Find the scan record
 		record, err := app.Dao().FindRecordById("nuclei_scans", scanReq.ScanID)
 		if err != nil {
@@ -162,199 +101,313 @@ func HandleStartAndGenerateScan(app *pocketbase.PocketBase, ansibleBasePath stri
 			})
 		}
 
-		// Check if the scan is already in progress
-		currentStatus := record.GetString("status")
-		if currentStatus == "Generating" || currentStatus == "Deploying" {
-			return c.JSON(http.StatusConflict, map[string]string{
-				"error": "Scan is already in progress",
-			})
+		status, response := startScan(app, c, scanQueue, budget, record, scanReq.BudgetOverride)
+		return c.JSON(status, response)
+	}
+}
+
+// startScan checks that a scan may start and places it on the scan queue. It
+// returns the HTTP status and body of the response to the start request.
+func startScan(app *pocketbase.PocketBase, c echo.Context, scanQueue *services.ScanQueue, budget *services.BudgetService, record *pbModels.Record, budgetOverride bool) (int, interface{}) {
+	scanID := record.Id
+
+	// Check that the scan can be started from its current status
+	currentStatus := record.GetString("status")
+	if !lifecycle.CanTransition(currentStatus, lifecycle.StatusGenerating) {
+		return http.StatusConflict, map[string]string{
+			"error": fmt.Sprintf("Scan cannot be started while it is %s", currentStatus),
 		}
+	}
 
-		// Get the scan profile to copy the VM size
-		scanProfileID := record.Get("scan_profile").(string)
-		scanProfile, err := app.Dao().FindRecordById("scan_profiles", scanProfileID)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to find scan profile",
-			})
+	// Make sure the scan profile exists before queueing
+	if _, err := app.Dao().FindRecordById("scan_profiles", record.GetString("scan_profile")); err != nil {
+		return http.StatusInternalServerError, map[string]string{
+			"error": "Failed to find scan profile",
 		}
+	}
 
-		// Copy the VM size from the scan profile to the scan record
-		vmSize := scanProfile.Get("vm_size")
-		if vmSize != nil {
-			record.Set("vm_size", vmSize)
+	// Apply the client's scan window policy; outside the allowed windows the
+	// start is either refused or deferred until the next allowed time
+	policy, err := services.LoadScanPolicy(app, record.GetString("client"))
+	if err != nil {
+		log.Printf("Failed to load scan policy for scan %s: %v", scanID, err)
+		return http.StatusInternalServerError, map[string]string{
+			"error": "Failed to load the client's scan policy",
 		}
+	}
 
-		// Update scan status to "Generating"
-		record.Set("status", "Generating")
-		record.Set("start_time", time.Now().Format(time.RFC3339))
+	var notBefore time.Time
+	if policy != nil {
+		decision := policy.Evaluate(time.Now())
+		switch {
+		case decision.Allowed:
+			recordPolicyDecision(app, scanID, policy, services.PolicyDecisionAllowed, services.ScanJobSourceManual, decision.Reason, time.Time{})
+		case policy.ManualAction == services.PolicyManualDefer && !decision.NextAllowed.IsZero():
+			notBefore = decision.NextAllowed
+			recordPolicyDecision(app, scanID, policy, services.PolicyDecisionDeferred, services.ScanJobSourceManual, decision.Reason, notBefore)
+		default:
+			recordPolicyDecision(app, scanID, policy, services.PolicyDecisionRefused, services.ScanJobSourceManual, decision.Reason, decision.NextAllowed)
+			response := map[string]interface{}{
+				"error":  fmt.Sprintf("Scan refused by the client's scan policy: %s", decision.Reason),
+				"reason": decision.Reason,
+			}
+			if !decision.NextAllowed.IsZero() {
+				response["next_allowed"] = decision.NextAllowed.Format(time.RFC3339)
+			}
+			return http.StatusConflict, response
+		}
+	}
 
-		// Generate and set API key
-		apiKey := utils.GenerateAPIKey()
-		record.Set("api_key", apiKey)
+	// Keep the scan within the monthly budgets unless an admin overrides them;
+	// a deferred scan is charged to the month it starts in
+	startAt := time.Now()
+	if !notBefore.IsZero() {
+		startAt = notBefore
+	}
+	check, err := budget.CheckScan(record, startAt)
+	if err != nil {
+		log.Printf("Failed to check the budget for scan %s: %v", scanID, err)
+		return http.StatusInternalServerError, map[string]string{
+			"error": "Failed to check the monthly budget",
+		}
+	}
+	if !check.Allowed {
+		if !budgetOverride || !isAdminRequest(app, c) {
+			return http.StatusConflict, map[string]interface{}{
+				"error":             fmt.Sprintf("Scan would exceed the monthly budget: %s", check.Reason()),
+				"budget":            check,
+				"override_required": true,
+			}
+		}
+		log.Printf("Budget overridden by %s for scan %s: %s", requestActor(c), scanID, check.Reason())
+	}
 
-		if err := app.Dao().SaveRecord(record); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to update scan status",
-			})
+	job, err := scanQueue.EnqueueAt(scanID, services.ScanJobSourceManual, requestActor(c), notBefore, time.Time{})
+	if err != nil {
+		if errors.Is(err, services.ErrScanJobActive) {
+			return http.StatusConflict, map[string]string{
+				"error":  "Scan is already queued or running",
+				"job_id": job.Id,
+			}
+		}
+		log.Printf("Failed to enqueue scan %s: %v", scanID, err)
+		return http.StatusInternalServerError, map[string]string{
+			"error": "Failed to queue scan",
 		}
+	}
 
-		// Send notification for scan start
-		if err := notificationService.NotifyScanStarted(context.Background(), scanReq.ScanID, record.GetString("name")); err != nil {
-			log.Printf("Failed to send scan start notification: %v", err)
+	status, err := scanQueue.GetJobStatus(job.Id)
+	if err != nil {
+		log.Printf("Failed to get status for job %s: %v", job.Id, err)
+		return http.StatusAccepted, map[string]interface{}{
+			"status": "Scan queued",
+			"job_id": job.Id,
 		}
+	}
 
-		// Generate YAML file for Ansible
-		yamlContent, err := utils.GenerateYAMLVars(app, scanReq.ScanID)
-		if err != nil {
-			log.Printf("Failed to generate YAML: %v", err)
+	response := map[string]interface{}{
+		"status":   "Scan queued",
+		"job_id":   job.Id,
+		"position": status.Position,
+		"phase":    status.Phase,
+	}
+	if !notBefore.IsZero() {
+		response["status"] = "Scan deferred"
+		response["not_before"] = notBefore.Format(time.RFC3339)
+	}
 
-			// Update scan status to Failed using fresh record
-			if updateErr := updateScanStatus(app, scanReq.ScanID, "Failed"); updateErr != nil {
-				log.Printf("Failed to update scan status to Failed: %v", updateErr)
-			}
+	return http.StatusAccepted, response
+}
 
-			// Send notification for scan failure
-			if notifyErr := notificationService.NotifyScanFailed(context.Background(), scanReq.ScanID, record.GetString("name"), err.Error()); notifyErr != nil {
-				log.Printf("Failed to send scan failure notification: %v", notifyErr)
-			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to generate YAML",
-			})
+// recordPolicyDecision logs a scan policy decision on the scan
+func recordPolicyDecision(app *pocketbase.PocketBase, scanID string, policy *services.ScanPolicy, decision, source, reason string, nextAllowed time.Time) {
+	if err := services.RecordPolicyDecision(app, scanID, policy, decision, source, reason, nextAllowed); err != nil {
+		log.Printf("Failed to record policy decision for scan %s: %v", scanID, err)
+	}
+}
+
+// RunScanJob returns the queue runner that generates and deploys a scan
+func RunScanJob(app *pocketbase.PocketBase, ansibleBasePath string) services.ScanJobRunner {
+	// Ensure ansible base path is absolute
+	if !filepath.IsAbs(ansibleBasePath) {
+		if workDir, err := os.Getwd(); err == nil {
+			ansibleBasePath = filepath.Join(workDir, ansibleBasePath)
 		}
+	}
 
-		// Define the paths using the scanID
-		scanDir := filepath.Join(ansibleBasePath, "scans", scanReq.ScanID)
-		yamlFile := filepath.Join(scanDir, "scan.yaml")
-		targetsFile := filepath.Join(scanDir, "targets.json")
-		profileFile := filepath.Join(scanDir, "nuclei_profile.yaml")
-		logDir := filepath.Join(scanDir, "logs")
-		generateYamlFile := filepath.Join(ansibleBasePath, "generate.yml")
-		deployPlaybookPath := filepath.Join(scanDir, "deploy.yml")
-		inventoryPath := filepath.Join(scanDir, "inventory")
-
-		// Log the paths for debugging
+	return func(ctx context.Context, job *services.ScanJob) error {
 		log.Printf("Ansible Base Path: %s", ansibleBasePath)
-		log.Printf("Scan Directory: %s", scanDir)
-		log.Printf("Generate YAML Path: %s", generateYamlFile)
-		log.Printf("Deploy Playbook Path: %s", deployPlaybookPath)
-		log.Printf("Inventory Path: %s", inventoryPath)
-
-		// Create scan directory if it doesn't exist
-		if err := os.MkdirAll(scanDir, 0755); err != nil {
-			log.Printf("Failed to create scan directory: %v", err)
-
-			// Update scan status to Failed using fresh record
-			if updateErr := updateScanStatus(app, scanReq.ScanID, "Failed"); updateErr != nil {
-				log.Printf("Failed to update scan status to Failed: %v", updateErr)
-			}
 
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": fmt.Sprintf("Failed to create scan directory: %v", err),
-			})
+		// Find the scan record
+		record, err := app.Dao().FindRecordById("nuclei_scans", job.ScanID)
+		if err != nil {
+			return fmt.Errorf("scan not found: %v", err)
 		}
 
-		// Create directories and files
-		if err := utils.SetupScanFiles(yamlContent, yamlFile, targetsFile, profileFile, logDir, app, scanReq.ScanID); err != nil {
-			// Update scan status to Failed using fresh record
-			if updateErr := updateScanStatus(app, scanReq.ScanID, "Failed"); updateErr != nil {
-				log.Printf("Failed to update scan status to Failed: %v", updateErr)
-			}
-
-			// Send notification for scan failure
-			if notifyErr := notificationService.NotifyScanFailed(context.Background(), scanReq.ScanID, record.GetString("name"), err.Error()); notifyErr != nil {
-				log.Printf("Failed to send scan failure notification: %v", notifyErr)
-			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": err.Error(),
-			})
+		// Get the scan profile to copy the VM size
+		scanProfile, err := app.Dao().FindRecordById("scan_profiles", record.GetString("scan_profile"))
+		if err != nil {
+			return fmt.Errorf("failed to find scan profile: %v", err)
 		}
 
-		// Validate the generate playbook before running it
-		if err := validatePlaybook(generateYamlFile, scanReq.ScanID, app); err != nil {
-			log.Printf("Failed to validate generate playbook: %v", err)
-			// Update scan status to Failed using fresh record
-			if updateErr := updateScanStatus(app, scanReq.ScanID, "Failed"); updateErr != nil {
-				log.Printf("Failed to update scan status to Failed: %v", updateErr)
-			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": fmt.Sprintf("Failed to validate generate playbook: %v", err),
-			})
+		deployment := scanDeployment{
+			ScanID:   job.ScanID,
+			Actor:    job.RequestedBy,
+			Reason:   fmt.Sprintf("%s scan job started", job.Source),
+			Profile:  scanProfile,
+			SetPhase: job.SetPhase,
 		}
 
-		// First run generate.yml to create all necessary files
-		log.Printf("Running generate.yml to create necessary files")
-		if err := utils.ExecuteAnsiblePlaybook(
-			generateYamlFile,
-			logDir,
-			yamlFile,
-			inventoryPath,
-			ansibleBasePath,
-			app,
-			scanReq.ScanID,
-		); err != nil {
-			// Update scan status to Failed using fresh record
-			if updateErr := updateScanStatus(app, scanReq.ScanID, "Failed"); updateErr != nil {
-				log.Printf("Failed to update scan status to Failed: %v", updateErr)
-			}
+		// Local scans run nuclei on this host and are never sharded
+		if scanProfile.GetString("execution_mode") == ExecutionModeLocal {
+			return runLocalScan(ctx, app, ansibleBasePath, deployment)
+		}
 
-			// Send notification for scan failure
-			if notifyErr := notificationService.NotifyScanFailed(context.Background(), scanReq.ScanID, record.GetString("name"), err.Error()); notifyErr != nil {
-				log.Printf("Failed to send scan failure notification: %v", notifyErr)
-			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to run generate playbook",
-			})
+		if shards := scanProfile.GetInt("shards"); shards > 1 {
+			return runShardedScan(ctx, app, ansibleBasePath, job, scanProfile, shards)
 		}
 
-		// Now validate the deploy playbook that was just generated
-		if err := validatePlaybook(deployPlaybookPath, scanReq.ScanID, app); err != nil {
-			log.Printf("Failed to validate deploy playbook: %v", err)
-			// Update scan status to Failed using fresh record
-			if updateErr := updateScanStatus(app, scanReq.ScanID, "Failed"); updateErr != nil {
-				log.Printf("Failed to update scan status to Failed: %v", updateErr)
-			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": fmt.Sprintf("Failed to validate deploy playbook: %v", err),
-			})
+		return deployScan(ctx, app, ansibleBasePath, deployment)
+	}
+}
+
+// scanDeployment describes one scan VM to generate and deploy
+type scanDeployment struct {
+	ScanID   string
+	Actor    string
+	Reason   string
+	Profile  *pbModels.Record
+	Targets  []string           // Replaces the scan's targets when set, used for shards
+	SetPhase func(phase string) // Reports pipeline progress, may be nil
+}
+
+// deployScan runs the generate, validate and deploy playbooks of a scan
+func deployScan(ctx context.Context, app *pocketbase.PocketBase, ansibleBasePath string, deployment scanDeployment) error {
+	scanID := deployment.ScanID
+	setPhase := deployment.SetPhase
+	if setPhase == nil {
+		setPhase = func(string) {}
+	}
+
+	// Update scan status to "Generating", saving the VM size from the
+	// scan profile and a fresh API key along with it
+	setPhase("generating")
+	if _, err := lifecycle.Transition(app, scanID, lifecycle.StatusGenerating, deployment.Actor, deployment.Reason, func(record *pbModels.Record) {
+		record.Set("execution_mode", ExecutionModeCloud)
+		if vmSize := deployment.Profile.Get("vm_size"); vmSize != nil {
+			record.Set("vm_size", vmSize)
 		}
+		record.Set("start_time", time.Now().Format(time.RFC3339))
+		record.Set("api_key", utils.GenerateAPIKey())
+	}); err != nil {
+		return fmt.Errorf("failed to update scan status: %v", err)
+	}
 
-		// Update scan status to "Deploying" using fresh record
-		if err := updateScanStatus(app, scanReq.ScanID, "Deploying"); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to update scan status",
-			})
+	// failScan marks the scan as failed; notifications are sent by the lifecycle hook.
+	// A cancelled job was stopped on purpose, so its status is left to whoever stopped it.
+	failScan := func(cause error) error {
+		if ctx.Err() != nil {
+			return cause
+		}
+		if _, updateErr := lifecycle.Transition(app, scanID, lifecycle.StatusFailed, lifecycle.ActorSystem, cause.Error()); updateErr != nil {
+			log.Printf("Failed to update scan status to Failed: %v", updateErr)
 		}
+		return cause
+	}
 
-		// Then run deploy.yml to start the scan
-		log.Printf("Running deploy.yml to start the scan")
-		if err := utils.ExecuteAnsiblePlaybook(
-			deployPlaybookPath,
-			logDir,
-			yamlFile,
-			inventoryPath,
-			ansibleBasePath,
-			app,
-			scanReq.ScanID,
-		); err != nil {
-			// Update scan status to Failed using fresh record
-			if updateErr := updateScanStatus(app, scanReq.ScanID, "Failed"); updateErr != nil {
-				log.Printf("Failed to update scan status to Failed: %v", updateErr)
-			}
+	// Generate YAML file for Ansible
+	yamlContent, err := utils.GenerateYAMLVars(app, scanID)
+	if err != nil {
+		log.Printf("Failed to generate YAML: %v", err)
+		return failScan(fmt.Errorf("failed to generate YAML: %v", err))
+	}
 
-			// Send notification for scan failure
-			if notifyErr := notificationService.NotifyScanFailed(context.Background(), scanReq.ScanID, record.GetString("name"), err.Error()); notifyErr != nil {
-				log.Printf("Failed to send scan failure notification: %v", notifyErr)
-			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to run deploy playbook",
-			})
+	// Define the paths using the scanID
+	scanDir := filepath.Join(ansibleBasePath, "scans", scanID)
+	yamlFile := filepath.Join(scanDir, "scan.yaml")
+	targetsFile := filepath.Join(scanDir, "targets.json")
+	profileFile := filepath.Join(scanDir, "nuclei_profile.yaml")
+	logDir := filepath.Join(scanDir, "logs")
+	generateYamlFile := filepath.Join(ansibleBasePath, "generate.yml")
+	deployPlaybookPath := filepath.Join(scanDir, "deploy.yml")
+	inventoryPath := filepath.Join(scanDir, "inventory")
+
+	// Log the paths for debugging
+	log.Printf("Scan Directory: %s", scanDir)
+	log.Printf("Generate YAML Path: %s", generateYamlFile)
+	log.Printf("Deploy Playbook Path: %s", deployPlaybookPath)
+	log.Printf("Inventory Path: %s", inventoryPath)
+
+	// Create scan directory if it doesn't exist
+	if err := os.MkdirAll(scanDir, 0755); err != nil {
+		log.Printf("Failed to create scan directory: %v", err)
+		return failScan(fmt.Errorf("failed to create scan directory: %v", err))
+	}
+
+	// Create directories and files
+	if err := utils.SetupScanFiles(yamlContent, yamlFile, targetsFile, profileFile, logDir, app, scanID); err != nil {
+		return failScan(err)
+	}
+
+	// A shard only scans its own part of the targets
+	if deployment.Targets != nil {
+		if err := writeTargetsJSON(targetsFile, deployment.Targets); err != nil {
+			return failScan(err)
 		}
+	}
 
-		return c.JSON(http.StatusOK, map[string]string{
-			"status": "Scan started",
-		})
+	// Validate the generate playbook before running it
+	setPhase("validating")
+	if err := validatePlaybook(generateYamlFile, scanID, app); err != nil {
+		log.Printf("Failed to validate generate playbook: %v", err)
+		return failScan(fmt.Errorf("failed to validate generate playbook: %v", err))
+	}
+
+	// First run generate.yml to create all necessary files
+	setPhase("generating")
+	log.Printf("Running generate.yml to create necessary files")
+	if err := utils.ExecuteAnsiblePlaybookContext(
+		ctx,
+		generateYamlFile,
+		logDir,
+		yamlFile,
+		inventoryPath,
+		ansibleBasePath,
+		app,
+		scanID,
+	); err != nil {
+		return failScan(fmt.Errorf("failed to run generate playbook: %v", err))
 	}
+
+	// Now validate the deploy playbook that was just generated
+	setPhase("validating")
+	if err := validatePlaybook(deployPlaybookPath, scanID, app); err != nil {
+		log.Printf("Failed to validate deploy playbook: %v", err)
+		return failScan(fmt.Errorf("failed to validate deploy playbook: %v", err))
+	}
+
+	// Update scan status to "Deploying"
+	setPhase("deploying")
+	if _, err := lifecycle.Transition(app, scanID, lifecycle.StatusDeploying, lifecycle.ActorSystem, "deploy playbook generated"); err != nil {
+		return fmt.Errorf("failed to update scan status: %v", err)
+	}
+
+	// Then run deploy.yml to start the scan
+	log.Printf("Running deploy.yml to start the scan")
+	if err := utils.ExecuteAnsiblePlaybookContext(
+		ctx,
+		deployPlaybookPath,
+		logDir,
+		yamlFile,
+		inventoryPath,
+		ansibleBasePath,
+		app,
+		scanID,
+	); err != nil {
+		return failScan(fmt.Errorf("failed to run deploy playbook: %v", err))
+	}
+
+	return nil
 }
 
 func HandleScanComplete(app *pocketbase.PocketBase) echo.HandlerFunc {
@@ -368,7 +421,7 @@ func HandleScanComplete(app *pocketbase.PocketBase) echo.HandlerFunc {
 			})
 		}
 
-		if err := updateScanStatus(app, req.ScanID, "Destroyed"); err != nil {
+		if _, err := lifecycle.Transition(app, req.ScanID, lifecycle.StatusDestroyed, requestActor(c), "scan completed on VM"); err != nil {
 			log.Printf("Failed to update scan status: %v", err)
 		}
 
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -16,6 +17,8 @@ import (
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
 )
 
 func HandleUpdateScanStatus(app *pocketbase.PocketBase) echo.HandlerFunc {
@@ -24,6 +27,7 @@ func HandleUpdateScanStatus(app *pocketbase.PocketBase) echo.HandlerFunc {
 		var statusUpdate struct {
 			ScanID string `json:"scan_id"`
 			Status string `json:"status"`
+			Reason string `json:"reason"`
 		}
 		if err := c.Bind(&statusUpdate); err != nil {
 			return c.JSON(http.StatusBadRequest, map[string]string{
@@ -46,9 +50,19 @@ func HandleUpdateScanStatus(app *pocketbase.PocketBase) echo.HandlerFunc {
 			})
 		}
 
-		// Update the scan status
-		record.Set("status", statusUpdate.Status)
-		if err := app.Dao().SaveRecord(record); err != nil {
+		// Update the scan status, rejecting stale updates such as a late
+		// callback from a VM that has already been destroyed
+		reason := "status reported by scan"
+		if statusUpdate.Reason != "" {
+			reason = statusUpdate.Reason
+		}
+		if _, err := lifecycle.Transition(app, record.Id, statusUpdate.Status, requestActor(c), reason); err != nil {
+			if errors.Is(err, lifecycle.ErrInvalidTransition) {
+				return c.JSON(http.StatusConflict, map[string]string{
+					"error": fmt.Sprintf("Scan status cannot change from %s to %s", record.GetString("status"), statusUpdate.Status),
+				})
+			}
+			log.Printf("Failed to update scan status: %v", err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{
 				"error": "Failed to update scan status",
 			})
@@ -100,49 +114,9 @@ func HandleUpdateScanLogs(app *pocketbase.PocketBase) echo.HandlerFunc {
 		// Use the decoded logs
 		logsContent := string(decodedLogs)
 
-		// Convert the logs to a log entry with a timestamp
-		logEntry := map[string]interface{}{
-			"timestamp": time.Now().Format(time.RFC3339),
-			"content":   logsContent,
-		}
-
-		// Initialize empty logs slice
-		var existingLogs []interface{}
-
-		// Fetch existing logs from the database
-		ansibleLogsValue := record.Get("ansible_logs")
-		if ansibleLogsValue != nil {
-			// Try to convert directly to slice
-			if logsSlice, ok := ansibleLogsValue.([]interface{}); ok {
-				existingLogs = logsSlice
-			} else {
-				// If not a slice, try to unmarshal from JSON string
-				var logs []interface{}
-				if jsonStr, ok := ansibleLogsValue.(string); ok {
-					if err := json.Unmarshal([]byte(jsonStr), &logs); err == nil {
-						existingLogs = logs
-					}
-				} else {
-					// Try to marshal and unmarshal the value
-					if jsonBytes, err := json.Marshal(ansibleLogsValue); err == nil {
-						if err := json.Unmarshal(jsonBytes, &logs); err == nil {
-							existingLogs = logs
-						}
-					}
-				}
-			}
-		}
-
-		// If we still don't have a valid slice, initialize a new one
-		if existingLogs == nil {
-			existingLogs = make([]interface{}, 0)
-		}
-
-		// Append the new log entry
-		existingLogs = append(existingLogs, logEntry)
+		appendScanLogs(record, logsContent)
 
 		// Update the record
-		record.Set("ansible_logs", existingLogs)
 		if err := app.Dao().SaveRecord(record); err != nil {
 			log.Printf("Failed to save record: %v", err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -156,6 +130,52 @@ func HandleUpdateScanLogs(app *pocketbase.PocketBase) echo.HandlerFunc {
 	}
 }
 
+// appendScanLogs adds a timestamped entry to the ansible_logs of a scan record
+func appendScanLogs(record *models.Record, logsContent string) {
+	// Convert the logs to a log entry with a timestamp
+	logEntry := map[string]interface{}{
+		"timestamp": time.Now().Format(time.RFC3339),
+		"content":   logsContent,
+	}
+
+	// Initialize empty logs slice
+	var existingLogs []interface{}
+
+	// Fetch existing logs from the database
+	ansibleLogsValue := record.Get("ansible_logs")
+	if ansibleLogsValue != nil {
+		// Try to convert directly to slice
+		if logsSlice, ok := ansibleLogsValue.([]interface{}); ok {
+			existingLogs = logsSlice
+		} else {
+			// If not a slice, try to unmarshal from JSON string
+			var logs []interface{}
+			if jsonStr, ok := ansibleLogsValue.(string); ok {
+				if err := json.Unmarshal([]byte(jsonStr), &logs); err == nil {
+					existingLogs = logs
+				}
+			} else {
+				// Try to marshal and unmarshal the value
+				if jsonBytes, err := json.Marshal(ansibleLogsValue); err == nil {
+					if err := json.Unmarshal(jsonBytes, &logs); err == nil {
+						existingLogs = logs
+					}
+				}
+			}
+		}
+	}
+
+	// If we still don't have a valid slice, initialize a new one
+	if existingLogs == nil {
+		existingLogs = make([]interface{}, 0)
+	}
+
+	// Append the new log entry
+	existingLogs = append(existingLogs, logEntry)
+
+	record.Set("ansible_logs", existingLogs)
+}
+
 func HandleUpdateNucleiScanArchives(app *pocketbase.PocketBase) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// Bind the request payload
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	pbModels "github.com/pocketbase/pocketbase/models"
+
+	"bitor/services"
+)
+
+// HandleCreateScanUpload opens a resumable upload session for a scan's results:
+// POST /api/scan/uploads {scan_id, client_id, total_size, chunk_size, sha256}
+func HandleCreateScanUpload(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var request struct {
+			ScanID    string `json:"scan_id"`
+			ClientID  string `json:"client_id"`
+			TotalSize int64  `json:"total_size"`
+			ChunkSize int64  `json:"chunk_size"`
+			SHA256    string `json:"sha256"`
+		}
+		if err := c.Bind(&request); err != nil || request.ScanID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Scan ID is required",
+			})
+		}
+
+		record, err := app.Dao().FindRecordById("nuclei_scans", request.ScanID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Scan not found",
+			})
+		}
+
+		clientID := request.ClientID
+		if clientID == "" {
+			clientID = record.GetString("client")
+		}
+
+		status, err := scanUploadService.Create(record.Id, clientID, importUserID(c), request.TotalSize, request.ChunkSize, request.SHA256)
+		if err != nil {
+			log.Printf("Failed to create upload for scan %s: %v", record.Id, err)
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(http.StatusOK, status)
+	}
+}
+
+// HandleUploadScanChunk writes one chunk of an upload at its offset:
+// POST /api/scan/uploads/:id/chunks (multipart: scan_id, offset, sha256, file)
+func HandleUploadScanChunk(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		upload := findScanUpload(c, c.FormValue("scan_id"))
+		if upload == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Upload not found",
+			})
+		}
+
+		offset, err := strconv.ParseInt(c.FormValue("offset"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid offset",
+			})
+		}
+		checksum := c.FormValue("sha256")
+		if checksum == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Chunk sha256 is required",
+			})
+		}
+
+		file, err := c.FormFile("file")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid file",
+			})
+		}
+		src, err := file.Open()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to open uploaded chunk",
+			})
+		}
+		defer src.Close()
+
+		status, err := scanUploadService.WriteChunk(upload.Id, offset, checksum, src)
+		if err != nil {
+			return scanUploadError(c, upload.Id, err)
+		}
+
+		return c.JSON(http.StatusOK, status)
+	}
+}
+
+// HandleGetScanUpload reports the state of an upload, including the chunks
+// still missing, so an interrupted upload can be resumed:
+// GET /api/scan/uploads/:id?scan_id=<scan>
+func HandleGetScanUpload(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		upload := findScanUpload(c, c.QueryParam("scan_id"))
+		if upload == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Upload not found",
+			})
+		}
+
+		status, err := scanUploadService.Status(upload.Id)
+		if err != nil {
+			return scanUploadError(c, upload.Id, err)
+		}
+
+		return c.JSON(http.StatusOK, status)
+	}
+}
+
+// HandleCompleteScanUpload verifies the whole file against its SHA-256 and
+// queues its import: POST /api/scan/uploads/:id/complete {scan_id}
+func HandleCompleteScanUpload(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var request struct {
+			ScanID string `json:"scan_id"`
+		}
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid request",
+			})
+		}
+
+		upload := findScanUpload(c, request.ScanID)
+		if upload == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Upload not found",
+			})
+		}
+
+		// The session is only closed once its import is registered, so an
+		// upload whose import couldn't be registered can be completed again
+		var imp *pbModels.Record
+		var duplicate bool
+		var registerErr error
+		record, path, err := scanUploadService.Complete(upload.Id, func(record *pbModels.Record, path string) error {
+			imp, duplicate, registerErr = registerImport(app, path, record.GetString("scan"), record.GetString("client"), record.GetString("created_by"), services.ScanImportSourceSession, record.GetString("sha256"))
+			return registerErr
+		})
+		if registerErr != nil {
+			log.Printf("Failed to queue import of upload %s: %v", upload.Id, registerErr)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to queue import",
+			})
+		}
+		if err != nil {
+			// Completing again queues the failed import once more
+			if imp != nil && !duplicate {
+				if failErr := services.FailScanImport(app, imp.Id, err); failErr != nil {
+					log.Printf("Failed to record import failure of upload %s: %v", upload.Id, failErr)
+				}
+			}
+			return scanUploadError(c, upload.Id, err)
+		}
+
+		if duplicate {
+			os.Remove(path)
+		} else {
+			log.Printf("Upload %s of scan %s complete, starting processing", record.Id, record.GetString("scan"))
+			go processFile(app, imp.Id, path, record.GetString("scan"), record.GetString("client"), record.GetString("created_by"))
+		}
+		return respondImport(c, imp, duplicate)
+	}
+}
+
+// findScanUpload loads the upload named in the path, or returns nil if there
+// is none for the given scan. API key requests are authorized per scan, so
+// they must name the scan; users and admins may leave it out.
+func findScanUpload(c echo.Context, scanID string) *pbModels.Record {
+	if scanID == "" && requestActor(c) == "api-key-auth" {
+		return nil
+	}
+
+	upload, err := scanUploadService.Find(c.PathParam("id"))
+	if err != nil {
+		return nil
+	}
+	if scanID != "" && upload.GetString("scan") != scanID {
+		return nil
+	}
+	return upload
+}
+
+func scanUploadError(c echo.Context, uploadID string, err error) error {
+	switch {
+	case errors.Is(err, services.ErrScanUploadInvalidChunk), errors.Is(err, services.ErrScanUploadChecksumMismatch):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	case errors.Is(err, services.ErrScanUploadIncomplete), errors.Is(err, services.ErrScanUploadClosed):
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	log.Printf("Failed to update upload %s: %v", uploadID, err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": "Failed to update upload",
+	})
+}
@@ -0,0 +1,187 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/hook"
+)
+
+// Scan statuses stored in nuclei_scans.status
+const (
+	StatusManual     = "Manual"
+	StatusCreated    = "Created"
+	StatusStarted    = "Started"
+	StatusGenerating = "Generating"
+	StatusDeploying  = "Deploying"
+	StatusRunning    = "Running"
+	StatusFinished   = "Finished"
+	StatusFailed     = "Failed"
+	StatusStopping   = "Stopping"
+	StatusStopped    = "Stopped"
+	StatusTimedOut   = "Timed out"
+	StatusDestroyed  = "Destroyed"
+)
+
+// Actors recorded for transitions that aren't triggered by a user
+const (
+	ActorSystem    = "system"
+	ActorScheduler = "scheduler"
+)
+
+// ErrInvalidTransition is returned when a scan can't move from its current status to the requested one
+var ErrInvalidTransition = errors.New("invalid scan status transition")
+
+// transitions lists the statuses a scan may move to from each status.
+// Finished, Failed, Stopped, Timed out and Destroyed scans may be started
+// again, which takes them back to Generating. Every status a scan can have a
+// VM in, from Deploying on, may move to Destroyed once the VM is gone.
+var transitions = map[string][]string{
+	"":               {StatusCreated, StatusManual, StatusGenerating},
+	StatusCreated:    {StatusStarted, StatusGenerating, StatusFailed, StatusStopping, StatusStopped},
+	StatusStarted:    {StatusGenerating, StatusFailed, StatusStopping, StatusStopped},
+	StatusGenerating: {StatusDeploying, StatusFailed, StatusStopping, StatusStopped},
+	StatusDeploying:  {StatusRunning, StatusFinished, StatusFailed, StatusStopping, StatusStopped, StatusDestroyed},
+	StatusRunning:    {StatusFinished, StatusFailed, StatusStopping, StatusStopped, StatusDestroyed},
+	StatusStopping:   {StatusStopped, StatusTimedOut, StatusFailed, StatusDestroyed},
+	StatusFinished:   {StatusGenerating, StatusStopping, StatusStopped, StatusDestroyed},
+	StatusFailed:     {StatusGenerating, StatusStopping, StatusStopped, StatusDestroyed},
+	StatusStopped:    {StatusGenerating, StatusDestroyed},
+	StatusTimedOut:   {StatusGenerating, StatusDestroyed},
+	StatusDestroyed:  {StatusGenerating},
+	StatusManual:     {},
+}
+
+// TransitionEvent describes a status change that has been saved
+type TransitionEvent struct {
+	Scan   *models.Record
+	From   string
+	To     string
+	Actor  string
+	Reason string
+	Time   time.Time
+}
+
+var onTransition = &hook.Hook[*TransitionEvent]{}
+
+// OnTransition returns the hook fired after every saved scan status change.
+// Handlers run synchronously after the change is committed; an error from a
+// handler is logged and doesn't undo the transition.
+func OnTransition() *hook.Hook[*TransitionEvent] {
+	return onTransition
+}
+
+// CanTransition reports whether a scan may move from one status to another
+func CanTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsActive reports whether a scan in the given status has work in progress
+func IsActive(status string) bool {
+	switch status {
+	case StatusStarted, StatusGenerating, StatusDeploying, StatusRunning, StatusStopping:
+		return true
+	}
+	return false
+}
+
+// IsTerminal reports whether a scan in the given status has ended, so its VM
+// should be gone
+func IsTerminal(status string) bool {
+	switch status {
+	case StatusFinished, StatusFailed, StatusStopped, StatusTimedOut, StatusDestroyed:
+		return true
+	}
+	return false
+}
+
+// Transition moves a scan to a new status. The current status is read inside
+// a transaction, so updates based on a stale view of the scan (for example a
+// late "Running" callback from a VM that was already destroyed) are rejected
+// with ErrInvalidTransition. Optional update funcs can set other fields that
+// must be saved together with the new status.
+//
+// Moving a scan to the status it already has is a no-op and returns a nil event.
+func Transition(app *pocketbase.PocketBase, scanID, to, actor, reason string, updates ...func(record *models.Record)) (*TransitionEvent, error) {
+	var event *TransitionEvent
+
+	err := app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		record, err := txDao.FindRecordById("nuclei_scans", scanID)
+		if err != nil {
+			return fmt.Errorf("failed to find scan: %v", err)
+		}
+
+		from := record.GetString("status")
+		if from == to {
+			return nil
+		}
+		if !CanTransition(from, to) {
+			return fmt.Errorf("%w: %q -> %q", ErrInvalidTransition, from, to)
+		}
+
+		now := time.Now()
+		record.Set("status", to)
+		switch to {
+		case StatusFailed, StatusDestroyed:
+			record.Set("end_time", now.Format(time.RFC3339))
+			record.Set("vm_stop_time", now.Format(time.RFC3339))
+			if to == StatusDestroyed {
+				record.Set("destroyed", true)
+			}
+		}
+		for _, update := range updates {
+			update(record)
+		}
+
+		if err := txDao.SaveRecord(record); err != nil {
+			return fmt.Errorf("failed to save scan status: %v", err)
+		}
+
+		collection, err := txDao.FindCollectionByNameOrId("scan_transitions")
+		if err != nil {
+			return fmt.Errorf("failed to find scan_transitions collection: %v", err)
+		}
+
+		transition := models.NewRecord(collection)
+		transition.Set("scan", scanID)
+		transition.Set("from_status", from)
+		transition.Set("to_status", to)
+		transition.Set("actor", actor)
+		transition.Set("reason", reason)
+		if err := txDao.SaveRecord(transition); err != nil {
+			return fmt.Errorf("failed to record transition: %v", err)
+		}
+
+		event = &TransitionEvent{
+			Scan:   record,
+			From:   from,
+			To:     to,
+			Actor:  actor,
+			Reason: reason,
+			Time:   now,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if event != nil {
+		log.Printf("[Lifecycle] Scan %s: %s -> %s (actor: %s, reason: %s)", scanID, event.From, event.To, actor, reason)
+		if err := onTransition.Trigger(event); err != nil {
+			log.Printf("[Lifecycle] Transition handler failed for scan %s: %v", scanID, err)
+		}
+	}
+
+	return event, nil
+}
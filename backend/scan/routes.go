@@ -4,6 +4,8 @@ import (
 	"log"
 	"bitor/auth"
 	"bitor/scan/handlers"
+	"bitor/scheduler"
+	"bitor/services"
 	"bitor/services/notification"
 
 	"github.com/pocketbase/pocketbase"
@@ -12,7 +14,7 @@ import (
 )
 
 // RegisterRoutes registers the scan routes with the authentication middleware.
-func RegisterRoutes(app *pocketbase.PocketBase, e *core.ServeEvent, ansibleBasePath string, notificationService *notification.NotificationService) {
+func RegisterRoutes(app *pocketbase.PocketBase, e *core.ServeEvent, ansibleBasePath string, notificationService *notification.NotificationService, scanQueue *services.ScanQueue, scanReconciler *services.ScanReconciler, scanScheduler *scheduler.ScanScheduler, budgetService *services.BudgetService, vmReaper *services.VMReaper) {
 	log.Printf("Registering scan routes with ansible base path: %s", ansibleBasePath)
 
 	// Initialize handlers with required services
@@ -30,8 +32,21 @@ func RegisterRoutes(app *pocketbase.PocketBase, e *core.ServeEvent, ansibleBaseP
 	scanGroup.POST("/test-notification", HandleTestNotification)
 
 	// Register scan routes
-	scanGroup.POST("/start", handlers.HandleStartAndGenerateScan(app, ansibleBasePath, notificationService))
-	scanGroup.POST("/stop", handlers.HandleStopScan(app, ansibleBasePath, notificationService))
+	scanGroup.POST("/start", handlers.HandleStartAndGenerateScan(app, scanQueue, budgetService))
+	scanGroup.POST("/plan", handlers.HandlePlanScan(app, ansibleBasePath))
+	scanGroup.GET("/jobs/:id", handlers.HandleGetScanJob(scanQueue))
+	scanGroup.POST("/jobs/:id/retry", handlers.HandleRetryScanJob(scanQueue))
+	scanGroup.GET("/reconcile", handlers.HandleGetReconcileReport(scanReconciler), apis.RequireAdminAuth())
+	scanGroup.GET("/budget", handlers.HandleGetBudgetReport(budgetService), apis.RequireAdminAuth())
+	scanGroup.GET("/orphans", handlers.HandleGetOrphanedVMs(vmReaper), apis.RequireAdminAuth())
+	scanGroup.POST("/orphans/reap", handlers.HandleReapOrphanedVMs(vmReaper), apis.RequireAdminAuth())
+	scanGroup.POST("/stop", handlers.HandleStopScan(app, ansibleBasePath, scanQueue))
+	scanGroup.GET("/:id/shards", handlers.HandleGetScanShards(app))
+	scanGroup.POST("/:id/rerun", handlers.HandleRerunScan(app, scanQueue, budgetService))
+	scanGroup.GET("/:id/runs", handlers.HandleGetScanRuns(app))
+	scanGroup.POST("/:id/rollup/recompute", handlers.HandleRecomputeScanRollup(app))
+	scanGroup.POST("/rollups/recompute", handlers.HandleRecomputeAllRollups(app), apis.RequireAdminAuth())
+	scanGroup.GET("/diff", handlers.HandleScanDiff(app))
 	scanGroup.POST("/generate", handlers.HandleGenerateScan(app, ansibleBasePath))
 	scanGroup.POST("/destroy", handlers.HandleDestroyScan(app, ansibleBasePath))
 	scanGroup.POST("/update-status", handlers.HandleUpdateScanStatus(app))
@@ -42,10 +57,26 @@ func RegisterRoutes(app *pocketbase.PocketBase, e *core.ServeEvent, ansibleBaseP
 	scanGroup.POST("/update-vm-times", handlers.HandleUpdateVMTimes(app))
 	scanGroup.POST("/update-nuclei-times", handlers.HandleUpdateNucleiTimes(app))
 	scanGroup.POST("/update-skipped-hosts", handlers.HandleUpdateSkippedHosts(app))
+	scanGroup.POST("/update-progress", handlers.HandleUpdateScanProgress(app))
 	scanGroup.GET("/current-cost", handlers.HandleGetCurrentCost(app))
 	scanGroup.POST("/import-scan-results", handlers.HandleImportNucleiScanResults(app))
+	scanGroup.POST("/ingest-findings", handlers.HandleIngestFindings(app))
+	scanGroup.POST("/ingest-findings/complete", handlers.HandleCompleteIngestFindings(app))
+	scanGroup.POST("/uploads", handlers.HandleCreateScanUpload(app))
+	scanGroup.GET("/uploads/:id", handlers.HandleGetScanUpload(app))
+	scanGroup.POST("/uploads/:id/chunks", handlers.HandleUploadScanChunk(app))
+	scanGroup.POST("/uploads/:id/complete", handlers.HandleCompleteScanUpload(app))
 	scanGroup.POST("/signed-url", handlers.HandleSignedURL(app))
 	scanGroup.POST("/schedule", handlers.HandleScheduleScan(app))
 	scanGroup.GET("/scheduled", handlers.HandleGetScheduledScans(app))
+	scanGroup.GET("/scheduled/:id/next-runs", handlers.HandleGetScheduledScanNextRuns(scanScheduler))
 	scanGroup.DELETE("/scheduled/:id", handlers.HandleDeleteScheduledScan(app))
+
+	// Imports of scan results are tracked as jobs the uploader can poll
+	importGroup := e.Router.Group("/api/imports",
+		apis.LoadAuthContext(app),
+		auth.RequireAuthOrAPIKey(app),
+		apis.ActivityLogger(app),
+	)
+	importGroup.GET("/:id", handlers.HandleGetImport(app))
 }
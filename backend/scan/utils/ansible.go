@@ -18,24 +18,6 @@ import (
 	"github.com/pocketbase/pocketbase"
 )
 
-var (
-	showLogsInTerminal bool
-	dbBasePath         string // Store the absolute path to the database directory
-)
-
-// InitDBPath initializes the database path - call this when the app starts
-func InitDBPath(app *pocketbase.PocketBase) {
-	// Get the absolute path to the database directory
-	if app.DataDir() != "" {
-		dbBasePath = filepath.Clean(app.DataDir())
-		if !filepath.IsAbs(dbBasePath) {
-			if abs, err := filepath.Abs(dbBasePath); err == nil {
-				dbBasePath = abs
-			}
-		}
-	}
-}
-
 // realTimeLogger implements io.Writer to handle real-time log processing
 type realTimeLogger struct {
 	app        *pocketbase.PocketBase
@@ -120,26 +102,6 @@ func (l *realTimeLogger) flushLogs() error {
 		return nil
 	}
 
-	// Store current working directory
-	currentDir, err := os.Getwd()
-	if err != nil {
-		log.Printf("Warning: Could not get current working directory: %v", err)
-	}
-
-	// If we have a stored database path and we're in a different directory, temporarily change back
-	if dbBasePath != "" && currentDir != filepath.Dir(dbBasePath) {
-		if err := os.Chdir(filepath.Dir(dbBasePath)); err != nil {
-			log.Printf("Warning: Could not change to database directory: %v", err)
-		} else {
-			// Ensure we change back when done
-			defer func() {
-				if err := os.Chdir(currentDir); err != nil {
-					log.Printf("Warning: Could not restore working directory: %v", err)
-				}
-			}()
-		}
-	}
-
 	// Create a copy of the logs we're about to flush
 	logsToFlush := make([]interface{}, len(l.logEntries))
 	copy(logsToFlush, l.logEntries)
@@ -207,88 +169,94 @@ func (l *realTimeLogger) flushLogs() error {
 	return lastErr
 }
 
-// ExecuteAnsiblePlaybook executes an ansible playbook
-func ExecuteAnsiblePlaybook(playbookPath, logDir, extraVarsFile, inventoryPath, ansibleBasePath string, app *pocketbase.PocketBase, scanID string) error {
-	// Get the absolute path of the working directory first
-	workDir, err := os.Getwd()
-	if err != nil {
-		return fmt.Errorf("failed to get working directory: %v", err)
-	}
+// AnsibleExecContext holds everything a single ansible-playbook run needs.
+// Nothing in it is shared between runs, so several scans can execute
+// playbooks at the same time without touching the working directory or
+// the environment of the server process.
+type AnsibleExecContext struct {
+	WorkDir       string            // Directory ansible-playbook is run from
+	LogDir        string            // Directory for ansible.log and the vault password file
+	ExtraVarsFile string            // Absolute path to the extra vars file
+	InventoryPath string            // Absolute path to the inventory
+	Env           map[string]string // Environment added to this run only
+	Binary        string            // ansible-playbook binary, empty means the one on PATH
+	ShowLogs      bool              // Mirror the playbook output to the terminal
+}
 
+// NewAnsibleExecContext builds an execution context, resolving relative paths
+// against the ansible base path.
+func NewAnsibleExecContext(logDir, extraVarsFile, inventoryPath, ansibleBasePath string) (*AnsibleExecContext, error) {
 	// Convert ansible base path to absolute if it isn't already
-	if !filepath.IsAbs(ansibleBasePath) {
-		ansibleBasePath = filepath.Join(workDir, ansibleBasePath)
+	workDir, err := filepath.Abs(ansibleBasePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve ansible base path: %v", err)
 	}
 
-	// Convert all paths to absolute paths
-	if !filepath.IsAbs(playbookPath) {
-		playbookPath = filepath.Join(ansibleBasePath, playbookPath)
-	}
-	if !filepath.IsAbs(logDir) {
-		logDir = filepath.Join(ansibleBasePath, logDir)
+	// Ensure ansible base path exists
+	if _, err := os.Stat(workDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("ansible base path does not exist: %s", workDir)
 	}
-	if !filepath.IsAbs(extraVarsFile) {
-		extraVarsFile = filepath.Join(ansibleBasePath, extraVarsFile)
+
+	ec := &AnsibleExecContext{
+		WorkDir:  workDir,
+		Binary:   os.Getenv("ANSIBLE_PLAYBOOK_BINARY"),
+		ShowLogs: os.Getenv("SHOW_ANSIBLE_LOGS") == "true",
 	}
-	if !filepath.IsAbs(inventoryPath) {
-		inventoryPath = filepath.Join(ansibleBasePath, inventoryPath)
+	ec.LogDir = ec.resolve(logDir)
+	ec.ExtraVarsFile = ec.resolve(extraVarsFile)
+	ec.InventoryPath = ec.resolve(inventoryPath)
+	ec.Env = map[string]string{
+		"ANSIBLE_STDOUT_CALLBACK":     "default",
+		"ANSIBLE_RETRY_FILES_ENABLED": "false",
 	}
 
-	// Get the show logs flag from environment
-	showLogsInTerminal = os.Getenv("SHOW_ANSIBLE_LOGS") == "true"
-
-	// Set required environment variables with absolute paths
-	os.Setenv("ANSIBLE_HOST_KEY_CHECKING", "false")
-	os.Setenv("ANSIBLE_FORCE_COLOR", "true")
-	os.Setenv("ANSIBLE_ACTION_WARNINGS", "false")
-	os.Setenv("ANSIBLE_STDOUT_CALLBACK", "default")
-	os.Setenv("ANSIBLE_RETRY_FILES_ENABLED", "false")
-	os.Setenv("ANSIBLE_INVENTORY", inventoryPath)
+	return ec, nil
+}
 
-	// Get the scan record to use its API key as the vault password
-	record, err := app.Dao().FindRecordById("nuclei_scans", scanID)
-	if err != nil {
-		return fmt.Errorf("failed to find scan record: %v", err)
-	}
-	scanApiKey := record.GetString("api_key")
-	if scanApiKey == "" {
-		return fmt.Errorf("scan API key not found")
+// resolve returns path as an absolute path, relative paths being taken from the working directory
+func (ec *AnsibleExecContext) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
 	}
+	return filepath.Join(ec.WorkDir, path)
+}
 
-	// Create a temporary vault password file with absolute path
-	vaultPassFile := filepath.Join(logDir, ".vault_pass")
-	if err := os.MkdirAll(filepath.Dir(vaultPassFile), 0755); err != nil {
-		return fmt.Errorf("failed to create vault pass directory: %v", err)
+// writeVaultPassFile writes the vault password to a file only this run uses
+// and returns its path. The caller removes the file when the run is over.
+func (ec *AnsibleExecContext) writeVaultPassFile(password string) (string, error) {
+	if err := os.MkdirAll(ec.LogDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create vault pass directory: %v", err)
 	}
-	if err := os.WriteFile(vaultPassFile, []byte(scanApiKey), 0600); err != nil {
-		return fmt.Errorf("failed to write vault password file: %v", err)
-	}
-	defer os.Remove(vaultPassFile)
 
-	// Ensure ansible base path exists
-	if _, err := os.Stat(ansibleBasePath); os.IsNotExist(err) {
-		return fmt.Errorf("ansible base path does not exist: %s", ansibleBasePath)
+	// CreateTemp gives every run its own file (mode 0600), so a playbook
+	// finishing early can't remove the password of one still running
+	file, err := os.CreateTemp(ec.LogDir, ".vault_pass-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create vault password file: %v", err)
 	}
+	defer file.Close()
 
-	// Change to the ansible directory
-	if err := os.Chdir(ansibleBasePath); err != nil {
-		return fmt.Errorf("failed to change to ansible directory: %v", err)
+	if _, err := file.WriteString(password); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write vault password file: %v", err)
 	}
 
-	// Ensure we change back to the original directory when done
-	defer func() {
-		if err := os.Chdir(workDir); err != nil {
-			log.Printf("Warning: Failed to restore original directory: %v", err)
-		}
-	}()
+	return file.Name(), nil
+}
+
+// Run executes a playbook within this context. Output is written to
+// LogDir/ansible.log and stored on the scan record as it arrives.
+func (ec *AnsibleExecContext) Run(ctx context.Context, playbookPath, vaultPassword string, app *pocketbase.PocketBase, scanID string) error {
+	playbookPath = ec.resolve(playbookPath)
 
-	// Create log directory if it doesn't exist
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return fmt.Errorf("failed to create log directory: %v", err)
+	vaultPassFile, err := ec.writeVaultPassFile(vaultPassword)
+	if err != nil {
+		return err
 	}
+	defer os.Remove(vaultPassFile)
 
 	// Create log file with absolute path
-	logFilePath := filepath.Join(logDir, "ansible.log")
+	logFilePath := filepath.Join(ec.LogDir, "ansible.log")
 	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to create log file: %v", err)
@@ -315,7 +283,7 @@ func ExecuteAnsiblePlaybook(playbookPath, logDir, extraVarsFile, inventoryPath,
 	// Create multi-writers for stdout and stderr
 	var stdoutWriter io.Writer = io.MultiWriter(logFile, stdoutLogger)
 	var stderrWriter io.Writer = io.MultiWriter(logFile, stderrLogger)
-	if showLogsInTerminal {
+	if ec.ShowLogs {
 		stdoutWriter = io.MultiWriter(os.Stdout, logFile, stdoutLogger)
 		stderrWriter = io.MultiWriter(os.Stderr, logFile, stderrLogger)
 	}
@@ -331,38 +299,46 @@ func ExecuteAnsiblePlaybook(playbookPath, logDir, extraVarsFile, inventoryPath,
 	}()
 
 	ansiblePlaybookOptions := &playbook.AnsiblePlaybookOptions{
-		ExtraVarsFile: []string{fmt.Sprintf("@%s", extraVarsFile)},
+		ExtraVarsFile: []string{fmt.Sprintf("@%s", ec.ExtraVarsFile)},
 		ExtraVars: map[string]interface{}{
 			"scan_id": scanID,
 		},
 	}
 
-	playbookCmd := playbook.NewAnsiblePlaybookCmd(
+	playbookCmdOptions := []playbook.AnsiblePlaybookOptionsFunc{
 		playbook.WithPlaybooks(playbookPath),
 		playbook.WithPlaybookOptions(ansiblePlaybookOptions),
-	)
+	}
+	if ec.Binary != "" {
+		playbookCmdOptions = append(playbookCmdOptions, playbook.WithBinary(ec.Binary))
+	}
+	playbookCmd := playbook.NewAnsiblePlaybookCmd(playbookCmdOptions...)
 
 	// Create a writer that captures both stdout/stderr and errors
 	errWriter := &bytes.Buffer{}
 	combinedWriter := io.MultiWriter(stderrWriter, errWriter)
 
+	// The working directory and environment are set on the command itself
+	// rather than on the server process
 	exec := configuration.NewAnsibleWithConfigurationSettingsExecute(
 		execute.NewDefaultExecute(
 			execute.WithCmd(playbookCmd),
+			execute.WithCmdRunDir(ec.WorkDir),
+			execute.WithEnvVars(ec.Env),
 			execute.WithWrite(stdoutWriter),
 			execute.WithWrite(combinedWriter),
 			execute.WithErrorEnrich(playbook.NewAnsiblePlaybookErrorEnrich()),
 		),
 		configuration.WithAnsibleForceColor(),
 		configuration.WithAnsibleForks(10),
-		configuration.WithAnsibleInventory(inventoryPath),
+		configuration.WithAnsibleInventory(ec.InventoryPath),
 		configuration.WithAnsibleHostKeyChecking(),
 		configuration.WithoutAnsibleActionWarnings(),
 		configuration.WithAnsibleVaultPasswordFile(vaultPassFile),
 	)
 
 	// Execute the playbook
-	if err := exec.Execute(context.Background()); err != nil {
+	if err := exec.Execute(ctx); err != nil {
 		log.Printf("Error executing Ansible playbook: %v", err)
 		// Get any error output
 		if errOutput := errWriter.String(); errOutput != "" {
@@ -383,3 +359,28 @@ func ExecuteAnsiblePlaybook(playbookPath, logDir, extraVarsFile, inventoryPath,
 
 	return nil
 }
+
+// ExecuteAnsiblePlaybook executes an ansible playbook
+func ExecuteAnsiblePlaybook(playbookPath, logDir, extraVarsFile, inventoryPath, ansibleBasePath string, app *pocketbase.PocketBase, scanID string) error {
+	return ExecuteAnsiblePlaybookContext(context.Background(), playbookPath, logDir, extraVarsFile, inventoryPath, ansibleBasePath, app, scanID)
+}
+
+// ExecuteAnsiblePlaybookContext executes an ansible playbook, killing it if ctx is cancelled
+func ExecuteAnsiblePlaybookContext(ctx context.Context, playbookPath, logDir, extraVarsFile, inventoryPath, ansibleBasePath string, app *pocketbase.PocketBase, scanID string) error {
+	ec, err := NewAnsibleExecContext(logDir, extraVarsFile, inventoryPath, ansibleBasePath)
+	if err != nil {
+		return err
+	}
+
+	// Get the scan record to use its API key as the vault password
+	record, err := app.Dao().FindRecordById("nuclei_scans", scanID)
+	if err != nil {
+		return fmt.Errorf("failed to find scan record: %v", err)
+	}
+	scanApiKey := record.GetString("api_key")
+	if scanApiKey == "" {
+		return fmt.Errorf("scan API key not found")
+	}
+
+	return ec.Run(ctx, playbookPath, scanApiKey, app, scanID)
+}
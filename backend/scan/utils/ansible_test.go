@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ansibleStub stands in for ansible-playbook: it writes what the run saw to
+// the file named by STUB_OUT and prints nothing, so no scan logs are stored
+const ansibleStub = `#!/bin/sh
+sleep 0.1
+{
+	echo "cwd=$(pwd -P)"
+	echo "run=$BITOR_TEST_RUN"
+	echo "inventory=$ANSIBLE_INVENTORY"
+	echo "vault_file=$ANSIBLE_VAULT_PASSWORD_FILE"
+	echo "vault_password=$(cat "$ANSIBLE_VAULT_PASSWORD_FILE")"
+	echo "args=$*"
+} > "$STUB_OUT"
+`
+
+func TestAnsibleExecContextRunParallel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the ansible-playbook stub is a shell script")
+	}
+
+	binary := filepath.Join(t.TempDir(), "ansible-playbook")
+	if err := os.WriteFile(binary, []byte(ansibleStub), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const runs = 16
+	contexts := make([]*AnsibleExecContext, runs)
+	for i := range contexts {
+		basePath := t.TempDir()
+		if err := os.WriteFile(filepath.Join(basePath, "playbook.yml"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		ec, err := NewAnsibleExecContext("logs", "extra_vars.yml", "inventory.ini", basePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ec.Binary = binary
+		ec.ShowLogs = false
+		ec.Env["BITOR_TEST_RUN"] = fmt.Sprintf("run-%d", i)
+		ec.Env["STUB_OUT"] = filepath.Join(basePath, "stub.out")
+		contexts[i] = ec
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, runs)
+	for i, ec := range contexts {
+		wg.Add(1)
+		go func(i int, ec *AnsibleExecContext) {
+			defer wg.Done()
+			errs[i] = ec.Run(context.Background(), "playbook.yml", fmt.Sprintf("password-%d", i), nil, fmt.Sprintf("scan%d", i))
+		}(i, ec)
+	}
+	wg.Wait()
+
+	for i, ec := range contexts {
+		if errs[i] != nil {
+			t.Errorf("run %d failed: %v", i, errs[i])
+			continue
+		}
+
+		seen := readStubOutput(t, ec.Env["STUB_OUT"])
+		workDir, err := filepath.EvalSymlinks(ec.WorkDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seen["cwd"] != workDir {
+			t.Errorf("run %d ran in %s, want %s", i, seen["cwd"], workDir)
+		}
+		if want := fmt.Sprintf("run-%d", i); seen["run"] != want {
+			t.Errorf("run %d saw BITOR_TEST_RUN=%s, want %s", i, seen["run"], want)
+		}
+		if seen["inventory"] != ec.InventoryPath {
+			t.Errorf("run %d used inventory %s, want %s", i, seen["inventory"], ec.InventoryPath)
+		}
+		if want := fmt.Sprintf("password-%d", i); seen["vault_password"] != want {
+			t.Errorf("run %d read vault password %q, want %q", i, seen["vault_password"], want)
+		}
+		if filepath.Dir(seen["vault_file"]) != ec.LogDir {
+			t.Errorf("run %d vault file %s isn't in %s", i, seen["vault_file"], ec.LogDir)
+		}
+		if _, err := os.Stat(seen["vault_file"]); !os.IsNotExist(err) {
+			t.Errorf("run %d vault file %s wasn't removed", i, seen["vault_file"])
+		}
+		if !strings.Contains(seen["args"], "@"+ec.ExtraVarsFile) {
+			t.Errorf("run %d args %q don't include its extra vars file", i, seen["args"])
+		}
+	}
+
+	// Nothing of a run may leak into the server process
+	if got, _ := os.Getwd(); got != cwd {
+		t.Errorf("working directory changed to %s", got)
+	}
+	if got := os.Getenv("BITOR_TEST_RUN"); got != "" {
+		t.Errorf("BITOR_TEST_RUN leaked into the process environment: %s", got)
+	}
+}
+
+// readStubOutput parses the key=value lines the stub wrote
+func readStubOutput(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("stub output missing: %v", err)
+	}
+	seen := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			seen[key] = value
+		}
+	}
+	return seen
+}
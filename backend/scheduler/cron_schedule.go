@@ -0,0 +1,239 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"bitor/models"
+)
+
+// cronDays maps day names to cron day-of-week numbers
+var cronDays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// monthWeeks maps week names to the occurrence of a weekday in a month, -1 being the last
+var monthWeeks = map[string]int{
+	"first":  1,
+	"second": 2,
+	"third":  3,
+	"fourth": 4,
+	"last":   -1,
+}
+
+// ValidateScheduleDetails checks the start time and timezone of a schedule
+func ValidateScheduleDetails(details *models.ScheduleDetails) error {
+	if details == nil {
+		return nil
+	}
+	if _, _, err := startTimeOf(details); err != nil {
+		return err
+	}
+	if _, err := locationOf(details); err != nil {
+		return err
+	}
+	if details.AllowedDuration < 0 {
+		return fmt.Errorf("allowed duration can't be negative")
+	}
+	return nil
+}
+
+// buildSchedule returns the cron schedule of a scheduled scan. One-time and
+// nth-weekday schedules can't be written as cron expressions, so they get
+// their own cron.Schedule implementations.
+func buildSchedule(schedule models.ScheduledScan) (cron.Schedule, error) {
+	details := schedule.ScheduleDetails
+
+	if schedule.Frequency == "one-time" || (details != nil && details.Type == "one-time") {
+		if schedule.StartDate.IsZero() {
+			return nil, fmt.Errorf("one-time schedule has no start date")
+		}
+		return onceSchedule{at: schedule.StartDate}, nil
+	}
+
+	if details != nil && details.Frequency == "monthly" && details.MonthlyType == "day" {
+		return nthWeekdayScheduleOf(details)
+	}
+
+	cronExpr, err := generateCronExpression(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	cronSchedule, err := cronParser.Parse(cronExpr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %v", cronExpr, err)
+	}
+	return cronSchedule, nil
+}
+
+// generateCronExpression returns the six-field (with seconds) cron expression
+// of a schedule, prefixed with CRON_TZ when the schedule has a timezone.
+// Schedule details take precedence over a stored expression.
+func generateCronExpression(schedule models.ScheduledScan) (string, error) {
+	details := schedule.ScheduleDetails
+	if details == nil {
+		if schedule.CronExpression == "" {
+			return "", fmt.Errorf("schedule has no details or cron expression")
+		}
+		// Expressions without a seconds field fire at second zero
+		if len(strings.Fields(schedule.CronExpression)) == 5 {
+			return "0 " + schedule.CronExpression, nil
+		}
+		return schedule.CronExpression, nil
+	}
+
+	hour, minute, err := startTimeOf(details)
+	if err != nil {
+		return "", err
+	}
+
+	var dom, dow string
+	switch details.Frequency {
+	case "daily":
+		dom, dow = "*", "*"
+	case "weekly":
+		days := make([]string, 0, len(details.SelectedDays))
+		for _, day := range details.SelectedDays {
+			if cronDay, ok := cronDays[strings.ToLower(day)]; ok {
+				days = append(days, fmt.Sprint(int(cronDay)))
+			}
+		}
+		if len(days) == 0 {
+			return "", fmt.Errorf("weekly schedule has no valid days")
+		}
+		dom, dow = "*", strings.Join(days, ",")
+	case "monthly":
+		if details.MonthlyType != "date" || details.MonthlyDate < 1 || details.MonthlyDate > 31 {
+			return "", fmt.Errorf("monthly schedule needs a date between 1 and 31")
+		}
+		dom, dow = fmt.Sprint(details.MonthlyDate), "*"
+	default:
+		return "", fmt.Errorf("unknown frequency %q", details.Frequency)
+	}
+
+	cronExpr := fmt.Sprintf("0 %d %d %s * %s", minute, hour, dom, dow)
+	if details.Timezone != "" {
+		cronExpr = fmt.Sprintf("CRON_TZ=%s %s", details.Timezone, cronExpr)
+	}
+	return cronExpr, nil
+}
+
+// startTimeOf returns the hour and minute a schedule starts at, midnight by default
+func startTimeOf(details *models.ScheduleDetails) (int, int, error) {
+	if details.StartTime == "" {
+		return 0, 0, nil
+	}
+	startTime, err := time.Parse("15:04", details.StartTime)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start time %q, expected HH:MM", details.StartTime)
+	}
+	return startTime.Hour(), startTime.Minute(), nil
+}
+
+// locationOf returns the timezone of a schedule, the server's local time by default
+func locationOf(details *models.ScheduleDetails) (*time.Location, error) {
+	if details.Timezone == "" {
+		return time.Local, nil
+	}
+	location, err := time.LoadLocation(details.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", details.Timezone, err)
+	}
+	return location, nil
+}
+
+// nthWeekdayScheduleOf builds the schedule for "the second Tuesday of the month" style details
+func nthWeekdayScheduleOf(details *models.ScheduleDetails) (cron.Schedule, error) {
+	weekday, ok := cronDays[strings.ToLower(details.MonthlyDay)]
+	if !ok {
+		return nil, fmt.Errorf("invalid monthly day %q", details.MonthlyDay)
+	}
+	week, ok := monthWeeks[strings.ToLower(details.MonthlyWeek)]
+	if !ok {
+		return nil, fmt.Errorf("invalid monthly week %q", details.MonthlyWeek)
+	}
+	hour, minute, err := startTimeOf(details)
+	if err != nil {
+		return nil, err
+	}
+	location, err := locationOf(details)
+	if err != nil {
+		return nil, err
+	}
+
+	return nthWeekdaySchedule{
+		weekday:  weekday,
+		week:     week,
+		hour:     hour,
+		minute:   minute,
+		location: location,
+	}, nil
+}
+
+// nthWeekdaySchedule fires on the nth (or last) given weekday of every month
+type nthWeekdaySchedule struct {
+	weekday  time.Weekday
+	week     int // 1-4, or -1 for the last one in the month
+	hour     int
+	minute   int
+	location *time.Location
+}
+
+// Next implements cron.Schedule
+func (s nthWeekdaySchedule) Next(t time.Time) time.Time {
+	t = t.In(s.location)
+	year, month := t.Year(), t.Month()
+
+	// The target day exists in every month, so this month or the next one always matches
+	for i := 0; i < 2; i++ {
+		candidate := time.Date(year, month, s.dayIn(year, month), s.hour, s.minute, 0, 0, s.location)
+		if candidate.After(t) {
+			return candidate
+		}
+		month++
+		if month > time.December {
+			month = time.January
+			year++
+		}
+	}
+	return time.Time{}
+}
+
+// dayIn returns the day of the month the schedule fires on
+func (s nthWeekdaySchedule) dayIn(year int, month time.Month) int {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, s.location)
+	day := 1 + (int(s.weekday)-int(first.Weekday())+7)%7
+
+	if s.week > 0 {
+		return day + 7*(s.week-1)
+	}
+
+	daysInMonth := time.Date(year, month+1, 0, 0, 0, 0, 0, s.location).Day()
+	for day+7 <= daysInMonth {
+		day += 7
+	}
+	return day
+}
+
+// onceSchedule fires a single time
+type onceSchedule struct {
+	at time.Time
+}
+
+// Next implements cron.Schedule; the zero time tells cron there are no more runs
+func (s onceSchedule) Next(t time.Time) time.Time {
+	if s.at.After(t) {
+		return s.at
+	}
+	return time.Time{}
+}
@@ -0,0 +1,204 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"bitor/models"
+)
+
+func TestGenerateCronExpression(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule models.ScheduledScan
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "stored expression without seconds",
+			schedule: models.ScheduledScan{CronExpression: "30 2 * * 1"},
+			want:     "0 30 2 * * 1",
+		},
+		{
+			name:     "daily at midnight by default",
+			schedule: models.ScheduledScan{ScheduleDetails: &models.ScheduleDetails{Frequency: "daily"}},
+			want:     "0 0 0 * * *",
+		},
+		{
+			name: "weekly",
+			schedule: models.ScheduledScan{ScheduleDetails: &models.ScheduleDetails{
+				Frequency:    "weekly",
+				SelectedDays: []string{"Monday", "wednesday", "Friday"},
+				StartTime:    "09:30",
+			}},
+			want: "0 30 9 * * 1,3,5",
+		},
+		{
+			name: "weekly in a timezone",
+			schedule: models.ScheduledScan{ScheduleDetails: &models.ScheduleDetails{
+				Frequency:    "weekly",
+				SelectedDays: []string{"sunday"},
+				StartTime:    "23:05",
+				Timezone:     "Europe/Berlin",
+			}},
+			want: "CRON_TZ=Europe/Berlin 0 5 23 * * 0",
+		},
+		{
+			name: "weekly without valid days",
+			schedule: models.ScheduledScan{ScheduleDetails: &models.ScheduleDetails{
+				Frequency:    "weekly",
+				SelectedDays: []string{"someday"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "monthly date",
+			schedule: models.ScheduledScan{ScheduleDetails: &models.ScheduleDetails{
+				Frequency:   "monthly",
+				MonthlyType: "date",
+				MonthlyDate: 15,
+				StartTime:   "02:00",
+			}},
+			want: "0 0 2 15 * *",
+		},
+		{
+			name: "monthly date out of range",
+			schedule: models.ScheduledScan{ScheduleDetails: &models.ScheduleDetails{
+				Frequency:   "monthly",
+				MonthlyType: "date",
+				MonthlyDate: 32,
+			}},
+			wantErr: true,
+		},
+		{
+			// The nth weekday of a month has no cron expression, buildSchedule handles it
+			name: "monthly nth weekday",
+			schedule: models.ScheduledScan{ScheduleDetails: &models.ScheduleDetails{
+				Frequency:   "monthly",
+				MonthlyType: "day",
+				MonthlyDay:  "tuesday",
+				MonthlyWeek: "second",
+			}},
+			wantErr: true,
+		},
+		{
+			name: "invalid start time",
+			schedule: models.ScheduledScan{ScheduleDetails: &models.ScheduleDetails{
+				Frequency: "daily",
+				StartTime: "25:00",
+			}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := generateCronExpression(tt.schedule)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildScheduleNthWeekday(t *testing.T) {
+	schedule, err := buildSchedule(models.ScheduledScan{ScheduleDetails: &models.ScheduleDetails{
+		Frequency:   "monthly",
+		MonthlyType: "day",
+		MonthlyDay:  "Tuesday",
+		MonthlyWeek: "Second",
+		StartTime:   "09:00",
+		Timezone:    "UTC",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC)
+	if got, want := schedule.Next(from), time.Date(2026, time.October, 13, 9, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Next(%s) = %s, want %s", from, got, want)
+	}
+}
+
+func TestNthWeekdayScheduleNext(t *testing.T) {
+	mustLoad := func(name string) *time.Location {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return location
+	}
+	newYork := mustLoad("America/New_York")
+	tokyo := mustLoad("Asia/Tokyo")
+
+	tests := []struct {
+		name     string
+		schedule nthWeekdaySchedule
+		from     time.Time
+		want     time.Time
+	}{
+		{
+			name:     "second tuesday later this month",
+			schedule: nthWeekdaySchedule{weekday: time.Tuesday, week: 2, hour: 9, location: time.UTC},
+			from:     time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, time.October, 13, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "second tuesday at its own start time moves to next month",
+			schedule: nthWeekdaySchedule{weekday: time.Tuesday, week: 2, hour: 9, location: time.UTC},
+			from:     time.Date(2026, time.October, 13, 9, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, time.November, 10, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "last friday in a month with five",
+			schedule: nthWeekdaySchedule{weekday: time.Friday, week: -1, hour: 18, minute: 30, location: time.UTC},
+			from:     time.Date(2026, time.October, 24, 0, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, time.October, 30, 18, 30, 0, 0, time.UTC),
+		},
+		{
+			name:     "last sunday of february",
+			schedule: nthWeekdaySchedule{weekday: time.Sunday, week: -1, location: time.UTC},
+			from:     time.Date(2027, time.February, 1, 0, 0, 0, 0, time.UTC),
+			want:     time.Date(2027, time.February, 28, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "last monday rolls over into the next year",
+			schedule: nthWeekdaySchedule{weekday: time.Monday, week: -1, hour: 6, location: time.UTC},
+			from:     time.Date(2026, time.December, 29, 0, 0, 0, 0, time.UTC),
+			want:     time.Date(2027, time.January, 25, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "first monday after the end of daylight saving time",
+			schedule: nthWeekdaySchedule{weekday: time.Monday, week: 1, hour: 8, location: newYork},
+			from:     time.Date(2026, time.November, 2, 12, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, time.November, 2, 13, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "timezone already past the day in UTC",
+			schedule: nthWeekdaySchedule{weekday: time.Monday, week: 1, hour: 7, location: tokyo},
+			from:     time.Date(2026, time.November, 1, 23, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, time.December, 6, 22, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.schedule.Next(tt.from)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want.In(tt.schedule.location))
+			}
+			if got.Location() != tt.schedule.location {
+				t.Errorf("Next returned a time in %s, want %s", got.Location(), tt.schedule.location)
+			}
+		})
+	}
+}
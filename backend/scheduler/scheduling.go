@@ -3,47 +3,111 @@
 package scheduler
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
 	"github.com/robfig/cron/v3"
 
 	pbModels "github.com/pocketbase/pocketbase/models"
 
 	"bitor/models"
-	"bitor/scan/utils"
+	"bitor/scan/lifecycle"
+	"bitor/services"
+	"bitor/services/notification"
 )
 
+// ErrScheduleNotFound is returned when a scheduled_scans record doesn't exist
+var ErrScheduleNotFound = errors.New("scheduled scan not found")
+
+// cronParser parses the six-field (with seconds) expressions used by the scan scheduler
+var cronParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
 type ScanScheduler struct {
 	Cron            *cron.Cron
 	App             *pocketbase.PocketBase
 	AnsibleBasePath string
+	Queue           *services.ScanQueue
+	Budget          *services.BudgetService
+
+	entries map[string]cron.EntryID // Cron entry of each scheduled_scans record
+	hookIDs map[string]string       // Model hook registrations, removed on Stop
+	mutex   sync.Mutex
 }
 
-func NewScanScheduler(app *pocketbase.PocketBase, ansibleBasePath string) *ScanScheduler {
+func NewScanScheduler(app *pocketbase.PocketBase, ansibleBasePath string, queue *services.ScanQueue, budget *services.BudgetService) *ScanScheduler {
 	log.Printf("Creating new scan scheduler with ansible base path: %s", ansibleBasePath)
-	c := cron.New(cron.WithSeconds())
+	c := cron.New(cron.WithParser(cronParser))
 	return &ScanScheduler{
 		Cron:            c,
 		App:             app,
 		AnsibleBasePath: ansibleBasePath,
+		Queue:           queue,
+		Budget:          budget,
+		entries:         make(map[string]cron.EntryID),
+		hookIDs:         make(map[string]string),
 	}
 }
 
 func (s *ScanScheduler) Start() {
 	log.Printf("Starting scan scheduler with ansible base path: %s", s.AnsibleBasePath)
 	s.scheduleExistingScans()
+	s.registerHooks()
 	s.Cron.Start()
 }
 
 func (s *ScanScheduler) Stop() {
+	s.mutex.Lock()
+	if id, ok := s.hookIDs["create"]; ok {
+		s.App.OnModelAfterCreate("scheduled_scans").Remove(id)
+	}
+	if id, ok := s.hookIDs["update"]; ok {
+		s.App.OnModelAfterUpdate("scheduled_scans").Remove(id)
+	}
+	if id, ok := s.hookIDs["delete"]; ok {
+		s.App.OnModelAfterDelete("scheduled_scans").Remove(id)
+	}
+	s.hookIDs = make(map[string]string)
+	s.mutex.Unlock()
+
 	s.Cron.Stop()
 }
 
+// registerHooks keeps the cron entries in sync with the scheduled_scans
+// collection, whether records change through the API, the admin UI or the DAO
+func (s *ScanScheduler) registerHooks() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.hookIDs["create"] = s.App.OnModelAfterCreate("scheduled_scans").Add(func(e *core.ModelEvent) error {
+		if record, ok := e.Model.(*pbModels.Record); ok {
+			log.Printf("Scheduled scan %s created, adding cron entry", record.Id)
+			s.scheduleScan(recordToScheduledScan(record))
+		}
+		return nil
+	})
+
+	s.hookIDs["update"] = s.App.OnModelAfterUpdate("scheduled_scans").Add(func(e *core.ModelEvent) error {
+		if record, ok := e.Model.(*pbModels.Record); ok {
+			log.Printf("Scheduled scan %s updated, replacing cron entry", record.Id)
+			s.scheduleScan(recordToScheduledScan(record))
+		}
+		return nil
+	})
+
+	s.hookIDs["delete"] = s.App.OnModelAfterDelete("scheduled_scans").Add(func(e *core.ModelEvent) error {
+		log.Printf("Scheduled scan %s deleted, removing cron entry", e.Model.GetId())
+		s.unscheduleScan(e.Model.GetId())
+		return nil
+	})
+}
+
 func (s *ScanScheduler) scheduleExistingScans() {
 	log.Printf("Scheduling existing scans with ansible base path: %s", s.AnsibleBasePath)
 	// Fetch scheduled scans from the database
@@ -59,31 +123,77 @@ func (s *ScanScheduler) scheduleExistingScans() {
 	}
 }
 
+// scheduleScan adds the cron entry for a schedule, replacing any existing one
 func (s *ScanScheduler) scheduleScan(schedule models.ScheduledScan) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if entryID, ok := s.entries[schedule.ID]; ok {
+		s.Cron.Remove(entryID)
+		delete(s.entries, schedule.ID)
+	}
+
 	// Skip if end date is in the past
 	if !schedule.EndDate.IsZero() && schedule.EndDate.Before(time.Now()) {
 		log.Printf("Skipping expired schedule %s", schedule.ID)
 		return
 	}
 
-	// Generate cron expression based on schedule details
-	cronExpr := generateCronExpression(schedule)
-	if cronExpr == "" {
-		log.Printf("Invalid schedule configuration for %s", schedule.ID)
+	// Build the cron schedule based on schedule details
+	cronSchedule, err := buildSchedule(schedule)
+	if err != nil {
+		log.Printf("Invalid schedule configuration for %s: %v", schedule.ID, err)
 		return
 	}
 
-	log.Printf("Scheduling scan %s with cron expression: %s", schedule.ID, cronExpr)
-
-	entryID, err := s.Cron.AddFunc(cronExpr, func() {
+	entryID := s.Cron.Schedule(cronSchedule, cron.FuncJob(func() {
 		s.executeScan(schedule)
-	})
+	}))
+	s.entries[schedule.ID] = entryID
+	log.Printf("Successfully scheduled scan %s with entry ID %d, next run at %s", schedule.ID, entryID, cronSchedule.Next(time.Now()))
+}
+
+// unscheduleScan removes the cron entry of a schedule, if it has one
+func (s *ScanScheduler) unscheduleScan(scheduleID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
+	if entryID, ok := s.entries[scheduleID]; ok {
+		s.Cron.Remove(entryID)
+		delete(s.entries, scheduleID)
+		log.Printf("Removed cron entry %d for schedule %s", entryID, scheduleID)
+	}
+}
+
+// NextRuns returns the next n times a schedule will fire, taking its start
+// and end dates into account
+func (s *ScanScheduler) NextRuns(scheduleID string, n int) ([]time.Time, error) {
+	record, err := s.App.Dao().FindRecordById("scheduled_scans", scheduleID)
 	if err != nil {
-		log.Printf("Failed to schedule scan %s: %v", schedule.ID, err)
-	} else {
-		log.Printf("Successfully scheduled scan %s with entry ID %d", schedule.ID, entryID)
+		return nil, ErrScheduleNotFound
+	}
+	schedule := recordToScheduledScan(record)
+
+	cronSchedule, err := buildSchedule(schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule configuration: %v", err)
+	}
+
+	from := time.Now()
+	if schedule.StartDate.After(from) {
+		// Next is exclusive, so step back to include a fire time at the start date itself
+		from = schedule.StartDate.Add(-time.Second)
+	}
+
+	runs := make([]time.Time, 0, n)
+	for next := cronSchedule.Next(from); len(runs) < n && !next.IsZero(); next = cronSchedule.Next(next) {
+		if !schedule.EndDate.IsZero() && next.After(schedule.EndDate) {
+			break
+		}
+		runs = append(runs, next)
 	}
+
+	return runs, nil
 }
 
 func (s *ScanScheduler) executeScan(schedule models.ScheduledScan) {
@@ -96,6 +206,13 @@ func (s *ScanScheduler) executeScan(schedule models.ScheduledScan) {
 		return
 	}
 
+	// Check if the schedule has started yet
+	startDate := record.GetDateTime("start_date")
+	if !startDate.IsZero() && startDate.Time().After(time.Now()) {
+		log.Printf("Schedule %s has not started yet", schedule.ID)
+		return
+	}
+
 	// Check if end date has passed
 	endDate := record.GetDateTime("end_date")
 	if !endDate.IsZero() && endDate.Time().Before(time.Now()) {
@@ -103,156 +220,162 @@ func (s *ScanScheduler) executeScan(schedule models.ScheduledScan) {
 		return
 	}
 
-	// Fetch the scan record
-	scanRecord, err := s.App.Dao().FindRecordById("nuclei_scans", schedule.ScanID)
+	// Make sure the scan still exists; it is the template for every run
+	template, err := s.App.Dao().FindRecordById("nuclei_scans", schedule.ScanID)
 	if err != nil {
 		log.Printf("Failed to find scan %s: %v", schedule.ScanID, err)
 		return
 	}
 
-	// Update scan status to "Deploying"
-	scanRecord.Set("status", "Deploying")
-	scanRecord.Set("start_time", time.Now())
-	if err := s.App.Dao().SaveRecord(scanRecord); err != nil {
-		log.Printf("Failed to update scan status: %v", err)
+	// Don't start an occurrence while the previous one is still going
+	active, err := s.activeRun(schedule.ID)
+	if err != nil {
+		log.Printf("Failed to check previous runs of schedule %s: %v", schedule.ID, err)
+		return
+	}
+	if active != nil {
+		log.Printf("Skipping scheduled run of schedule %s: run %s is still %s", schedule.ID, active.Id, active.GetString("status"))
 		return
 	}
 
-	// Define paths using the scheduler's AnsibleBasePath
-	playbookPath := filepath.Join(s.AnsibleBasePath, "scans", schedule.ScanID, "deploy.yml")
-	logDir := filepath.Join(s.AnsibleBasePath, "scans", schedule.ScanID, "logs")
-	yamlFile := filepath.Join(s.AnsibleBasePath, "scans", schedule.ScanID, "scan.yaml")
-	inventoryPath := filepath.Join(s.AnsibleBasePath, "scans", schedule.ScanID, "inventory")
-
-	log.Printf("Using ansible base path: %s for scan %s", s.AnsibleBasePath, schedule.ScanID)
-	log.Printf("Playbook path: %s", playbookPath)
-	log.Printf("Log directory: %s", logDir)
-	log.Printf("YAML file: %s", yamlFile)
-	log.Printf("Inventory path: %s", inventoryPath)
-
-	// Execute Ansible playbook
-	if err := utils.ExecuteAnsiblePlaybook(
-		playbookPath,
-		logDir,
-		yamlFile,
-		inventoryPath,
-		s.AnsibleBasePath,
-		s.App,
-		schedule.ScanID,
-	); err != nil {
-		log.Printf("Failed to execute scan: %v", err)
-		scanRecord.Set("status", "Failed")
-		if err := s.App.Dao().SaveRecord(scanRecord); err != nil {
-			log.Printf("Failed to save scan record: %v", err)
-		}
+	// Apply the client's scan window policy; outside the allowed windows the
+	// occurrence is either skipped or shifted to the next allowed time
+	policy, err := services.LoadScanPolicy(s.App, template.GetString("client"))
+	if err != nil {
+		log.Printf("Failed to load scan policy for schedule %s: %v", schedule.ID, err)
 		return
 	}
 
-	// Update scan status to "Running"
-	scanRecord.Set("status", "Running")
-	if err := s.App.Dao().SaveRecord(scanRecord); err != nil {
-		log.Printf("Failed to save scan record: %v", err)
+	startAt := time.Now()
+	var notBefore time.Time
+	var decision services.PolicyDecision
+	if policy != nil {
+		decision = policy.Evaluate(startAt)
+		if !decision.Allowed {
+			if policy.ScheduledAction != services.PolicyScheduledShift || decision.NextAllowed.IsZero() {
+				log.Printf("Skipping scheduled run of schedule %s: %s", schedule.ID, decision.Reason)
+				s.recordPolicyDecision(template.Id, policy, services.PolicyDecisionSkipped, decision.Reason, decision.NextAllowed)
+				return
+			}
+			notBefore = decision.NextAllowed
+			startAt = notBefore
+		}
 	}
-}
 
-func generateCronExpression(schedule models.ScheduledScan) string {
-	if schedule.CronExpression != "" {
-		return schedule.CronExpression
+	// Scheduled runs have nobody to approve going over the monthly budget
+	if s.Budget != nil {
+		check, err := s.Budget.CheckScan(template, startAt)
+		if err != nil {
+			log.Printf("Failed to check the budget for schedule %s: %v", schedule.ID, err)
+		} else if !check.Allowed {
+			log.Printf("Skipping scheduled run of schedule %s: %s", schedule.ID, check.Reason())
+			s.Budget.NotifyBlocked(context.Background(), template, check)
+			return
+		}
 	}
 
-	details := schedule.ScheduleDetails
-	if details == nil {
-		return ""
+	// Each occurrence gets its own scan record so earlier runs keep their history
+	run, err := s.createRun(template, schedule.ID)
+	if err != nil {
+		log.Printf("Failed to create run for schedule %s: %v", schedule.ID, err)
+		return
 	}
 
-	switch details.Frequency {
-	case "daily":
-		// Run at midnight every day
-		return "0 0 * * *"
-	case "weekly":
-		if len(details.SelectedDays) == 0 {
-			return ""
+	if policy != nil {
+		if notBefore.IsZero() {
+			s.recordPolicyDecision(run.Id, policy, services.PolicyDecisionAllowed, decision.Reason, time.Time{})
+		} else {
+			log.Printf("Shifting run %s of schedule %s to %s: %s", run.Id, schedule.ID, notBefore.Format(time.RFC3339), decision.Reason)
+			s.recordPolicyDecision(run.Id, policy, services.PolicyDecisionShifted, decision.Reason, notBefore)
 		}
-		// Convert day names to cron day numbers
-		dayMap := map[string]string{
-			"sunday":    "0",
-			"monday":    "1",
-			"tuesday":   "2",
-			"wednesday": "3",
-			"thursday":  "4",
-			"friday":    "5",
-			"saturday":  "6",
-		}
-		days := make([]string, 0)
-		for _, day := range details.SelectedDays {
-			if cronDay, ok := dayMap[strings.ToLower(day)]; ok {
-				days = append(days, cronDay)
-			}
+	}
+
+	// Runs that can't start within the schedule's allowed window are dropped by the queue
+	var notAfter time.Time
+	if schedule.ScheduleDetails != nil && schedule.ScheduleDetails.AllowedDuration > 0 {
+		notAfter = startAt.Add(time.Duration(schedule.ScheduleDetails.AllowedDuration) * time.Minute)
+	}
+
+	// Hand the run over to the queue, which runs the generate, validate and deploy
+	// playbooks; lifecycle notifications are sent as its status changes
+	job, err := s.Queue.EnqueueAt(run.Id, services.ScanJobSourceScheduled, lifecycle.ActorScheduler, notBefore, notAfter)
+	if err != nil {
+		if errors.Is(err, services.ErrScanJobActive) {
+			log.Printf("Skipping scheduled run of scan %s: job %s is still active", run.Id, job.Id)
+			return
 		}
-		if len(days) == 0 {
-			return ""
+		log.Printf("Failed to enqueue scheduled scan %s: %v", run.Id, err)
+		if _, err := lifecycle.Transition(s.App, run.Id, lifecycle.StatusFailed, lifecycle.ActorScheduler, fmt.Sprintf("failed to enqueue: %v", err)); err != nil {
+			log.Printf("Failed to mark run %s as failed: %v", run.Id, err)
 		}
-		// Run at midnight on selected days
-		return "0 0 * * " + strings.Join(days, ",")
-	case "monthly":
-		if details.MonthlyType == "date" && details.MonthlyDate > 0 {
-			// Run at midnight on specific date of each month
-			return fmt.Sprintf("0 0 %d * *", details.MonthlyDate)
-		} else if details.MonthlyType == "day" && details.MonthlyDay != "" && details.MonthlyWeek != "" {
-			// Convert day name to number
-			dayMap := map[string]string{
-				"sunday":    "0",
-				"monday":    "1",
-				"tuesday":   "2",
-				"wednesday": "3",
-				"thursday":  "4",
-				"friday":    "5",
-				"saturday":  "6",
-			}
-			day := dayMap[strings.ToLower(details.MonthlyDay)]
-			if day == "" {
-				return ""
-			}
+		return
+	}
 
-			// Convert week to number
-			weekMap := map[string]string{
-				"first":  "1",
-				"second": "2",
-				"third":  "3",
-				"fourth": "4",
-				"last":   "L",
-			}
-			week := weekMap[strings.ToLower(details.MonthlyWeek)]
-			if week == "" {
-				return ""
-			}
+	log.Printf("Enqueued run %s of schedule %s as job %s", run.Id, schedule.ID, job.Id)
+}
 
-			// Run at midnight on the specified day of the specified week
-			if week == "L" {
-				return fmt.Sprintf("0 0 * * %sL", day)
-			}
-			return fmt.Sprintf("0 0 * * %s#%s", day, week)
-		}
+// createRun creates the scan record for one occurrence of a schedule
+func (s *ScanScheduler) createRun(template *pbModels.Record, scheduleID string) (*pbModels.Record, error) {
+	name := fmt.Sprintf("%s (%s)", template.GetString("name"), time.Now().Format("2006-01-02 15:04"))
+	run, err := services.NewScanRun(s.App, template, name)
+	if err != nil {
+		return nil, err
+	}
+	run.Set("scheduled_scan", scheduleID)
+
+	if err := s.App.Dao().SaveRecord(run); err != nil {
+		return nil, fmt.Errorf("failed to save scan run: %v", err)
+	}
+
+	if _, err := lifecycle.Transition(s.App, run.Id, lifecycle.StatusCreated, lifecycle.ActorScheduler, fmt.Sprintf("scheduled run of %s", scheduleID)); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// recordPolicyDecision logs a scan policy decision on a scan
+func (s *ScanScheduler) recordPolicyDecision(scanID string, policy *services.ScanPolicy, decision, reason string, nextAllowed time.Time) {
+	if err := services.RecordPolicyDecision(s.App, scanID, policy, decision, services.ScanJobSourceScheduled, reason, nextAllowed); err != nil {
+		log.Printf("Failed to record policy decision for scan %s: %v", scanID, err)
 	}
+}
 
-	return ""
+// activeRun returns a run of the schedule that hasn't finished yet, or nil if there is none
+func (s *ScanScheduler) activeRun(scheduleID string) (*pbModels.Record, error) {
+	runs, err := s.App.Dao().FindRecordsByFilter(
+		"nuclei_scans",
+		"scheduled_scan = {:schedule} && (status = {:created} || status = {:started} || status = {:generating} || status = {:deploying} || status = {:running} || status = {:stopping})",
+		"-created",
+		1,
+		0,
+		dbx.Params{
+			"schedule":   scheduleID,
+			"created":    lifecycle.StatusCreated,
+			"started":    lifecycle.StatusStarted,
+			"generating": lifecycle.StatusGenerating,
+			"deploying":  lifecycle.StatusDeploying,
+			"running":    lifecycle.StatusRunning,
+			"stopping":   lifecycle.StatusStopping,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, nil
+	}
+	return runs[0], nil
 }
 
 func recordToScheduledScan(record *pbModels.Record) models.ScheduledScan {
 	var scheduleDetails *models.ScheduleDetails
-	if details := record.Get("schedule_details"); details != nil {
-		// Try to convert the details to our struct
-		if detailsMap, ok := details.(map[string]interface{}); ok {
-			scheduleDetails = &models.ScheduleDetails{
-				Type:         getString(detailsMap["type"]),
-				Frequency:    getString(detailsMap["frequency"]),
-				SelectedDays: convertToStringSlice(detailsMap["selectedDays"]),
-				MonthlyType:  getString(detailsMap["monthlyType"]),
-				MonthlyDate:  getInt(detailsMap["monthlyDate"]),
-				MonthlyDay:   getString(detailsMap["monthlyDay"]),
-				MonthlyWeek:  getString(detailsMap["monthlyWeek"]),
-			}
-		}
+	var details models.ScheduleDetails
+	if err := record.UnmarshalJSONField("schedule_details", &details); err != nil {
+		log.Printf("Failed to parse schedule details of %s: %v", record.Id, err)
+	} else if details.Type != "" || details.Frequency != "" {
+		// Empty or null details leave the schedule to its cron expression
+		scheduleDetails = &details
 	}
 
 	startDate := record.GetDateTime("start_date")
@@ -271,49 +394,8 @@ func recordToScheduledScan(record *pbModels.Record) models.ScheduledScan {
 	}
 }
 
-// Helper functions for type conversion
-func convertToStringSlice(v interface{}) []string {
-	if v == nil {
-		return nil
-	}
-	if slice, ok := v.([]interface{}); ok {
-		result := make([]string, 0, len(slice))
-		for _, item := range slice {
-			if str, ok := item.(string); ok {
-				result = append(result, str)
-			}
-		}
-		return result
-	}
-	return nil
-}
-
-func getString(v interface{}) string {
-	if v == nil {
-		return ""
-	}
-	if str, ok := v.(string); ok {
-		return str
-	}
-	return ""
-}
-
-func getInt(v interface{}) int {
-	if v == nil {
-		return 0
-	}
-	switch n := v.(type) {
-	case int:
-		return n
-	case float64:
-		return int(n)
-	default:
-		return 0
-	}
-}
-
 // StartScheduler starts the scheduler for periodic tasks
-func StartScheduler(app *pocketbase.PocketBase) (*cron.Cron, error) {
+func StartScheduler(app *pocketbase.PocketBase, notificationService *notification.NotificationService) (*cron.Cron, error) {
 	c := cron.New()
 
 	// Add scheduled tasks
@@ -325,6 +407,18 @@ func StartScheduler(app *pocketbase.PocketBase) (*cron.Cron, error) {
 		return nil, err
 	}
 
+	// Notify findings past their SLA due date once a day
+	if _, err := c.AddFunc("@daily", func() {
+		notified, err := services.NotifyOverdueFindings(app, notificationService, time.Now())
+		if err != nil {
+			log.Printf("Error notifying overdue findings: %v", err)
+			return
+		}
+		log.Printf("Notified %d overdue findings", notified)
+	}); err != nil {
+		return nil, err
+	}
+
 	c.Start()
 	return c, nil
 }
@@ -0,0 +1,496 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+	"bitor/scan/utils"
+	"bitor/services/notification"
+)
+
+// Scopes a monthly budget applies to
+const (
+	BudgetScopeGlobal   = "global"
+	BudgetScopeProvider = "provider"
+	BudgetScopeClient   = "client"
+)
+
+// defaultBudgetThresholds are the percentages of a budget that are notified
+// when system_settings.budget_alert_thresholds is empty
+var defaultBudgetThresholds = []float64{50, 80, 100}
+
+// BudgetStatus is the spending of one budget scope in the current month
+type BudgetStatus struct {
+	Scope     string  `json:"scope"`
+	ScopeID   string  `json:"scope_id"`
+	Name      string  `json:"name"`
+	Budget    float64 `json:"budget"`    // Zero when the scope has no budget
+	Spent     float64 `json:"spent"`     // Recorded cost of the month's scans
+	Projected float64 `json:"projected"` // Expected remaining cost of running and queued scans
+	Total     float64 `json:"total"`
+	Percent   float64 `json:"percent"`
+}
+
+// BudgetReport is the spending of every budget scope in a month
+type BudgetReport struct {
+	Month      string         `json:"month"`
+	Thresholds []float64      `json:"thresholds"`
+	Global     BudgetStatus   `json:"global"`
+	Providers  []BudgetStatus `json:"providers"`
+	Clients    []BudgetStatus `json:"clients"`
+}
+
+// BudgetCheck is whether a scan fits in the budgets it is charged to
+type BudgetCheck struct {
+	Allowed  bool           `json:"allowed"`
+	Estimate *ScanEstimate  `json:"estimate"`
+	Exceeded []BudgetStatus `json:"exceeded"`
+}
+
+// Reason describes the budgets a scan would exceed
+func (c *BudgetCheck) Reason() string {
+	parts := make([]string, 0, len(c.Exceeded))
+	for _, status := range c.Exceeded {
+		parts = append(parts, fmt.Sprintf("%s budget of $%.2f (%.2f spent or projected)", status.Name, status.Budget, status.Total))
+	}
+	return fmt.Sprintf("estimated cost of $%.2f exceeds the %s", c.Estimate.Cost, strings.Join(parts, ", "))
+}
+
+// BudgetService keeps cloud spending within the monthly budgets set on the
+// system settings, providers and clients
+type BudgetService struct {
+	app                 *pocketbase.PocketBase
+	notificationService *notification.NotificationService
+	logger              *log.Logger
+	alertMutex          sync.Mutex
+}
+
+// NewBudgetService creates a new budget service
+func NewBudgetService(app *pocketbase.PocketBase, notificationService *notification.NotificationService) *BudgetService {
+	return &BudgetService{
+		app:                 app,
+		notificationService: notificationService,
+		logger:              log.New(log.Writer(), "[BudgetService] ", log.LstdFlags),
+	}
+}
+
+// RegisterHooks checks the budget thresholds whenever a scan starts running
+// or ends, which is when its projected or final cost changes
+func (b *BudgetService) RegisterHooks() {
+	lifecycle.OnTransition().Add(func(e *lifecycle.TransitionEvent) error {
+		if e.Scan.GetString("shard_of") != "" {
+			return nil
+		}
+
+		switch e.To {
+		case lifecycle.StatusRunning, lifecycle.StatusFinished, lifecycle.StatusFailed, lifecycle.StatusStopped, lifecycle.StatusTimedOut:
+			go b.CheckThresholds(context.Background())
+		}
+		return nil
+	})
+}
+
+// Report returns the spending of the month containing now, including the
+// expected cost of the scans queued to start in that month
+func (b *BudgetService) Report(now time.Time) (*BudgetReport, error) {
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthEnd := monthStart.AddDate(0, 1, 0)
+
+	settings, err := b.app.Dao().FindFirstRecordByFilter("system_settings", "id != ''")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get system settings: %v", err)
+	}
+
+	report := &BudgetReport{
+		Month:      monthStart.Format("2006-01"),
+		Thresholds: budgetThresholds(settings),
+		Global: BudgetStatus{
+			Scope:  BudgetScopeGlobal,
+			Name:   "Global",
+			Budget: settings.GetFloat("max_cost_per_month"),
+		},
+	}
+
+	// start_time is stored as RFC3339 with the server's offset, which doesn't
+	// compare as text with a UTC date. The query keeps a day of margin on the
+	// date alone, which both layouts start with, and the parsed times decide.
+	scans, err := b.app.Dao().FindRecordsByFilter(
+		"nuclei_scans",
+		"shard_of = '' && start_time >= {:since}",
+		"",
+		0,
+		0,
+		dbx.Params{"since": monthStart.AddDate(0, 0, -1).Format("2006-01-02")},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find this month's scans: %v", err)
+	}
+
+	providers := make(map[string]*BudgetStatus)
+	clients := make(map[string]*BudgetStatus)
+	charge := func(scan *models.Record, spent, projected float64) {
+		addSpending(&report.Global, spent, projected)
+		if providerID := scan.GetString("vm_provider"); providerID != "" {
+			if _, ok := providers[providerID]; !ok {
+				providers[providerID] = &BudgetStatus{Scope: BudgetScopeProvider, ScopeID: providerID}
+			}
+			addSpending(providers[providerID], spent, projected)
+		}
+		if clientID := scan.GetString("client"); clientID != "" {
+			if _, ok := clients[clientID]; !ok {
+				clients[clientID] = &BudgetStatus{Scope: BudgetScopeClient, ScopeID: clientID}
+			}
+			addSpending(clients[clientID], spent, projected)
+		}
+	}
+
+	for _, scan := range scans {
+		if startTime := scan.GetDateTime("start_time"); startTime.IsZero() || startTime.Time().Before(monthStart) || !startTime.Time().Before(monthEnd) {
+			continue
+		}
+
+		spent := scan.GetFloat("cost")
+		projected := 0.0
+		if lifecycle.IsActive(scan.GetString("status")) {
+			if expected := b.expectedScanCost(scan, scan.GetInt("target_count")); expected > spent {
+				projected = expected - spent
+			}
+		}
+		if spent == 0 && projected == 0 {
+			continue
+		}
+		charge(scan, spent, projected)
+	}
+
+	// Queued and deferred scans haven't started yet, they are charged in full
+	// to the month they are expected to start in
+	if err := b.projectQueuedScans(monthStart, monthEnd, charge); err != nil {
+		return nil, err
+	}
+
+	// Scopes with a budget are reported even before anything was spent
+	report.Providers, err = b.scopeStatuses("providers", BudgetScopeProvider, providers)
+	if err != nil {
+		return nil, err
+	}
+	report.Clients, err = b.scopeStatuses("clients", BudgetScopeClient, clients)
+	if err != nil {
+		return nil, err
+	}
+	setPercent(&report.Global)
+
+	return report, nil
+}
+
+// projectQueuedScans charges the expected cost of every scan with a queued
+// job that starts between monthStart and monthEnd. A job that may start
+// right away is expected to start now.
+func (b *BudgetService) projectQueuedScans(monthStart, monthEnd time.Time, charge func(scan *models.Record, spent, projected float64)) error {
+	jobs, err := b.app.Dao().FindRecordsByFilter(
+		"scan_jobs",
+		"status = {:queued}",
+		"",
+		0,
+		0,
+		dbx.Params{"queued": ScanJobQueued},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to find queued scan jobs: %v", err)
+	}
+
+	now := time.Now()
+	for _, job := range jobs {
+		startAt := now
+		if notBefore := job.GetDateTime("not_before"); !notBefore.IsZero() && notBefore.Time().After(now) {
+			startAt = notBefore.Time()
+		}
+		if startAt.Before(monthStart) || !startAt.Before(monthEnd) {
+			continue
+		}
+
+		scan, err := b.app.Dao().FindRecordById("nuclei_scans", job.GetString("scan"))
+		if err != nil {
+			continue
+		}
+		// Targets are only counted on the scan once it is generated
+		targets := scan.GetInt("target_count")
+		if targets == 0 {
+			targets = b.countTargets(scan.Id)
+		}
+		if expected := b.expectedScanCost(scan, targets); expected > 0 {
+			charge(scan, 0, expected)
+		}
+	}
+	return nil
+}
+
+// scopeStatuses fills in the names and budgets of the providers or clients
+// that spent something, adding those that have a budget but spent nothing
+func (b *BudgetService) scopeStatuses(collection, scope string, spending map[string]*BudgetStatus) ([]BudgetStatus, error) {
+	budgeted, err := b.app.Dao().FindRecordsByFilter(collection, "max_cost_per_month > 0", "", 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s with a budget: %v", collection, err)
+	}
+	for _, record := range budgeted {
+		if _, ok := spending[record.Id]; !ok {
+			spending[record.Id] = &BudgetStatus{Scope: scope, ScopeID: record.Id}
+		}
+	}
+
+	statuses := make([]BudgetStatus, 0, len(spending))
+	for id, status := range spending {
+		if record, err := b.app.Dao().FindRecordById(collection, id); err == nil {
+			status.Name = record.GetString("name")
+			status.Budget = record.GetFloat("max_cost_per_month")
+		} else {
+			status.Name = id
+		}
+		setPercent(status)
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Total > statuses[j].Total
+	})
+	return statuses, nil
+}
+
+// CheckScan reports whether starting a scan at startAt would take any of the
+// budgets of that month over their limit
+func (b *BudgetService) CheckScan(scan *models.Record, startAt time.Time) (*BudgetCheck, error) {
+	scanProfile, err := b.app.Dao().FindRecordById("scan_profiles", scan.GetString("scan_profile"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scan profile: %v", err)
+	}
+
+	estimate, err := EstimateScan(b.app, scan, scanProfile, b.countTargets(scan.Id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate scan cost: %v", err)
+	}
+
+	check := &BudgetCheck{Allowed: true, Estimate: estimate, Exceeded: []BudgetStatus{}}
+	if estimate.Cost == 0 {
+		return check, nil
+	}
+
+	report, err := b.Report(startAt)
+	if err != nil {
+		return nil, err
+	}
+
+	charged := []BudgetStatus{report.Global}
+	charged = append(charged, findBudgetStatus(report.Providers, estimate.ProviderID)...)
+	charged = append(charged, findBudgetStatus(report.Clients, scan.GetString("client"))...)
+	for _, status := range charged {
+		if status.Budget > 0 && status.Total+estimate.Cost > status.Budget {
+			check.Allowed = false
+			check.Exceeded = append(check.Exceeded, status)
+		}
+	}
+
+	return check, nil
+}
+
+// countTargets returns how many targets a scan would be run against
+func (b *BudgetService) countTargets(scanID string) int {
+	file, err := os.CreateTemp("", "budget-targets-*.json")
+	if err != nil {
+		return 0
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	if err := utils.GenerateTargetsJSON(b.app, scanID, file.Name()); err != nil {
+		b.logger.Printf("Failed to count targets of scan %s: %v", scanID, err)
+		return 0
+	}
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return 0
+	}
+	var targets []string
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return 0
+	}
+	return len(targets)
+}
+
+// expectedScanCost returns the estimated total cost of running a scan
+// against the given number of targets
+func (b *BudgetService) expectedScanCost(scan *models.Record, targets int) float64 {
+	scanProfile, err := b.app.Dao().FindRecordById("scan_profiles", scan.GetString("scan_profile"))
+	if err != nil {
+		return 0
+	}
+	estimate, err := EstimateScan(b.app, scan, scanProfile, targets)
+	if err != nil {
+		return 0
+	}
+	return estimate.Cost
+}
+
+// CheckThresholds notifies every budget that crossed one of the alert
+// thresholds this month. Each threshold is notified once per month.
+func (b *BudgetService) CheckThresholds(ctx context.Context) {
+	b.alertMutex.Lock()
+	defer b.alertMutex.Unlock()
+
+	report, err := b.Report(time.Now())
+	if err != nil {
+		b.logger.Printf("Failed to compute budget report: %v", err)
+		return
+	}
+
+	statuses := append([]BudgetStatus{report.Global}, report.Providers...)
+	statuses = append(statuses, report.Clients...)
+	for _, status := range statuses {
+		if status.Budget <= 0 {
+			continue
+		}
+
+		// Only the highest newly crossed threshold is notified
+		crossed := 0.0
+		for _, threshold := range report.Thresholds {
+			if status.Percent < threshold {
+				continue
+			}
+			created, err := b.recordAlert(report.Month, status, threshold)
+			if err != nil {
+				b.logger.Printf("Failed to record budget alert for %s %s: %v", status.Scope, status.Name, err)
+				continue
+			}
+			if created && threshold > crossed {
+				crossed = threshold
+			}
+		}
+		if crossed > 0 {
+			b.notify(ctx, report.Month, status, crossed)
+		}
+	}
+}
+
+// recordAlert saves that a threshold was crossed and reports whether it was
+// the first time this month
+func (b *BudgetService) recordAlert(month string, status BudgetStatus, threshold float64) (bool, error) {
+	existing, err := b.app.Dao().FindRecordsByFilter(
+		"budget_alerts",
+		"scope = {:scope} && scope_id = {:scope_id} && month = {:month} && threshold = {:threshold}",
+		"",
+		1,
+		0,
+		dbx.Params{
+			"scope":     status.Scope,
+			"scope_id":  status.ScopeID,
+			"month":     month,
+			"threshold": threshold,
+		},
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to find budget alerts: %v", err)
+	}
+	if len(existing) > 0 {
+		return false, nil
+	}
+
+	collection, err := b.app.Dao().FindCollectionByNameOrId("budget_alerts")
+	if err != nil {
+		return false, fmt.Errorf("failed to find budget_alerts collection: %v", err)
+	}
+	record := models.NewRecord(collection)
+	record.Set("scope", status.Scope)
+	record.Set("scope_id", status.ScopeID)
+	record.Set("month", month)
+	record.Set("threshold", threshold)
+	record.Set("spent", status.Total)
+	record.Set("budget", status.Budget)
+	if err := b.app.Dao().SaveRecord(record); err != nil {
+		return false, fmt.Errorf("failed to save budget alert: %v", err)
+	}
+	return true, nil
+}
+
+// notify sends a budget threshold notification
+func (b *BudgetService) notify(ctx context.Context, month string, status BudgetStatus, threshold float64) {
+	b.logger.Printf("%s budget crossed %.0f%%: $%.2f of $%.2f", status.Name, threshold, status.Total, status.Budget)
+	if b.notificationService == nil {
+		return
+	}
+
+	subject := fmt.Sprintf("Budget Alert: %s at %.0f%%", status.Name, status.Percent)
+	message := fmt.Sprintf("Cloud spending for %s (%s budget) in %s is $%.2f of the $%.2f monthly budget (%.0f%%), including $%.2f projected for running scans.",
+		status.Name,
+		status.Scope,
+		month,
+		status.Total,
+		status.Budget,
+		status.Percent,
+		status.Projected,
+	)
+	if err := b.notificationService.Notify(ctx, subject, message); err != nil {
+		b.logger.Printf("Failed to send budget notification: %v", err)
+	}
+}
+
+// NotifyBlocked reports a scan that was not started because of the budget
+func (b *BudgetService) NotifyBlocked(ctx context.Context, scan *models.Record, check *BudgetCheck) {
+	b.logger.Printf("Blocked scan %s: %s", scan.Id, check.Reason())
+	if b.notificationService == nil {
+		return
+	}
+
+	subject := fmt.Sprintf("Scan Blocked by Budget: %s", scan.GetString("name"))
+	message := fmt.Sprintf("The scan %s (ID: %s) was not started: %s",
+		scan.GetString("name"),
+		scan.Id,
+		check.Reason(),
+	)
+	if err := b.notificationService.Notify(ctx, subject, message); err != nil {
+		b.logger.Printf("Failed to send budget notification: %v", err)
+	}
+}
+
+// budgetThresholds returns the alert thresholds from the system settings
+func budgetThresholds(settings *models.Record) []float64 {
+	var thresholds []float64
+	if err := unmarshalOptionalJSON(settings, "budget_alert_thresholds", &thresholds); err != nil {
+		log.Printf("[BudgetService] Ignoring invalid budget alert thresholds: %v", err)
+	}
+	if len(thresholds) == 0 {
+		return defaultBudgetThresholds
+	}
+	sort.Float64s(thresholds)
+	return thresholds
+}
+
+func addSpending(status *BudgetStatus, spent, projected float64) {
+	status.Spent += spent
+	status.Projected += projected
+	status.Total += spent + projected
+}
+
+func setPercent(status *BudgetStatus) {
+	if status.Budget > 0 {
+		status.Percent = status.Total / status.Budget * 100
+	}
+}
+
+// findBudgetStatus returns the status of a scope as a slice of at most one
+func findBudgetStatus(statuses []BudgetStatus, scopeID string) []BudgetStatus {
+	for _, status := range statuses {
+		if scopeID != "" && status.ScopeID == scopeID {
+			return []BudgetStatus{status}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"bitor/models"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	pbModels "github.com/pocketbase/pocketbase/models"
+)
+
+// findingLookupSize bounds the number of hashes looked up in one query
+const findingLookupSize = 500
+
+// FindingBatchResult is the outcome of persisting a batch of findings
+type FindingBatchResult struct {
+	// New holds the findings that weren't in the database yet
+	New []*models.Finding
+	// Duplicates counts the findings that already existed, including repeats within the batch
+	Duplicates int
+	// Reopened holds the fixed findings that showed up again and were reopened
+	Reopened []*models.Finding
+}
+
+// ProcessFindings persists a batch of findings in a single transaction. It
+// does what ProcessFinding does for each finding, but looks up existing
+// hashes in bulk and updates the rollup of each scan once. Either the whole
+// batch is saved, including its rollups, or nothing is. Fixed findings that
+// show up again are reopened as regressions, and new findings get the due
+// date of their client's SLA policy.
+func (fm *FindingManager) ProcessFindings(findings []*models.Finding) (*FindingBatchResult, error) {
+	result := &FindingBatchResult{}
+	if len(findings) == 0 {
+		return result, nil
+	}
+
+	deltas := make(map[string]*findingRollupDelta)
+	deltaOf := func(scanID string) *findingRollupDelta {
+		delta, exists := deltas[scanID]
+		if !exists {
+			delta = &findingRollupDelta{Severities: make(map[string]int)}
+			deltas[scanID] = delta
+		}
+		return delta
+	}
+
+	err := fm.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		collection, err := txDao.FindCollectionByNameOrId("nuclei_findings")
+		if err != nil {
+			return fmt.Errorf("failed to find nuclei_findings collection: %v", err)
+		}
+
+		// Group the hashes by client, since findings are deduplicated per client
+		hashes := make(map[string][]string)
+		for _, finding := range findings {
+			hashes[finding.ClientID] = append(hashes[finding.ClientID], finding.GenerateHash())
+		}
+
+		existing := make(map[string]*pbModels.Record)
+		for clientID, clientHashes := range hashes {
+			records, err := findRecordsByHash(txDao, clientID, clientHashes)
+			if err != nil {
+				return err
+			}
+			for hash, record := range records {
+				existing[clientID+"|"+hash] = record
+			}
+		}
+
+		// Records whose scan_ids changed, saved once each
+		updated := make(map[string]*pbModels.Record)
+
+		// SLA policy of each client, for the due dates of new findings
+		policies := make(map[string]SLAPolicy)
+
+		for _, finding := range findings {
+			hash := finding.GenerateHash()
+			key := finding.ClientID + "|" + hash
+			delta := deltaOf(finding.ScanID)
+
+			if record, exists := existing[key]; exists {
+				// The rollup counts a finding once per scan, like CountScanFindings
+				if addScanID(record, finding.ScanID) {
+					updated[record.Id] = record
+					delta.Duplicates++
+				}
+				result.Duplicates++
+
+				if isResolvedStatus(record.GetString("status")) {
+					if err := reopenFinding(txDao, record, finding.ScanID); err != nil {
+						return fmt.Errorf("failed to reopen finding %s: %v", record.Id, err)
+					}
+					delete(updated, record.Id)
+					result.Reopened = append(result.Reopened, finding)
+				}
+				continue
+			}
+
+			record := pbModels.NewRecord(collection)
+			for field, value := range finding.ToMap() {
+				record.Set(field, value)
+			}
+			if finding.CreatedBy != "" {
+				record.Set("created_by", finding.CreatedBy)
+			}
+
+			policy, exists := policies[finding.ClientID]
+			if !exists {
+				if policy, err = LoadSLAPolicy(txDao, finding.ClientID); err != nil {
+					return err
+				}
+				policies[finding.ClientID] = policy
+			}
+			setDueAt(record, policy)
+
+			scanIDsJSON, err := json.Marshal([]string{finding.ScanID})
+			if err == nil {
+				record.Set("scan_ids", string(scanIDsJSON))
+			}
+
+			if err := txDao.SaveRecord(record); err != nil {
+				return fmt.Errorf("failed to save nuclei_findings record: %v", err)
+			}
+			existing[key] = record
+
+			delta.New++
+			delta.Severities[strings.ToLower(finding.Severity)]++
+			result.New = append(result.New, finding)
+		}
+
+		for _, record := range updated {
+			if err := txDao.SaveRecord(record); err != nil {
+				return fmt.Errorf("failed to update scan_ids of finding %s: %v", record.Id, err)
+			}
+		}
+
+		for scanID, delta := range deltas {
+			if err := applyRollupDelta(txDao, scanID, delta); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fm.logger.Printf("Processed batch of %d findings: %d new, %d duplicates, %d reopened", len(findings), len(result.New), result.Duplicates, len(result.Reopened))
+	return result, nil
+}
+
+// findRecordsByHash returns the findings of a client with one of the given hashes, keyed by hash
+func findRecordsByHash(dao *daos.Dao, clientID string, hashes []string) (map[string]*pbModels.Record, error) {
+	records := make(map[string]*pbModels.Record, len(hashes))
+
+	for start := 0; start < len(hashes); start += findingLookupSize {
+		end := start + findingLookupSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+
+		values := make([]interface{}, 0, end-start)
+		for _, hash := range hashes[start:end] {
+			values = append(values, hash)
+		}
+
+		found, err := dao.FindRecordsByExpr("nuclei_findings", dbx.HashExp{
+			"client": clientID,
+			"hash":   values,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query nuclei_findings: %v", err)
+		}
+		for _, record := range found {
+			if _, exists := records[record.GetString("hash")]; !exists {
+				records[record.GetString("hash")] = record
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// addScanID adds a scan to the scan_ids of a finding and reports whether it changed
+func addScanID(record *pbModels.Record, scanID string) bool {
+	var scanIDs []string
+	if scanIDsStr := record.GetString("scan_ids"); scanIDsStr != "" {
+		if err := json.Unmarshal([]byte(scanIDsStr), &scanIDs); err != nil {
+			scanIDs = []string{}
+		}
+	}
+	if contains(scanIDs, scanID) {
+		return false
+	}
+
+	scanIDsJSON, err := json.Marshal(append(scanIDs, scanID))
+	if err != nil {
+		return false
+	}
+	record.Set("scan_ids", string(scanIDsJSON))
+	return true
+}
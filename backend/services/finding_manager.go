@@ -24,14 +24,6 @@ type FindingManager struct {
 	logger              *log.Logger
 }
 
-// ScanDuplicateTracker tracks duplicates for each scan
-type ScanDuplicateTracker struct {
-	TotalNew  int
-	TotalDups int
-}
-
-var scanTrackers = make(map[string]*ScanDuplicateTracker)
-
 // NewFindingManager creates a new instance of FindingManager
 func NewFindingManager(app *pocketbase.PocketBase, notificationService *notification.NotificationService) *FindingManager {
 	return &FindingManager{
@@ -43,110 +35,13 @@ func NewFindingManager(app *pocketbase.PocketBase, notificationService *notifica
 
 // ProcessFinding processes a new finding, checking for duplicates and updating rollups
 func (fm *FindingManager) ProcessFinding(finding *models.Finding) (bool, error) {
-	// Generate hash for the finding
-	hash := finding.GenerateHash()
-
-	fm.logger.Printf("Processing finding - Name: %s, Hash: %s, Client: %s", finding.Name, hash, finding.ClientID)
-	fm.logger.Printf("Finding details - Severity: %s, Host: %s, Type: %s, TemplateID: %s",
-		finding.Severity, finding.Host, finding.Type, finding.TemplateID)
-
-	// Check if finding exists in nuclei_findings
-	existingResult, err := fm.app.Dao().FindFirstRecordByFilter(
-		"nuclei_findings",
-		"(hash = {:hash} && client = {:client} && hash != '' && hash != 'null' && hash != null)",
-		dbx.Params{
-			"hash":   hash,
-			"client": finding.ClientID,
-		},
-	)
-
-	// Only treat as error if it's not a "no rows" error
-	if err != nil && err.Error() != "sql: no rows in result set" {
-		return false, fmt.Errorf("failed to query nuclei_findings: %v", err)
-	}
-
-	// If finding exists, update it and return
-	if existingResult != nil {
-		fm.logger.Printf("Found duplicate finding with hash %s", hash)
-
-		// Get existing scan_ids
-		var scanIDs []string
-		scanIDsStr := existingResult.GetString("scan_ids")
-		if scanIDsStr != "" {
-			if err := json.Unmarshal([]byte(scanIDsStr), &scanIDs); err != nil {
-				fm.logger.Printf("Error unmarshaling scan_ids: %v", err)
-				scanIDs = []string{}
-			}
-		}
-
-		// Add new scan_id if it doesn't exist
-		scanIDExists := false
-		for _, id := range scanIDs {
-			if id == finding.ScanID {
-				scanIDExists = true
-				break
-			}
-		}
-
-		if !scanIDExists {
-			scanIDs = append(scanIDs, finding.ScanID)
-			scanIDsJSON, err := json.Marshal(scanIDs)
-			if err != nil {
-				fm.logger.Printf("Error marshaling scan_ids: %v", err)
-			} else {
-				existingResult.Set("scan_ids", string(scanIDsJSON))
-				if err := fm.app.Dao().SaveRecord(existingResult); err != nil {
-					fm.logger.Printf("Error updating finding record: %v", err)
-				}
-			}
-		}
-
-		if err := fm.updateRollup(finding, true); err != nil {
-			fm.logger.Printf("Error updating rollup for duplicate finding: %v", err)
-		}
+	fm.logger.Printf("Processing finding - Name: %s, Hash: %s, Client: %s", finding.Name, finding.GenerateHash(), finding.ClientID)
 
-		return true, nil
-	}
-
-	// Create new record
-	resultsCollection, err := fm.app.Dao().FindCollectionByNameOrId("nuclei_findings")
+	result, err := fm.ProcessFindings([]*models.Finding{finding})
 	if err != nil {
-		return false, fmt.Errorf("failed to find nuclei_findings collection: %v", err)
+		return false, err
 	}
-
-	resultRecord := pbModels.NewRecord(resultsCollection)
-
-	// Convert finding to map and set all fields
-	data := finding.ToMap()
-	for key, value := range data {
-		resultRecord.Set(key, value)
-	}
-
-	// Set created_by field if available
-	if finding.CreatedBy != "" {
-		resultRecord.Set("created_by", finding.CreatedBy)
-	}
-
-	// Initialize scan_ids array with the current scan
-	scanIDsJSON, err := json.Marshal([]string{finding.ScanID})
-	if err == nil {
-		resultRecord.Set("scan_ids", string(scanIDsJSON))
-	}
-
-	// Save the record
-	if err := fm.app.Dao().SaveRecord(resultRecord); err != nil {
-		fm.logger.Printf("[ERROR] Failed to save nuclei_findings record: %v", err)
-		return false, fmt.Errorf("failed to save nuclei_findings record: %v", err)
-	}
-
-	fm.logger.Printf("[DEBUG] Saved nuclei_findings record with ID %s and hash %s", resultRecord.Id, hash)
-
-	// Update rollup for new finding
-	if err := fm.updateRollup(finding, false); err != nil {
-		fm.logger.Printf("Error updating rollup for new finding: %v", err)
-	}
-
-	return false, nil
+	return len(result.New) == 0, nil
 }
 
 // contains checks if a string slice contains a specific string
@@ -164,151 +59,6 @@ func (fm *FindingManager) generateFindingHash(finding *models.Finding) (string,
 	return finding.GenerateHash(), nil
 }
 
-// updateRollup updates the finding rollup for a scan
-func (fm *FindingManager) updateRollup(finding *models.Finding, isDuplicate bool) error {
-	fm.logger.Printf("Updating rollup for finding - Name: %s, IsDuplicate: %v", finding.Name, isDuplicate)
-
-	// Get or create tracker for this scan
-	tracker, exists := scanTrackers[finding.ScanID]
-	if !exists {
-		tracker = &ScanDuplicateTracker{
-			TotalNew:  0,
-			TotalDups: 0,
-		}
-		scanTrackers[finding.ScanID] = tracker
-	}
-
-	// Get existing rollup or create new one
-	rollup, err := fm.app.Dao().FindFirstRecordByFilter(
-		"nuclei_findings_rollups",
-		"scan_id = {:scan_id}",
-		dbx.Params{
-			"scan_id": finding.ScanID,
-		},
-	)
-
-	// Log current state if rollup exists
-	if err == nil && rollup != nil {
-		fm.logger.Printf("Current rollup state for scan %s:", finding.ScanID)
-		fm.logger.Printf("- New findings: %d", tracker.TotalNew)
-		fm.logger.Printf("- Duplicate findings: %d", tracker.TotalDups)
-		fm.logger.Printf("- Critical: %d, High: %d, Medium: %d, Low: %d, Info: %d",
-			rollup.GetInt("critical_count"),
-			rollup.GetInt("high_count"),
-			rollup.GetInt("medium_count"),
-			rollup.GetInt("low_count"),
-			rollup.GetInt("info_count"))
-	}
-
-	// If no rollup exists, create a new one
-	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			fm.logger.Printf("No existing rollup found for scan %s - creating new rollup", finding.ScanID)
-			collection, err := fm.app.Dao().FindCollectionByNameOrId("nuclei_findings_rollups")
-			if err != nil {
-				return fmt.Errorf("failed to get nuclei_findings_rollups collection: %v", err)
-			}
-
-			rollup = pbModels.NewRecord(collection)
-			rollup.Set("scan_id", finding.ScanID)
-			rollup.Set("critical_count", 0)
-			rollup.Set("high_count", 0)
-			rollup.Set("medium_count", 0)
-			rollup.Set("low_count", 0)
-			rollup.Set("info_count", 0)
-			rollup.Set("new_findings_count", 0)
-			rollup.Set("duplicate_findings_count", 0)
-			rollup.Set("notification_sent", false)
-		} else {
-			return fmt.Errorf("failed to get rollup: %v", err)
-		}
-	}
-
-	if rollup == nil {
-		// Create new record with default values
-		collection, err := fm.app.Dao().FindCollectionByNameOrId("nuclei_findings_rollups")
-		if err != nil {
-			return fmt.Errorf("failed to find nuclei_findings_rollups collection: %v", err)
-		}
-
-		rollup = pbModels.NewRecord(collection)
-		rollup.Set("scan_id", finding.ScanID)
-		rollup.Set("critical_count", 0)
-		rollup.Set("high_count", 0)
-		rollup.Set("medium_count", 0)
-		rollup.Set("low_count", 0)
-		rollup.Set("info_count", 0)
-		rollup.Set("new_findings_count", 0)
-		rollup.Set("duplicate_findings_count", 0)
-		rollup.Set("notification_sent", false)
-	}
-
-	if isDuplicate {
-		// Simply increment the duplicate count for every duplicate finding
-		tracker.TotalDups++
-		rollup.Set("duplicate_findings_count", tracker.TotalDups)
-		fm.logger.Printf("Incrementing duplicate findings count to %d", tracker.TotalDups)
-	} else {
-		tracker.TotalNew++
-		rollup.Set("new_findings_count", tracker.TotalNew)
-		fm.logger.Printf("Incrementing new findings count to %d", tracker.TotalNew)
-
-		severity := strings.ToLower(finding.Severity)
-		currentSeverityCount := 0
-		severityField := ""
-
-		switch severity {
-		case "critical":
-			severityField = "critical_count"
-			currentSeverityCount = rollup.GetInt("critical_count")
-		case "high":
-			severityField = "high_count"
-			currentSeverityCount = rollup.GetInt("high_count")
-		case "medium":
-			severityField = "medium_count"
-			currentSeverityCount = rollup.GetInt("medium_count")
-		case "low":
-			severityField = "low_count"
-			currentSeverityCount = rollup.GetInt("low_count")
-		case "info":
-			severityField = "info_count"
-			currentSeverityCount = rollup.GetInt("info_count")
-		default:
-			fm.logger.Printf("Warning: Unknown severity level: %s", severity)
-		}
-
-		if severityField != "" {
-			rollup.Set(severityField, currentSeverityCount+1)
-			fm.logger.Printf("Incrementing %s to %d", severityField, currentSeverityCount+1)
-		}
-	}
-
-	// Save the rollup
-	if err := fm.app.Dao().SaveRecord(rollup); err != nil {
-		fm.logger.Printf("Error saving rollup: %v", err)
-		return fmt.Errorf("failed to save rollup: %v", err)
-	}
-
-	// Log final state
-	fm.logger.Printf("Final rollup state after update:")
-	fm.logger.Printf("- New findings: %d", tracker.TotalNew)
-	fm.logger.Printf("- Duplicate findings: %d", tracker.TotalDups)
-	fm.logger.Printf("- Critical: %d, High: %d, Medium: %d, Low: %d, Info: %d",
-		rollup.GetInt("critical_count"),
-		rollup.GetInt("high_count"),
-		rollup.GetInt("medium_count"),
-		rollup.GetInt("low_count"),
-		rollup.GetInt("info_count"))
-
-	return nil
-}
-
-// CleanupScanTracker removes the tracker for a completed scan
-func (fm *FindingManager) CleanupScanTracker(scanID string) {
-	delete(scanTrackers, scanID)
-	fm.logger.Printf("Cleaned up tracker for scan %s", scanID)
-}
-
 // GetRollupSummary gets the finding summary for a scan
 func (fm *FindingManager) GetRollupSummary(scanID string) (map[string]int, error) {
 	record, err := fm.app.Dao().FindFirstRecordByFilter(
@@ -424,18 +174,33 @@ func (fm *FindingManager) MarkRollupNotificationSent(scanID string) error {
 // HandleFinding processes a finding and sends notifications if needed
 func (fm *FindingManager) HandleFinding(ctx context.Context, finding *models.Finding) error {
 	// Process the finding (deduplication and rollup)
-	isDuplicate, err := fm.ProcessFinding(finding)
+	result, err := fm.ProcessFindings([]*models.Finding{finding})
 	if err != nil {
 		return fmt.Errorf("failed to process finding: %v", err)
 	}
 
+	// A fixed finding that showed up again is a regression
+	if len(result.Reopened) > 0 {
+		return fm.NotifyRegression(ctx, finding)
+	}
+
 	// If it's a duplicate, we don't need to send a notification
-	if isDuplicate {
+	if len(result.New) == 0 {
+		return nil
+	}
+
+	return fm.NotifyNewFinding(ctx, finding)
+}
+
+// NotifyNewFinding sends a notification for a finding seen for the first time,
+// if the notification rules ask for its severity
+func (fm *FindingManager) NotifyNewFinding(ctx context.Context, finding *models.Finding) error {
+	if fm.notificationService == nil {
 		return nil
 	}
 
 	// Get scan details
-	scan, err := fm.app.Dao().FindRecordById("scans", finding.ScanID)
+	scan, err := fm.app.Dao().FindRecordById("nuclei_scans", finding.ScanID)
 	if err != nil {
 		return fmt.Errorf("failed to get scan: %v", err)
 	}
@@ -457,9 +222,42 @@ func (fm *FindingManager) HandleFinding(ctx context.Context, finding *models.Fin
 	return nil
 }
 
-// FinalizeScan cleans up the scan tracker and performs any final processing
+// FinalizeScan recomputes the rollup of a finished scan from its stored
+// findings, so it matches them even if an import failed halfway
 func (fm *FindingManager) FinalizeScan(scanID string) {
-	fm.CleanupScanTracker(scanID)
+	if _, err := fm.RecomputeRollup(scanID); err != nil {
+		fm.logger.Printf("Error recomputing rollup for scan %s: %v", scanID, err)
+	}
+}
+
+// RecomputeRollup rebuilds the rollup of a scan from its stored findings
+func (fm *FindingManager) RecomputeRollup(scanID string) (*RollupCounts, error) {
+	var counts *RollupCounts
+	err := fm.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		var err error
+		counts, err = RecomputeRollup(txDao, scanID)
+		return err
+	})
+	return counts, err
+}
+
+// RecomputeAllRollups rebuilds the rollups of all scans from their stored
+// findings and returns the number of scans recomputed. Shards are skipped,
+// since their findings belong to the scan they were split from.
+func (fm *FindingManager) RecomputeAllRollups() (int, error) {
+	scans, err := fm.app.Dao().FindRecordsByFilter("nuclei_scans", "shard_of = ''", "", 0, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list scans: %v", err)
+	}
+
+	recomputed := 0
+	for _, scan := range scans {
+		if _, err := fm.RecomputeRollup(scan.Id); err != nil {
+			return recomputed, fmt.Errorf("failed to recompute rollup for scan %s: %v", scan.Id, err)
+		}
+		recomputed++
+	}
+	return recomputed, nil
 }
 
 // DeleteClientFindings deletes all findings for a specific client
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "bitor/migrations"
+	"bitor/models"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+)
+
+// benchmarkFindings is the size of the import each benchmark iteration persists
+const benchmarkFindings = 1000
+
+var (
+	benchmarkDataOnce sync.Once
+	benchmarkDataDir  string
+	benchmarkDataErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if benchmarkDataDir != "" {
+		os.RemoveAll(benchmarkDataDir)
+	}
+	os.Exit(code)
+}
+
+// benchmarkData bootstraps an app in a shared data dir and applies the app
+// migrations to it, once; every test and benchmark starts from a copy of that dir
+func benchmarkData() (string, error) {
+	benchmarkDataOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "bitor-benchmark-")
+		if err != nil {
+			benchmarkDataErr = err
+			return
+		}
+		benchmarkDataDir = dir
+
+		app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: dir})
+		if err := app.Bootstrap(); err != nil {
+			benchmarkDataErr = fmt.Errorf("failed to bootstrap app: %v", err)
+			return
+		}
+		defer app.ResetBootstrapState()
+
+		runner, err := migrate.NewRunner(app.DB(), migrations.AppMigrations)
+		if err != nil {
+			benchmarkDataErr = fmt.Errorf("failed to create migration runner: %v", err)
+			return
+		}
+		if _, err := runner.Up(); err != nil {
+			benchmarkDataErr = fmt.Errorf("failed to run migrations: %v", err)
+		}
+	})
+	return benchmarkDataDir, benchmarkDataErr
+}
+
+// newTestApp returns an app backed by a fresh copy of the migrated database
+func newTestApp(tb testing.TB) *pocketbase.PocketBase {
+	tb.Helper()
+
+	if jsonV2 {
+		tb.Skip("PocketBase v0.22 can't decode collection schemas with encoding/json v2; run with GOEXPERIMENT=nojsonv2")
+	}
+
+	source, err := benchmarkData()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dataDir := tb.TempDir()
+	if err := copyDir(source, dataDir); err != nil {
+		tb.Fatalf("failed to copy benchmark data: %v", err)
+	}
+
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: dataDir})
+	if err := app.Bootstrap(); err != nil {
+		tb.Fatalf("failed to bootstrap app: %v", err)
+	}
+	tb.Cleanup(func() { app.ResetBootstrapState() })
+	return app
+}
+
+// newBenchmarkFindingManager returns a finding manager backed by a fresh copy
+// of the migrated benchmark database
+func newBenchmarkFindingManager(b *testing.B) *FindingManager {
+	b.Helper()
+
+	fm := NewFindingManager(newTestApp(b), nil)
+	fm.logger = log.New(io.Discard, "", 0)
+	return fm
+}
+
+// copyDir copies the files of a data dir
+func copyDir(source, target string) error {
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(source, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(target, entry.Name()), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchmarkImport returns the findings of one scan; every other finding
+// repeats one of the previous scan, like a scan of an unchanged target would
+func benchmarkImport(scan int) []*models.Finding {
+	severities := []string{"critical", "high", "medium", "low", "info"}
+
+	findings := make([]*models.Finding, 0, benchmarkFindings)
+	for i := 0; i < benchmarkFindings; i++ {
+		host := fmt.Sprintf("host-%d-%d.example.com", scan, i)
+		if i%2 == 0 && scan > 0 {
+			host = fmt.Sprintf("host-%d-%d.example.com", scan-1, i)
+		}
+		findings = append(findings, &models.Finding{
+			Name:       fmt.Sprintf("finding-%d", i%50),
+			Severity:   severities[i%len(severities)],
+			Host:       host,
+			Type:       "http",
+			Tool:       "nuclei",
+			ScanID:     fmt.Sprintf("scan%010d", scan),
+			ClientID:   "benchclient0001",
+			TemplateID: fmt.Sprintf("template-%d", i%50),
+			MatchedAt:  "https://" + host + "/",
+			URL:        "https://" + host + "/",
+			CreatedBy:  "system",
+		})
+	}
+	return findings
+}
+
+// BenchmarkProcessFinding persists an import one finding at a time.
+// ProcessFinding is a batch of one since rollups moved to the database, so
+// this measures one transaction per finding, not the in-memory tracker path
+// that existed when the benchmark was added.
+func BenchmarkProcessFinding(b *testing.B) {
+	fm := newBenchmarkFindingManager(b)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, finding := range benchmarkImport(n) {
+			if _, err := fm.ProcessFinding(finding); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkProcessFindings persists an import in batches of 500, like the
+// scan result import does
+func BenchmarkProcessFindings(b *testing.B) {
+	fm := newBenchmarkFindingManager(b)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		findings := benchmarkImport(n)
+		for start := 0; start < len(findings); start += 500 {
+			end := start + 500
+			if end > len(findings) {
+				end = len(findings)
+			}
+			if _, err := fm.ProcessFindings(findings[start:end]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
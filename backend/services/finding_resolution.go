@@ -0,0 +1,265 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	pbModels "github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	findingLifecycle "bitor/findings/lifecycle"
+	"bitor/models"
+	"bitor/scan/lifecycle"
+)
+
+// unresolvedStatuses are the statuses of findings still waiting for a fix,
+// which a scan that no longer observes them resolves
+var unresolvedStatuses = []string{
+	findingLifecycle.StatusOpen,
+	findingLifecycle.StatusTriaged,
+	findingLifecycle.StatusInProgress,
+	findingLifecycle.StatusReopened,
+}
+
+var resolutionHooksOnce sync.Once
+
+// FindingResolution is the outcome of reconciling the findings of a client with a completed scan
+type FindingResolution struct {
+	ScanID   string `json:"scan_id"`
+	Observed int    `json:"observed"`
+	Resolved int    `json:"resolved"`
+}
+
+// RegisterResolutionHooks reconciles findings with every scan that finishes.
+// Shards are skipped: their scan finishes once all of them have.
+func (fm *FindingManager) RegisterResolutionHooks() {
+	resolutionHooksOnce.Do(func() {
+		lifecycle.OnTransition().Add(func(e *lifecycle.TransitionEvent) error {
+			if e.To != lifecycle.StatusFinished || e.Scan.GetString("shard_of") != "" {
+				return nil
+			}
+
+			go fm.ResolveFinishedScan(e.Scan.Id)
+			return nil
+		})
+	})
+}
+
+// ResolveFinishedScan resolves the findings a finished scan didn't observe,
+// but only once no import into the scan or its shards is still running:
+// results are often imported after the scan was marked finished, and
+// resolving before they are saved would reopen them as regressions. It is
+// called when the scan finishes and again whenever an import into it is done.
+func (fm *FindingManager) ResolveFinishedScan(scanID string) {
+	scan, err := fm.app.Dao().FindRecordById("nuclei_scans", scanID)
+	if err != nil {
+		fm.logger.Printf("Error finding scan %s to resolve findings: %v", scanID, err)
+		return
+	}
+	if scan.GetString("status") != lifecycle.StatusFinished || scan.GetString("shard_of") != "" {
+		return
+	}
+
+	pending, err := HasPendingScanImports(fm.app, scanID)
+	if err != nil {
+		fm.logger.Printf("Error checking imports of scan %s: %v", scanID, err)
+		return
+	}
+	if pending {
+		fm.logger.Printf("Scan %s still has imports running, resolving its findings once they are done", scanID)
+		return
+	}
+
+	if _, err := fm.ResolveUnobservedFindings(scanID); err != nil {
+		fm.logger.Printf("Error resolving findings not observed by scan %s: %v", scanID, err)
+	}
+}
+
+// ResolveUnobservedFindings sets last_seen on every finding a completed scan
+// observed, then resolves the unfixed findings of the same client whose host
+// was in the scan's targets but which the scan didn't observe. They move to
+// fixed, unverified, with the scan recorded in resolved_by_scan; a later scan
+// that observes them again reopens them.
+func (fm *FindingManager) ResolveUnobservedFindings(scanID string) (*FindingResolution, error) {
+	scan, err := fm.app.Dao().FindRecordById("nuclei_scans", scanID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scan: %v", err)
+	}
+	clientID := scan.GetString("client")
+
+	scope, err := scanTargetHosts(fm.app.Dao(), scan)
+	if err != nil {
+		return nil, err
+	}
+
+	resolution := &FindingResolution{ScanID: scanID}
+
+	err = fm.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		result, err := txDao.DB().NewQuery(`
+			UPDATE nuclei_findings SET last_seen = {:now}
+			WHERE client = {:client}
+			AND EXISTS (
+				SELECT 1 FROM json_each(CASE WHEN json_valid(scan_ids) THEN scan_ids ELSE '[]' END)
+				WHERE value = {:scan_id}
+			)
+		`).Bind(dbx.Params{
+			"now":     types.NowDateTime().String(),
+			"client":  clientID,
+			"scan_id": scanID,
+		}).Execute()
+		if err != nil {
+			return fmt.Errorf("failed to update last_seen: %v", err)
+		}
+		if observed, err := result.RowsAffected(); err == nil {
+			resolution.Observed = int(observed)
+		}
+
+		// Without a target list there is no scope to resolve findings in
+		if len(scope) == 0 {
+			return nil
+		}
+
+		candidates, err := txDao.FindRecordsByExpr("nuclei_findings",
+			dbx.HashExp{"client": clientID},
+			dbx.In("status", unresolvedStatusValues()...),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to find unresolved findings: %v", err)
+		}
+
+		// Findings first seen while the scan ran may come from another scan
+		startTime := scan.GetDateTime("start_time")
+		comment := fmt.Sprintf("Resolved (unverified): not observed by scan %s", scan.GetString("name"))
+
+		for _, finding := range candidates {
+			if !scope[targetHost(finding.GetString("host"))] {
+				continue
+			}
+			if !startTime.IsZero() && finding.GetDateTime("created").Time().After(startTime.Time()) {
+				continue
+			}
+			if containsScanID(finding, scanID) {
+				continue
+			}
+
+			if _, err := findingLifecycle.TransitionWithDao(txDao, finding, findingLifecycle.StatusFixed, findingLifecycle.ActorSystem, comment, func(record *pbModels.Record) {
+				record.Set("resolved_by_scan", scanID)
+			}); err != nil {
+				return fmt.Errorf("failed to resolve finding %s: %v", finding.Id, err)
+			}
+			resolution.Resolved++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fm.logger.Printf("Scan %s observed %d findings and resolved %d", scanID, resolution.Observed, resolution.Resolved)
+	return resolution, nil
+}
+
+// reopenFinding reopens a fixed or verified finding that a scan observed again
+func reopenFinding(dao *daos.Dao, record *pbModels.Record, scanID string) error {
+	comment := fmt.Sprintf("Regression: observed again by scan %s", scanID)
+	_, err := findingLifecycle.TransitionWithDao(dao, record, findingLifecycle.StatusReopened, findingLifecycle.ActorSystem, comment, func(record *pbModels.Record) {
+		record.Set("resolved_by_scan", "")
+		record.Set("last_seen", time.Now())
+	})
+	return err
+}
+
+// isResolvedStatus reports whether a finding in the given status is considered fixed
+func isResolvedStatus(status string) bool {
+	return status == findingLifecycle.StatusFixed || status == findingLifecycle.StatusVerified
+}
+
+// NotifyRegression sends a notification for a fixed finding that showed up
+// again, if the notification rules ask for regressions of its severity
+func (fm *FindingManager) NotifyRegression(ctx context.Context, finding *models.Finding) error {
+	if fm.notificationService == nil {
+		return nil
+	}
+
+	scan, err := fm.app.Dao().FindRecordById("nuclei_scans", finding.ScanID)
+	if err != nil {
+		return fmt.Errorf("failed to get scan: %v", err)
+	}
+
+	if fm.notificationService.ShouldNotify("finding_regression", finding.Severity) {
+		if err := fm.notificationService.NotifyFindingRegression(
+			ctx,
+			finding.ScanID,
+			scan.GetString("name"),
+			finding.Severity,
+			finding.Name,
+			finding.Host,
+		); err != nil {
+			return fmt.Errorf("failed to send regression notification: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// scanTargetHosts returns the normalized hosts of a scan's target list
+func scanTargetHosts(dao *daos.Dao, scan *pbModels.Record) (map[string]bool, error) {
+	hosts := make(map[string]bool)
+
+	targetsID := scan.GetString("nuclei_targets")
+	if targetsID == "" {
+		return hosts, nil
+	}
+	targetsRecord, err := dao.FindRecordById("nuclei_targets", targetsID)
+	if err != nil {
+		log.Printf("Targets %s of scan %s not found: %v", targetsID, scan.Id, err)
+		return hosts, nil
+	}
+
+	var targets []string
+	if err := targetsRecord.UnmarshalJSONField("targets", &targets); err != nil {
+		return nil, fmt.Errorf("failed to read targets of scan %s: %v", scan.Id, err)
+	}
+	for _, target := range targets {
+		if host := targetHost(target); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts, nil
+}
+
+// targetHost reduces a target or a finding's host, which may be a URL or
+// include a port, to its lowercase host name
+func targetHost(target string) string {
+	target = strings.ToLower(strings.TrimSpace(target))
+	if strings.Contains(target, "://") {
+		if parsed, err := url.Parse(target); err == nil {
+			return parsed.Hostname()
+		}
+	}
+	if index := strings.Index(target, "/"); index >= 0 {
+		target = target[:index]
+	}
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return strings.Trim(host, "[]")
+	}
+	return target
+}
+
+// containsScanID reports whether a finding's scan_ids lists the scan
+func containsScanID(record *pbModels.Record, scanID string) bool {
+	var scanIDs []string
+	if err := record.UnmarshalJSONField("scan_ids", &scanIDs); err != nil {
+		return false
+	}
+	return contains(scanIDs, scanID)
+}
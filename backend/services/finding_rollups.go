@@ -0,0 +1,162 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	pbModels "github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// RollupCounts are the finding counts of a scan as derived from nuclei_findings.
+// A finding is new for the scan that first found it, whose ID is its scan_id,
+// and a duplicate for every later scan listed in its scan_ids.
+type RollupCounts struct {
+	New        int `db:"new_count" json:"new"`
+	Duplicates int `db:"duplicate_count" json:"duplicate"`
+	Critical   int `db:"critical_count" json:"critical"`
+	High       int `db:"high_count" json:"high"`
+	Medium     int `db:"medium_count" json:"medium"`
+	Low        int `db:"low_count" json:"low"`
+	Info       int `db:"info_count" json:"info"`
+}
+
+// findingRollupDelta accumulates the rollup changes of one scan within a batch
+type findingRollupDelta struct {
+	New        int
+	Duplicates int
+	Severities map[string]int
+}
+
+// CountScanFindings aggregates the rollup counts of a scan from the stored findings
+func CountScanFindings(dao *daos.Dao, scanID string) (*RollupCounts, error) {
+	counts := &RollupCounts{}
+	err := dao.DB().NewQuery(`
+		SELECT
+			COUNT(*) AS new_count,
+			COALESCE(SUM(LOWER(severity) = 'critical'), 0) AS critical_count,
+			COALESCE(SUM(LOWER(severity) = 'high'), 0) AS high_count,
+			COALESCE(SUM(LOWER(severity) = 'medium'), 0) AS medium_count,
+			COALESCE(SUM(LOWER(severity) = 'low'), 0) AS low_count,
+			COALESCE(SUM(LOWER(severity) = 'info'), 0) AS info_count,
+			(
+				SELECT COUNT(*) FROM nuclei_findings
+				WHERE scan_id != {:scan_id}
+				AND EXISTS (
+					SELECT 1 FROM json_each(CASE WHEN json_valid(scan_ids) THEN scan_ids ELSE '[]' END)
+					WHERE value = {:scan_id}
+				)
+			) AS duplicate_count
+		FROM nuclei_findings
+		WHERE scan_id = {:scan_id}
+	`).Bind(dbx.Params{
+		"scan_id": scanID,
+	}).One(counts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count findings of scan %s: %v", scanID, err)
+	}
+	return counts, nil
+}
+
+// RecomputeRollup overwrites the counts of a scan's rollup with those
+// aggregated from the stored findings, creating the rollup if needed
+func RecomputeRollup(dao *daos.Dao, scanID string) (*RollupCounts, error) {
+	counts, err := CountScanFindings(dao, scanID)
+	if err != nil {
+		return nil, err
+	}
+
+	rollup, err := findOrNewRollup(dao, scanID)
+	if err != nil {
+		return nil, err
+	}
+
+	rollup.Set("new_findings_count", counts.New)
+	rollup.Set("duplicate_findings_count", counts.Duplicates)
+	rollup.Set("critical_count", counts.Critical)
+	rollup.Set("high_count", counts.High)
+	rollup.Set("medium_count", counts.Medium)
+	rollup.Set("low_count", counts.Low)
+	rollup.Set("info_count", counts.Info)
+
+	if err := dao.SaveRecord(rollup); err != nil {
+		return nil, fmt.Errorf("failed to save rollup: %v", err)
+	}
+	return counts, nil
+}
+
+// applyRollupDelta adds the counts of a batch to the rollup of a scan in a
+// single UPDATE, so concurrent imports into the scan can't lose counts. A
+// scan without a rollup gets one recomputed from the stored findings, which
+// already include the batch.
+func applyRollupDelta(dao *daos.Dao, scanID string, delta *findingRollupDelta) error {
+	result, err := dao.DB().NewQuery(`
+		UPDATE nuclei_findings_rollups SET
+			new_findings_count = new_findings_count + {:new},
+			duplicate_findings_count = duplicate_findings_count + {:duplicates},
+			critical_count = critical_count + {:critical},
+			high_count = high_count + {:high},
+			medium_count = medium_count + {:medium},
+			low_count = low_count + {:low},
+			info_count = info_count + {:info},
+			updated = {:updated}
+		WHERE scan_id = {:scan_id}
+	`).Bind(dbx.Params{
+		"scan_id":    scanID,
+		"new":        delta.New,
+		"duplicates": delta.Duplicates,
+		"critical":   delta.Severities["critical"],
+		"high":       delta.Severities["high"],
+		"medium":     delta.Severities["medium"],
+		"low":        delta.Severities["low"],
+		"info":       delta.Severities["info"],
+		"updated":    types.NowDateTime().String(),
+	}).Execute()
+	if err != nil {
+		return fmt.Errorf("failed to update rollup: %v", err)
+	}
+
+	if updated, err := result.RowsAffected(); err == nil && updated > 0 {
+		return nil
+	}
+
+	_, err = RecomputeRollup(dao, scanID)
+	return err
+}
+
+// findOrNewRollup returns the rollup of a scan, or a new one with zero counts
+func findOrNewRollup(dao *daos.Dao, scanID string) (*pbModels.Record, error) {
+	rollup, err := dao.FindFirstRecordByFilter(
+		"nuclei_findings_rollups",
+		"scan_id = {:scan_id}",
+		dbx.Params{
+			"scan_id": scanID,
+		},
+	)
+	if err == nil {
+		return rollup, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get rollup: %v", err)
+	}
+
+	collection, err := dao.FindCollectionByNameOrId("nuclei_findings_rollups")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find nuclei_findings_rollups collection: %v", err)
+	}
+
+	rollup = pbModels.NewRecord(collection)
+	rollup.Set("scan_id", scanID)
+	rollup.Set("critical_count", 0)
+	rollup.Set("high_count", 0)
+	rollup.Set("medium_count", 0)
+	rollup.Set("low_count", 0)
+	rollup.Set("info_count", 0)
+	rollup.Set("new_findings_count", 0)
+	rollup.Set("duplicate_findings_count", 0)
+	rollup.Set("notification_sent", false)
+	return rollup, nil
+}
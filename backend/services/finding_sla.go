@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+	pbModels "github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"bitor/services/notification"
+)
+
+// DefaultSLADays are the days a finding of each severity may stay unresolved
+// when neither system_settings.finding_sla_days nor the client's override it.
+// Severities without an entry, like info, have no due date.
+var DefaultSLADays = map[string]int{
+	"critical": 7,
+	"high":     30,
+	"medium":   90,
+	"low":      180,
+}
+
+// overdueDigestSize bounds the findings listed in one overdue notification
+const overdueDigestSize = 20
+
+// SLAPolicy is the number of days a finding may stay unresolved, per severity
+type SLAPolicy map[string]int
+
+// DueAt returns when a finding of the given severity first seen at firstSeen
+// has to be resolved, or false if its severity has no SLA
+func (p SLAPolicy) DueAt(severity string, firstSeen time.Time) (time.Time, bool) {
+	days, exists := p[strings.ToLower(severity)]
+	if !exists || days <= 0 {
+		return time.Time{}, false
+	}
+	return firstSeen.AddDate(0, 0, days), true
+}
+
+// LoadSLAPolicy returns the SLA policy of a client: the defaults, overridden
+// by system_settings.finding_sla_days, overridden by the client's
+// finding_sla_days. An override of 0 days removes the SLA of a severity.
+func LoadSLAPolicy(dao *daos.Dao, clientID string) (SLAPolicy, error) {
+	policy := make(SLAPolicy, len(DefaultSLADays))
+	for severity, days := range DefaultSLADays {
+		policy[severity] = days
+	}
+
+	if settings, err := dao.FindFirstRecordByFilter("system_settings", "id != ''"); err == nil {
+		if err := overrideSLAPolicy(policy, settings); err != nil {
+			return nil, err
+		}
+	}
+
+	if clientID != "" {
+		if client, err := dao.FindRecordById("clients", clientID); err == nil {
+			if err := overrideSLAPolicy(policy, client); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// overrideSLAPolicy applies the finding_sla_days of a record to a policy
+func overrideSLAPolicy(policy SLAPolicy, record *pbModels.Record) error {
+	var overrides map[string]int
+	if err := unmarshalOptionalJSON(record, "finding_sla_days", &overrides); err != nil {
+		return fmt.Errorf("%s %s: %v", record.Collection().Name, record.Id, err)
+	}
+	for severity, days := range overrides {
+		if days <= 0 {
+			delete(policy, strings.ToLower(severity))
+			continue
+		}
+		policy[strings.ToLower(severity)] = days
+	}
+	return nil
+}
+
+// setDueAt sets the due date of a finding from its first_seen and its client's policy
+func setDueAt(record *pbModels.Record, policy SLAPolicy) {
+	firstSeen := record.GetDateTime("first_seen").Time()
+	if firstSeen.IsZero() {
+		firstSeen = time.Now()
+		record.Set("first_seen", firstSeen)
+	}
+
+	if dueAt, ok := policy.DueAt(record.GetString("severity"), firstSeen); ok {
+		record.Set("due_at", dueAt)
+	} else {
+		record.Set("due_at", "")
+	}
+}
+
+// RecomputeDueDates sets the due date of every unresolved finding of a client,
+// or of all clients when clientID is empty, from its current SLA policy. It
+// returns the number of findings updated.
+func RecomputeDueDates(app *pocketbase.PocketBase, clientID string) (int, error) {
+	updated := 0
+
+	err := app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		expressions := []dbx.Expression{dbx.In("status", unresolvedStatusValues()...)}
+		if clientID != "" {
+			expressions = append(expressions, dbx.HashExp{"client": clientID})
+		}
+		records, err := txDao.FindRecordsByExpr("nuclei_findings", expressions...)
+		if err != nil {
+			return fmt.Errorf("failed to find unresolved findings: %v", err)
+		}
+
+		policies := make(map[string]SLAPolicy)
+		for _, record := range records {
+			client := record.GetString("client")
+			policy, exists := policies[client]
+			if !exists {
+				if policy, err = LoadSLAPolicy(txDao, client); err != nil {
+					return err
+				}
+				policies[client] = policy
+			}
+
+			before := record.GetString("due_at")
+			setDueAt(record, policy)
+			if record.GetString("due_at") == before {
+				continue
+			}
+			if err := txDao.SaveRecord(record); err != nil {
+				return fmt.Errorf("failed to update due date of finding %s: %v", record.Id, err)
+			}
+			updated++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return updated, nil
+}
+
+// SLAFinding is an unresolved finding with a due date
+type SLAFinding struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Severity  string    `json:"severity"`
+	Host      string    `json:"host"`
+	Client    string    `json:"client"`
+	Status    string    `json:"status"`
+	FirstSeen time.Time `json:"first_seen"`
+	DueAt     time.Time `json:"due_at"`
+	// DaysLeft is negative once the finding is overdue
+	DaysLeft int `json:"days_left"`
+}
+
+// SLAQuery narrows the findings returned by OverdueFindings and DueSoonFindings
+type SLAQuery struct {
+	ClientIDs  []string
+	Severities []string
+	CreatedBy  string
+}
+
+// OverdueFindings returns the unresolved findings past their due date, most overdue first
+func OverdueFindings(dao *daos.Dao, query SLAQuery, now time.Time) ([]SLAFinding, error) {
+	return findSLAFindings(dao, query, time.Time{}, now, now)
+}
+
+// DueSoonFindings returns the unresolved findings due within the given
+// duration and not overdue yet, soonest first
+func DueSoonFindings(dao *daos.Dao, query SLAQuery, now time.Time, within time.Duration) ([]SLAFinding, error) {
+	return findSLAFindings(dao, query, now, now.Add(within), now)
+}
+
+// findSLAFindings returns the unresolved findings due in [from, to); a zero from has no lower bound
+func findSLAFindings(dao *daos.Dao, query SLAQuery, from, to, now time.Time) ([]SLAFinding, error) {
+	expressions := []dbx.Expression{
+		dbx.In("status", unresolvedStatusValues()...),
+		dbx.NewExp("due_at != ''"),
+		dbx.NewExp("due_at < {:to}", dbx.Params{"to": formatDateTime(to)}),
+	}
+	if !from.IsZero() {
+		expressions = append(expressions, dbx.NewExp("due_at >= {:from}", dbx.Params{"from": formatDateTime(from)}))
+	}
+	if len(query.ClientIDs) > 0 {
+		expressions = append(expressions, dbx.In("client", stringValues(query.ClientIDs)...))
+	}
+	if len(query.Severities) > 0 {
+		severities := make([]string, 0, len(query.Severities))
+		for _, severity := range query.Severities {
+			severities = append(severities, strings.ToLower(severity))
+		}
+		expressions = append(expressions, dbx.In("LOWER(severity)", stringValues(severities)...))
+	}
+	if query.CreatedBy != "" {
+		expressions = append(expressions, dbx.HashExp{"created_by": query.CreatedBy})
+	}
+
+	records, err := dao.FindRecordsByExpr("nuclei_findings", expressions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query findings by due date: %v", err)
+	}
+
+	findings := make([]SLAFinding, 0, len(records))
+	for _, record := range records {
+		dueAt := record.GetDateTime("due_at").Time()
+		findings = append(findings, SLAFinding{
+			ID:        record.Id,
+			Name:      record.GetString("name"),
+			Severity:  record.GetString("severity"),
+			Host:      record.GetString("host"),
+			Client:    record.GetString("client"),
+			Status:    record.GetString("status"),
+			FirstSeen: record.GetDateTime("first_seen").Time(),
+			DueAt:     dueAt,
+			DaysLeft:  daysUntil(now, dueAt),
+		})
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		return findings[i].DueAt.Before(findings[j].DueAt)
+	})
+
+	return findings, nil
+}
+
+// NotifyOverdueFindings sends one notification per severity listing the
+// overdue findings, for the severities the "finding_overdue" notification
+// rules ask for. It returns the number of findings notified.
+func NotifyOverdueFindings(app *pocketbase.PocketBase, notificationService *notification.NotificationService, now time.Time) (int, error) {
+	if notificationService == nil {
+		return 0, nil
+	}
+
+	findings, err := OverdueFindings(app.Dao(), SLAQuery{}, now)
+	if err != nil {
+		return 0, err
+	}
+
+	bySeverity := make(map[string][]SLAFinding)
+	for _, finding := range findings {
+		severity := strings.ToLower(finding.Severity)
+		bySeverity[severity] = append(bySeverity[severity], finding)
+	}
+
+	clientNames := make(map[string]string)
+	clientName := func(clientID string) string {
+		if name, exists := clientNames[clientID]; exists {
+			return name
+		}
+		name := clientID
+		if client, err := app.Dao().FindRecordById("clients", clientID); err == nil {
+			name = client.GetString("name")
+		}
+		clientNames[clientID] = name
+		return name
+	}
+
+	notified := 0
+	for severity, overdue := range bySeverity {
+		if !notificationService.ShouldNotify("finding_overdue", severity) {
+			continue
+		}
+
+		lines := make([]string, 0, overdueDigestSize)
+		for i, finding := range overdue {
+			if i == overdueDigestSize {
+				break
+			}
+			lines = append(lines, fmt.Sprintf("%s on %s (%s): %d days overdue",
+				finding.Name,
+				finding.Host,
+				clientName(finding.Client),
+				-finding.DaysLeft,
+			))
+		}
+
+		if err := notificationService.NotifyFindingsOverdue(context.Background(), severity, len(overdue), lines); err != nil {
+			log.Printf("Failed to notify overdue %s findings: %v", severity, err)
+			continue
+		}
+		notified += len(overdue)
+	}
+
+	return notified, nil
+}
+
+// daysUntil returns the whole days from now until t, negative once t has passed
+func daysUntil(now, t time.Time) int {
+	return int(math.Floor(t.Sub(now).Hours() / 24))
+}
+
+// formatDateTime formats a time like PocketBase stores dates, so they compare as strings
+func formatDateTime(t time.Time) string {
+	dateTime, err := types.ParseDateTime(t)
+	if err != nil {
+		return ""
+	}
+	return dateTime.String()
+}
+
+// unresolvedStatusValues returns unresolvedStatuses for dbx.In
+func unresolvedStatusValues() []interface{} {
+	return stringValues(unresolvedStatuses)
+}
+
+// stringValues converts strings for dbx.In
+func stringValues(values []string) []interface{} {
+	result := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		result = append(result, value)
+	}
+	return result
+}
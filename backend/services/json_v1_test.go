@@ -0,0 +1,6 @@
+//go:build !goexperiment.jsonv2
+
+package services
+
+// jsonV2 reports whether encoding/json is built on json v2
+const jsonV2 = false
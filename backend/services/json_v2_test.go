@@ -0,0 +1,7 @@
+//go:build goexperiment.jsonv2
+
+package services
+
+// jsonV2 reports whether encoding/json is built on json v2, where PocketBase
+// v0.22's SchemaField.UnmarshalJSON recurses until the stack overflows
+const jsonV2 = true
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -230,6 +231,35 @@ func (n *NotificationService) NotifyFinding(ctx context.Context, scanID, scanNam
 	return n.Notify(ctx, subject, message)
 }
 
+// NotifyFindingRegression sends a notification about a fixed finding that showed up again
+func (n *NotificationService) NotifyFindingRegression(ctx context.Context, scanID, scanName, severity, title, host string) error {
+	subject := fmt.Sprintf("Regression: %s Finding Reopened in %s", severity, scanName)
+	message := fmt.Sprintf("A %s severity finding that was resolved has been detected again and reopened:\nTitle: %s\nHost: %s\nScan: %s (ID: %s)",
+		severity,
+		title,
+		host,
+		scanName,
+		scanID,
+	)
+
+	return n.Notify(ctx, subject, message)
+}
+
+// NotifyFindingsOverdue sends a notification about findings of a severity past their SLA due date
+func (n *NotificationService) NotifyFindingsOverdue(ctx context.Context, severity string, count int, findings []string) error {
+	subject := fmt.Sprintf("%d Overdue %s Findings", count, severity)
+	message := fmt.Sprintf("%d %s severity findings are past their SLA due date:\n%s",
+		count,
+		severity,
+		strings.Join(findings, "\n"),
+	)
+	if count > len(findings) {
+		message += fmt.Sprintf("\n...and %d more", count-len(findings))
+	}
+
+	return n.Notify(ctx, subject, message)
+}
+
 // NotifyScanStarted sends a notification about a scan starting
 func (n *NotificationService) NotifyScanStarted(ctx context.Context, scanID, scanName string) error {
 	subject := fmt.Sprintf("Scan Started: %s", scanName)
@@ -279,6 +309,19 @@ func (n *NotificationService) NotifyScanStopped(ctx context.Context, scanID, sca
 	return n.Notify(ctx, subject, message)
 }
 
+// NotifyScanTimedOut sends a notification about a scan stopped for running too long
+func (n *NotificationService) NotifyScanTimedOut(ctx context.Context, scanID, scanName, reason string) error {
+	subject := fmt.Sprintf("Scan Timed Out: %s", scanName)
+	message := fmt.Sprintf("The scan %s (ID: %s) ran past its maximum runtime and was stopped at %s\nReason: %s\nFindings uploaded before the timeout have been kept.",
+		scanName,
+		scanID,
+		time.Now().Format(time.RFC3339),
+		reason,
+	)
+
+	return n.Notify(ctx, subject, message)
+}
+
 // GetRules returns the current notification rules
 func (n *NotificationService) GetRules() []NotificationRule {
 	n.mu.RLock()
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// Changes of a finding between two scans
+const (
+	FindingChangeNew        = "new"
+	FindingChangeResolved   = "resolved"
+	FindingChangePersisting = "persisting"
+)
+
+// ErrScanDiffClientMismatch is returned when the scans of a diff belong to
+// different clients. Finding hashes include the client, so nothing would match.
+var ErrScanDiffClientMismatch = errors.New("scans belong to different clients")
+
+// ScanDiffScan identifies one side of a scan diff
+type ScanDiffScan struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Start    string `json:"start_time"`
+	End      string `json:"end_time"`
+	Findings int    `json:"findings"`
+}
+
+// DiffFinding is a finding that is new, resolved or persisting between two scans
+type DiffFinding struct {
+	ID         string `json:"id"`
+	Hash       string `json:"hash"`
+	Change     string `json:"change"`
+	Name       string `json:"name"`
+	Severity   string `json:"severity"`
+	Host       string `json:"host"`
+	TemplateID string `json:"template_id"`
+	MatchedAt  string `json:"matched_at"`
+	Status     string `json:"status"`
+
+	severityOrder int
+}
+
+// DiffCounts counts the findings of a diff by change
+type DiffCounts struct {
+	New        int `json:"new"`
+	Resolved   int `json:"resolved"`
+	Persisting int `json:"persisting"`
+	Base       int `json:"base"`
+	Head       int `json:"head"`
+}
+
+// HostDiff is the change in findings on one host
+type HostDiff struct {
+	Host string `json:"host"`
+	DiffCounts
+	Delta int `json:"delta"` // Head findings minus base findings
+}
+
+// ScanDiff is the difference in findings between a base scan and a later head scan
+type ScanDiff struct {
+	Base       ScanDiffScan          `json:"base"`
+	Head       ScanDiffScan          `json:"head"`
+	Summary    DiffCounts            `json:"summary"`
+	Severities map[string]DiffCounts `json:"severities"`
+	Hosts      []HostDiff            `json:"hosts"`
+	New        []DiffFinding         `json:"new"`
+	Resolved   []DiffFinding         `json:"resolved"`
+	Persisting []DiffFinding         `json:"persisting"`
+}
+
+// DiffScans compares the findings of two scans by their hash. Findings only
+// seen by head are new, findings only seen by base are resolved and findings
+// seen by both are persisting.
+func DiffScans(app *pocketbase.PocketBase, baseID, headID string) (*ScanDiff, error) {
+	base, err := app.Dao().FindRecordById("nuclei_scans", baseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find base scan: %v", err)
+	}
+	head, err := app.Dao().FindRecordById("nuclei_scans", headID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find head scan: %v", err)
+	}
+	if base.GetString("client") != head.GetString("client") {
+		return nil, ErrScanDiffClientMismatch
+	}
+
+	baseFindings, err := findScanFindings(app, base)
+	if err != nil {
+		return nil, err
+	}
+	headFindings, err := findScanFindings(app, head)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &ScanDiff{
+		Base:       diffScan(base, len(baseFindings)),
+		Head:       diffScan(head, len(headFindings)),
+		Severities: make(map[string]DiffCounts),
+		Hosts:      []HostDiff{},
+		New:        []DiffFinding{},
+		Resolved:   []DiffFinding{},
+		Persisting: []DiffFinding{},
+	}
+
+	hosts := make(map[string]*HostDiff)
+	add := func(record *models.Record, change string, inBase, inHead bool) {
+		finding := diffFinding(record, change)
+		switch change {
+		case FindingChangeNew:
+			diff.New = append(diff.New, finding)
+		case FindingChangeResolved:
+			diff.Resolved = append(diff.Resolved, finding)
+		case FindingChangePersisting:
+			diff.Persisting = append(diff.Persisting, finding)
+		}
+
+		host, ok := hosts[finding.Host]
+		if !ok {
+			host = &HostDiff{Host: finding.Host}
+			hosts[finding.Host] = host
+		}
+		severity := diff.Severities[finding.Severity]
+		for _, counts := range []*DiffCounts{&diff.Summary, &severity, &host.DiffCounts} {
+			counts.add(change, inBase, inHead)
+		}
+		diff.Severities[finding.Severity] = severity
+	}
+
+	for hash, record := range headFindings {
+		if _, ok := baseFindings[hash]; ok {
+			add(record, FindingChangePersisting, true, true)
+		} else {
+			add(record, FindingChangeNew, false, true)
+		}
+	}
+	for hash, record := range baseFindings {
+		if _, ok := headFindings[hash]; !ok {
+			add(record, FindingChangeResolved, true, false)
+		}
+	}
+
+	for _, host := range hosts {
+		host.Delta = host.Head - host.Base
+		diff.Hosts = append(diff.Hosts, *host)
+	}
+	sort.Slice(diff.Hosts, func(i, j int) bool {
+		if diff.Hosts[i].Delta != diff.Hosts[j].Delta {
+			return diff.Hosts[i].Delta > diff.Hosts[j].Delta
+		}
+		return diff.Hosts[i].Host < diff.Hosts[j].Host
+	})
+	for _, findings := range [][]DiffFinding{diff.New, diff.Resolved, diff.Persisting} {
+		sortDiffFindings(findings)
+	}
+
+	return diff, nil
+}
+
+// Findings returns all findings of the diff: new, then resolved, then persisting
+func (d *ScanDiff) Findings() []DiffFinding {
+	findings := make([]DiffFinding, 0, len(d.New)+len(d.Resolved)+len(d.Persisting))
+	findings = append(findings, d.New...)
+	findings = append(findings, d.Resolved...)
+	return append(findings, d.Persisting...)
+}
+
+func (c *DiffCounts) add(change string, inBase, inHead bool) {
+	switch change {
+	case FindingChangeNew:
+		c.New++
+	case FindingChangeResolved:
+		c.Resolved++
+	case FindingChangePersisting:
+		c.Persisting++
+	}
+	if inBase {
+		c.Base++
+	}
+	if inHead {
+		c.Head++
+	}
+}
+
+// findScanFindings returns the findings seen by a scan, keyed by hash. A
+// finding seen again by a later scan keeps the ID of the scan that found it
+// first in scan_id and lists every scan in scan_ids.
+func findScanFindings(app *pocketbase.PocketBase, scan *models.Record) (map[string]*models.Record, error) {
+	records, err := app.Dao().FindRecordsByFilter(
+		"nuclei_findings",
+		"client = {:client} && (scan_id = {:scan} || scan_ids ~ {:scan})",
+		"",
+		0,
+		0,
+		dbx.Params{
+			"client": scan.GetString("client"),
+			"scan":   scan.Id,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find findings of scan %s: %v", scan.Id, err)
+	}
+
+	findings := make(map[string]*models.Record, len(records))
+	for _, record := range records {
+		hash := record.GetString("hash")
+		if hash == "" {
+			hash = record.Id
+		}
+		findings[hash] = record
+	}
+	return findings, nil
+}
+
+func diffScan(scan *models.Record, findings int) ScanDiffScan {
+	return ScanDiffScan{
+		ID:       scan.Id,
+		Name:     scan.GetString("name"),
+		Status:   scan.GetString("status"),
+		Start:    scan.GetString("start_time"),
+		End:      scan.GetString("end_time"),
+		Findings: findings,
+	}
+}
+
+func diffFinding(record *models.Record, change string) DiffFinding {
+	return DiffFinding{
+		ID:            record.Id,
+		Hash:          record.GetString("hash"),
+		Change:        change,
+		Name:          record.GetString("name"),
+		Severity:      strings.ToLower(record.GetString("severity")),
+		Host:          record.GetString("host"),
+		TemplateID:    record.GetString("template_id"),
+		MatchedAt:     record.GetString("matched_at"),
+		Status:        record.GetString("status"),
+		severityOrder: record.GetInt("severity_order"),
+	}
+}
+
+// sortDiffFindings sorts findings by severity, then host and name
+func sortDiffFindings(findings []DiffFinding) {
+	sort.Slice(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.severityOrder != b.severityOrder {
+			return a.severityOrder < b.severityOrder
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Name < b.Name
+	})
+}
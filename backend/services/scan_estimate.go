@@ -0,0 +1,145 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+	"bitor/scan/utils"
+)
+
+const (
+	// estimateHistorySize is how many earlier runs the runtime estimate is based on
+	estimateHistorySize = 10
+	// defaultRuntimePerTarget and vmOverhead estimate scans without any history
+	defaultRuntimePerTarget = 20 * time.Second
+	vmOverhead              = 10 * time.Minute
+)
+
+// ScanEstimate is the expected runtime and cost of a scan
+type ScanEstimate struct {
+	ExecutionMode string        `json:"execution_mode"`
+	ProviderID    string        `json:"provider_id"`
+	ProviderName  string        `json:"provider_name"`
+	ProviderType  string        `json:"provider_type"`
+	Region        string        `json:"region"`
+	VMSize        string        `json:"vm_size"`
+	Shards        int           `json:"shards"`
+	HourlyPrice   float64       `json:"hourly_price"`
+	Runtime       time.Duration `json:"-"`
+	RuntimeHours  float64       `json:"estimated_runtime_hours"`
+	RuntimeBasis  string        `json:"runtime_basis"`
+	Cost          float64       `json:"estimated_cost"`
+}
+
+// EstimateScan estimates how long a scan will run and what its VMs will cost.
+// The runtime is the average of earlier finished runs with the same client
+// and nuclei profile, or a per-target default when there are none. A sharded
+// scan runs its shards side by side, each on its own VM.
+func EstimateScan(app *pocketbase.PocketBase, scan, scanProfile *models.Record, targets int) (*ScanEstimate, error) {
+	estimate := &ScanEstimate{
+		ExecutionMode: scanProfile.GetString("execution_mode"),
+		VMSize:        scanProfile.GetString("vm_size"),
+		Shards:        1,
+	}
+	if estimate.ExecutionMode == "" {
+		estimate.ExecutionMode = "cloud"
+	}
+	if shards := scanProfile.GetInt("shards"); shards > 1 && estimate.ExecutionMode != "local" {
+		estimate.Shards = shards
+		if estimate.Shards > MaxScanShards {
+			estimate.Shards = MaxScanShards
+		}
+		if targets > 0 && estimate.Shards > targets {
+			estimate.Shards = targets
+		}
+	}
+
+	runtime, runs, err := averageScanRuntime(app, scan)
+	if err != nil {
+		return nil, err
+	}
+	if runs > 0 {
+		estimate.Runtime = runtime
+		estimate.RuntimeBasis = fmt.Sprintf("average of the last %d finished runs", runs)
+	} else {
+		estimate.Runtime = vmOverhead + time.Duration(targets)*defaultRuntimePerTarget/time.Duration(estimate.Shards)
+		estimate.RuntimeBasis = fmt.Sprintf("default of %s per target, no earlier runs", defaultRuntimePerTarget)
+	}
+	estimate.RuntimeHours = estimate.Runtime.Hours()
+
+	// Local scans have no VM to pay for
+	if estimate.ExecutionMode == "local" {
+		return estimate, nil
+	}
+
+	estimate.ProviderID = scanProfile.GetString("vm_provider")
+	if estimate.ProviderID == "" {
+		return nil, fmt.Errorf("scan profile has no VM provider")
+	}
+	provider, err := app.Dao().FindRecordById("providers", estimate.ProviderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find provider: %v", err)
+	}
+	estimate.ProviderName = provider.GetString("name")
+	estimate.ProviderType = provider.GetString("provider_type")
+
+	estimate.Region, err = ProviderRegion(provider)
+	if err != nil {
+		return nil, err
+	}
+	if estimate.VMSize == "" {
+		return nil, fmt.Errorf("scan profile has no VM size")
+	}
+
+	estimate.HourlyPrice, err = utils.GetVMPrice(app, estimate.ProviderID, estimate.Region, estimate.VMSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VM price: %v", err)
+	}
+	estimate.Cost = estimate.HourlyPrice * estimate.RuntimeHours * float64(estimate.Shards)
+
+	return estimate, nil
+}
+
+// averageScanRuntime returns the average runtime of the last finished runs
+// with the same client and nuclei profile as a scan, and how many there were
+func averageScanRuntime(app *pocketbase.PocketBase, scan *models.Record) (time.Duration, int, error) {
+	runs, err := app.Dao().FindRecordsByFilter(
+		"nuclei_scans",
+		"client = {:client} && nuclei_profile = {:profile} && status = {:finished} && shard_of = '' && start_time != '' && end_time != ''",
+		"-end_time",
+		estimateHistorySize,
+		0,
+		dbx.Params{
+			"client":   scan.GetString("client"),
+			"profile":  scan.GetString("nuclei_profile"),
+			"finished": lifecycle.StatusFinished,
+		},
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to find earlier runs: %v", err)
+	}
+
+	var total time.Duration
+	count := 0
+	for _, run := range runs {
+		start, err := parseScanTime(run.GetString("start_time"))
+		if err != nil {
+			continue
+		}
+		end, err := parseScanTime(run.GetString("end_time"))
+		if err != nil || !end.After(start) {
+			continue
+		}
+		total += end.Sub(start)
+		count++
+	}
+	if count == 0 {
+		return 0, 0, nil
+	}
+	return total / time.Duration(count), count, nil
+}
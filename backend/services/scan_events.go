@@ -6,6 +6,9 @@ import (
 	"time"
 
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
 )
 
 // ScanEventService handles scan lifecycle events
@@ -31,14 +34,23 @@ func (s *ScanEventService) HandleScanFinished(scanID string) error {
 	}
 
 	// Only update status if it's not a manual scan
-	currentStatus := scan.GetString("status")
-	if currentStatus != "Manual" {
-		scan.Set("status", "Finished")
+	if scan.GetString("status") != lifecycle.StatusManual {
+		if _, err := lifecycle.Transition(s.app, scanID, lifecycle.StatusFinished, lifecycle.ActorSystem, "scan results imported", func(record *models.Record) {
+			record.Set("end_time", time.Now())
+		}); err != nil {
+			log.Printf("Failed to update scan status: %v", err)
+		}
+	} else {
+		scan.Set("end_time", time.Now())
+		if err := s.app.Dao().SaveRecord(scan); err != nil {
+			log.Printf("Failed to update scan end time: %v", err)
+		}
 	}
-	scan.Set("end_time", time.Now())
 
-	if err := s.app.Dao().SaveRecord(scan); err != nil {
-		log.Printf("Failed to update scan status: %v", err)
+	// A shard's findings are rolled up under its parent scan, which finishes
+	// once all of its shards have
+	if scan.GetString("shard_of") != "" {
+		return nil
 	}
 
 	// Get finding summary and create rollup
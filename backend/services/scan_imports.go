@@ -0,0 +1,266 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	pbModels "github.com/pocketbase/pocketbase/models"
+)
+
+// Scan import states stored in the scan_imports collection
+const (
+	ScanImportQueued     = "queued"
+	ScanImportParsing    = "parsing"
+	ScanImportProcessing = "processing"
+	ScanImportDone       = "done"
+	ScanImportFailed     = "failed"
+)
+
+// Where the file of a scan import came from
+const (
+	ScanImportSourceUpload  = "upload"
+	ScanImportSourceChunked = "chunked"
+	ScanImportSourceSession = "session"
+	ScanImportSourceLocal   = "local"
+)
+
+// ScanImportCounts summarizes the findings of one import
+type ScanImportCounts struct {
+	Parsed     int `json:"parsed"`
+	Unique     int `json:"unique"`
+	New        int `json:"new"`
+	Duplicates int `json:"duplicates"`
+	Errors     int `json:"errors"`
+	// Unsaved are the errors of findings that failed to be saved, which a
+	// retry of the same results may still save
+	Unsaved int `json:"-"`
+}
+
+// ScanImportStatus is the API view of a scan import
+type ScanImportStatus struct {
+	ID         string           `json:"id"`
+	ScanID     string           `json:"scan_id"`
+	Source     string           `json:"source"`
+	Status     string           `json:"status"`
+	SHA256     string           `json:"sha256"`
+	Counts     ScanImportCounts `json:"counts"`
+	Error      string           `json:"error,omitempty"`
+	Created    string           `json:"created"`
+	StartedAt  string           `json:"started_at,omitempty"`
+	FinishedAt string           `json:"finished_at,omitempty"`
+}
+
+// FileSHA256 returns the hex encoded SHA-256 of a file
+func FileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// QueueScanImport registers the import of a results file into a scan. The
+// idempotency key combines the scan, its current run and the file's checksum:
+// when the same file was already imported into the same run, the existing
+// import is returned with true and the file must not be processed again. A
+// failed import of the same file is queued again.
+func QueueScanImport(app *pocketbase.PocketBase, scan *pbModels.Record, clientID, createdBy, source, checksum string) (*pbModels.Record, bool, error) {
+	key := fmt.Sprintf("%s:%s:%s", scan.Id, scan.GetString("start_time"), checksum)
+
+	record, err := app.Dao().FindFirstRecordByFilter(
+		"scan_imports",
+		"idempotency_key = {:key}",
+		dbx.Params{"key": key},
+	)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, fmt.Errorf("failed to find scan import: %v", err)
+	}
+	if record != nil && record.GetString("status") != ScanImportFailed {
+		return record, true, nil
+	}
+
+	if record == nil {
+		collection, err := app.Dao().FindCollectionByNameOrId("scan_imports")
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to find scan_imports collection: %v", err)
+		}
+		record = pbModels.NewRecord(collection)
+		record.Set("scan", scan.Id)
+		record.Set("idempotency_key", key)
+		record.Set("sha256", checksum)
+	}
+
+	record.Set("client", clientID)
+	record.Set("created_by", createdBy)
+	record.Set("source", source)
+	record.Set("status", ScanImportQueued)
+	record.Set("parsed_count", 0)
+	record.Set("unique_count", 0)
+	record.Set("new_count", 0)
+	record.Set("duplicate_count", 0)
+	record.Set("error_count", 0)
+	record.Set("error", "")
+	record.Set("started_at", nil)
+	record.Set("finished_at", nil)
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return nil, false, fmt.Errorf("failed to save scan import: %v", err)
+	}
+	return record, false, nil
+}
+
+// StartScanImportParsing marks an import as reading its file
+func StartScanImportParsing(app *pocketbase.PocketBase, importID string) error {
+	return updateScanImport(app, importID, func(record *pbModels.Record) {
+		record.Set("status", ScanImportParsing)
+		record.Set("started_at", time.Now())
+	})
+}
+
+// StartScanImportProcessing marks an import as saving the findings it parsed
+func StartScanImportProcessing(app *pocketbase.PocketBase, importID string, parsed int) error {
+	return updateScanImport(app, importID, func(record *pbModels.Record) {
+		record.Set("status", ScanImportProcessing)
+		record.Set("parsed_count", parsed)
+	})
+}
+
+// FinishScanImport marks an import as done with the counts of its findings
+func FinishScanImport(app *pocketbase.PocketBase, importID string, counts ScanImportCounts) error {
+	return updateScanImport(app, importID, func(record *pbModels.Record) {
+		record.Set("status", ScanImportDone)
+		record.Set("parsed_count", counts.Parsed)
+		record.Set("unique_count", counts.Unique)
+		record.Set("new_count", counts.New)
+		record.Set("duplicate_count", counts.Duplicates)
+		record.Set("error_count", counts.Errors)
+		record.Set("finished_at", time.Now())
+	})
+}
+
+// FailScanImport marks an import as failed
+func FailScanImport(app *pocketbase.PocketBase, importID string, cause error) error {
+	return updateScanImport(app, importID, func(record *pbModels.Record) {
+		record.Set("status", ScanImportFailed)
+		record.Set("error", cause.Error())
+		record.Set("finished_at", time.Now())
+	})
+}
+
+// HasPendingScanImports reports whether an import into a scan or one of its
+// shards is still queued, parsing or processing
+func HasPendingScanImports(app *pocketbase.PocketBase, scanID string) (bool, error) {
+	records, err := app.Dao().FindRecordsByFilter(
+		"scan_imports",
+		"(scan = {:scan} || scan.shard_of = {:scan}) && (status = {:queued} || status = {:parsing} || status = {:processing})",
+		"",
+		1,
+		0,
+		dbx.Params{
+			"scan":       scanID,
+			"queued":     ScanImportQueued,
+			"parsing":    ScanImportParsing,
+			"processing": ScanImportProcessing,
+		},
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to find pending scan imports: %v", err)
+	}
+	return len(records) > 0, nil
+}
+
+// RecoverInterruptedScanImports fails the imports a restart left queued,
+// parsing or processing. Their background processing is gone, and an
+// unfinished import would make every later upload of the same file look like
+// a duplicate; a failed one is queued again when the file is uploaded again.
+func RecoverInterruptedScanImports(app *pocketbase.PocketBase) (int, error) {
+	records, err := app.Dao().FindRecordsByFilter(
+		"scan_imports",
+		"status = {:queued} || status = {:parsing} || status = {:processing}",
+		"created",
+		0,
+		0,
+		dbx.Params{
+			"queued":     ScanImportQueued,
+			"parsing":    ScanImportParsing,
+			"processing": ScanImportProcessing,
+		},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find interrupted scan imports: %v", err)
+	}
+
+	for _, record := range records {
+		record.Set("status", ScanImportFailed)
+		record.Set("error", "interrupted by a restart; upload the results again")
+		record.Set("finished_at", time.Now())
+		if err := app.Dao().SaveRecord(record); err != nil {
+			return 0, fmt.Errorf("failed to save scan import %s: %v", record.Id, err)
+		}
+	}
+	return len(records), nil
+}
+
+// GetScanImport returns the API view of a scan import
+func GetScanImport(app *pocketbase.PocketBase, importID string) (*ScanImportStatus, error) {
+	record, err := app.Dao().FindRecordById("scan_imports", importID)
+	if err != nil {
+		return nil, err
+	}
+	return ScanImportStatusOf(record), nil
+}
+
+// ScanImportStatusOf converts a scan_imports record to its API view
+func ScanImportStatusOf(record *pbModels.Record) *ScanImportStatus {
+	status := &ScanImportStatus{
+		ID:     record.Id,
+		ScanID: record.GetString("scan"),
+		Source: record.GetString("source"),
+		Status: record.GetString("status"),
+		SHA256: record.GetString("sha256"),
+		Counts: ScanImportCounts{
+			Parsed:     record.GetInt("parsed_count"),
+			Unique:     record.GetInt("unique_count"),
+			New:        record.GetInt("new_count"),
+			Duplicates: record.GetInt("duplicate_count"),
+			Errors:     record.GetInt("error_count"),
+		},
+		Error:   record.GetString("error"),
+		Created: record.GetDateTime("created").String(),
+	}
+
+	if startedAt := record.GetDateTime("started_at"); !startedAt.IsZero() {
+		status.StartedAt = startedAt.String()
+	}
+	if finishedAt := record.GetDateTime("finished_at"); !finishedAt.IsZero() {
+		status.FinishedAt = finishedAt.String()
+	}
+	return status
+}
+
+func updateScanImport(app *pocketbase.PocketBase, importID string, update func(record *pbModels.Record)) error {
+	record, err := app.Dao().FindRecordById("scan_imports", importID)
+	if err != nil {
+		return fmt.Errorf("failed to find scan import %s: %v", importID, err)
+	}
+
+	update(record)
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return fmt.Errorf("failed to save scan import %s: %v", importID, err)
+	}
+	return nil
+}
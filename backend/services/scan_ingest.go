@@ -0,0 +1,118 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// IngestBatchTotals sums the findings of the batches streamed for a scan
+type IngestBatchTotals struct {
+	Batches    int `json:"batches"`
+	Findings   int `json:"findings"`
+	New        int `json:"new"`
+	Duplicates int `json:"duplicates"`
+}
+
+// ingestRun identifies the current run of a scan. A VM starts numbering its
+// batches at 1 on every run, so sequence numbers are only unique per run.
+func ingestRun(scan *models.Record) string {
+	return scan.GetString("start_time")
+}
+
+// FindIngestBatch returns the batch the current run of a scan already
+// streamed under the given sequence number, or nil if that sequence hasn't
+// been ingested yet
+func FindIngestBatch(app *pocketbase.PocketBase, scan *models.Record, sequence int) (*models.Record, error) {
+	record, err := app.Dao().FindFirstRecordByFilter(
+		"scan_ingest_batches",
+		"scan = {:scan} && run = {:run} && sequence = {:sequence}",
+		dbx.Params{"scan": scan.Id, "run": ingestRun(scan), "sequence": sequence},
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find ingest batch: %v", err)
+	}
+	return record, nil
+}
+
+// SaveIngestBatch records that a batch has been ingested, so a retry of the
+// same sequence number in the same run isn't processed twice
+func SaveIngestBatch(app *pocketbase.PocketBase, scan *models.Record, sequence, findings, newCount, duplicates int) (*models.Record, error) {
+	collection, err := app.Dao().FindCollectionByNameOrId("scan_ingest_batches")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scan_ingest_batches collection: %v", err)
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("scan", scan.Id)
+	record.Set("run", ingestRun(scan))
+	record.Set("sequence", sequence)
+	record.Set("findings_count", findings)
+	record.Set("new_count", newCount)
+	record.Set("duplicate_count", duplicates)
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return nil, fmt.Errorf("failed to save ingest batch: %v", err)
+	}
+	return record, nil
+}
+
+// MissingIngestBatches returns the sequence numbers between 1 and expected
+// that the current run of a scan hasn't streamed yet
+func MissingIngestBatches(app *pocketbase.PocketBase, scan *models.Record, expected int) ([]int, error) {
+	batches, err := findIngestBatches(app, scan)
+	if err != nil {
+		return nil, err
+	}
+
+	received := make(map[int]bool, len(batches))
+	for _, batch := range batches {
+		received[batch.GetInt("sequence")] = true
+	}
+
+	missing := []int{}
+	for sequence := 1; sequence <= expected; sequence++ {
+		if !received[sequence] {
+			missing = append(missing, sequence)
+		}
+	}
+	return missing, nil
+}
+
+// GetIngestBatchTotals sums the batches the current run of a scan has streamed
+func GetIngestBatchTotals(app *pocketbase.PocketBase, scan *models.Record) (*IngestBatchTotals, error) {
+	batches, err := findIngestBatches(app, scan)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := &IngestBatchTotals{Batches: len(batches)}
+	for _, batch := range batches {
+		totals.Findings += batch.GetInt("findings_count")
+		totals.New += batch.GetInt("new_count")
+		totals.Duplicates += batch.GetInt("duplicate_count")
+	}
+	return totals, nil
+}
+
+func findIngestBatches(app *pocketbase.PocketBase, scan *models.Record) ([]*models.Record, error) {
+	batches, err := app.Dao().FindRecordsByFilter(
+		"scan_ingest_batches",
+		"scan = {:scan} && run = {:run}",
+		"sequence",
+		0,
+		0,
+		dbx.Params{"scan": scan.Id, "run": ingestRun(scan)},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find ingest batches: %v", err)
+	}
+	return batches, nil
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// Actions a policy takes on manual starts requested outside the allowed windows
+const (
+	PolicyManualRefuse = "refuse"
+	PolicyManualDefer  = "defer"
+)
+
+// Actions a policy takes on scheduled runs that fall outside the allowed windows
+const (
+	PolicyScheduledSkip  = "skip"
+	PolicyScheduledShift = "shift"
+)
+
+// Decisions recorded in scan_policy_decisions
+const (
+	PolicyDecisionAllowed  = "allowed"
+	PolicyDecisionRefused  = "refused"
+	PolicyDecisionDeferred = "deferred"
+	PolicyDecisionSkipped  = "skipped"
+	PolicyDecisionShifted  = "shifted"
+	PolicyDecisionStopped  = "stopped"
+)
+
+// ActorScanPolicy is recorded on the transitions made when a policy stops a scan
+const ActorScanPolicy = "scan-policy"
+
+// policyLookahead is how far ahead the next allowed time and the end of the
+// current window are searched for
+const policyLookahead = 14 * 24 * time.Hour
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// ScanWindow is a weekly time window in the policy's timezone. A window whose
+// end is before its start runs past midnight into the next day.
+type ScanWindow struct {
+	Days  []string `json:"days"`  // Weekday names, every day when empty
+	Start string   `json:"start"` // HH:MM
+	End   string   `json:"end"`   // HH:MM, 24 hours from Start when equal to it
+
+	days       map[time.Weekday]bool
+	start, end int // Minutes since midnight
+}
+
+// FreezePeriod is a range of dates during which no scan may run
+type FreezePeriod struct {
+	Start  string `json:"start"` // YYYY-MM-DD
+	End    string `json:"end"`   // YYYY-MM-DD, inclusive; the start date when empty
+	Reason string `json:"reason"`
+}
+
+// ScanPolicy is a client's scan window policy from the scan_policies collection.
+// A scan may run when it is inside one of the allowed windows (or there are
+// none), outside every blocked window and not on a freeze date.
+type ScanPolicy struct {
+	ID              string
+	ClientID        string
+	Location        *time.Location
+	AllowedWindows  []ScanWindow
+	BlockedWindows  []ScanWindow
+	FreezeDates     []FreezePeriod
+	ManualAction    string
+	ScheduledAction string
+}
+
+// PolicyDecision is the outcome of evaluating a policy at a given time
+type PolicyDecision struct {
+	Allowed     bool
+	Reason      string
+	NextAllowed time.Time // When a blocked scan may run, zero if not within the lookahead
+	ClosesAt    time.Time // When an allowed scan must stop, zero if not within the lookahead
+}
+
+// LoadScanPolicy returns the enabled scan policy of a client, or nil if the
+// client has none
+func LoadScanPolicy(app *pocketbase.PocketBase, clientID string) (*ScanPolicy, error) {
+	if clientID == "" {
+		return nil, nil
+	}
+
+	records, err := app.Dao().FindRecordsByFilter("scan_policies", "client = {:client} && enabled = true", "", 1, 0, dbx.Params{"client": clientID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scan policy: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	return ParseScanPolicy(records[0])
+}
+
+// RegisterScanPolicyValidation rejects scan_policies records whose timezone,
+// windows or freeze dates can't be parsed
+func RegisterScanPolicyValidation(app *pocketbase.PocketBase) {
+	validate := func(e *core.ModelEvent) error {
+		record, ok := e.Model.(*models.Record)
+		if !ok {
+			return nil
+		}
+		if _, err := ParseScanPolicy(record); err != nil {
+			return fmt.Errorf("invalid scan policy: %v", err)
+		}
+		return nil
+	}
+
+	app.OnModelBeforeCreate("scan_policies").Add(validate)
+	app.OnModelBeforeUpdate("scan_policies").Add(validate)
+}
+
+// ParseScanPolicy reads and validates a scan_policies record
+func ParseScanPolicy(record *models.Record) (*ScanPolicy, error) {
+	policy := &ScanPolicy{
+		ID:              record.Id,
+		ClientID:        record.GetString("client"),
+		Location:        time.Local,
+		ManualAction:    record.GetString("manual_action"),
+		ScheduledAction: record.GetString("scheduled_action"),
+	}
+
+	if timezone := record.GetString("timezone"); timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+		}
+		policy.Location = location
+	}
+	if policy.ManualAction == "" {
+		policy.ManualAction = PolicyManualRefuse
+	}
+	if policy.ScheduledAction == "" {
+		policy.ScheduledAction = PolicyScheduledSkip
+	}
+
+	if err := unmarshalOptionalJSON(record, "allowed_windows", &policy.AllowedWindows); err != nil {
+		return nil, err
+	}
+	if err := unmarshalOptionalJSON(record, "blocked_windows", &policy.BlockedWindows); err != nil {
+		return nil, err
+	}
+	if err := unmarshalOptionalJSON(record, "freeze_dates", &policy.FreezeDates); err != nil {
+		return nil, err
+	}
+
+	for i := range policy.AllowedWindows {
+		if err := policy.AllowedWindows[i].parse(); err != nil {
+			return nil, fmt.Errorf("invalid allowed window %d: %v", i+1, err)
+		}
+	}
+	for i := range policy.BlockedWindows {
+		if err := policy.BlockedWindows[i].parse(); err != nil {
+			return nil, fmt.Errorf("invalid blocked window %d: %v", i+1, err)
+		}
+	}
+	for i, freeze := range policy.FreezeDates {
+		if _, err := time.Parse("2006-01-02", freeze.Start); err != nil {
+			return nil, fmt.Errorf("invalid freeze %d start date %q, expected YYYY-MM-DD", i+1, freeze.Start)
+		}
+		if freeze.End == "" {
+			policy.FreezeDates[i].End = freeze.Start
+		} else if _, err := time.Parse("2006-01-02", freeze.End); err != nil {
+			return nil, fmt.Errorf("invalid freeze %d end date %q, expected YYYY-MM-DD", i+1, freeze.End)
+		}
+	}
+
+	return policy, nil
+}
+
+// unmarshalOptionalJSON reads a JSON field that may be left empty
+func unmarshalOptionalJSON(record *models.Record, field string, target any) error {
+	if raw := record.GetString(field); raw == "" || raw == "null" {
+		return nil
+	}
+	if err := record.UnmarshalJSONField(field, target); err != nil {
+		return fmt.Errorf("invalid %s: %v", field, err)
+	}
+	return nil
+}
+
+// Evaluate reports whether a scan may run at the given time and, depending
+// on the answer, when it may start or when it has to stop
+func (p *ScanPolicy) Evaluate(at time.Time) PolicyDecision {
+	reason := p.blockedReason(at)
+	if reason == "" {
+		decision := PolicyDecision{Allowed: true, Reason: "inside the allowed scan windows"}
+		for t := p.nextBoundary(at); t.Sub(at) <= policyLookahead; t = p.nextBoundary(t) {
+			if p.blockedReason(t) != "" {
+				decision.ClosesAt = t
+				break
+			}
+		}
+		return decision
+	}
+
+	decision := PolicyDecision{Reason: reason}
+	for t := p.nextBoundary(at); t.Sub(at) <= policyLookahead; t = p.nextBoundary(t) {
+		if p.blockedReason(t) == "" {
+			decision.NextAllowed = t
+			break
+		}
+	}
+	return decision
+}
+
+// nextBoundary returns the first time after t at which the policy's answer
+// may change: the next start or end of a window, the next midnight, where
+// the day of the week and the freeze dates change, or the next change of the
+// timezone's UTC offset, which moves the wall clock the windows are set in.
+// Up to that change the wall clock has t's offset, so the candidates are
+// built in it; a wall time that occurs twice is then not resolved to its
+// second occurrence.
+func (p *ScanPolicy) nextBoundary(t time.Time) time.Time {
+	local := t.In(p.Location)
+	year, month, day := local.Date()
+	_, offset := local.Zone()
+	zone := time.FixedZone("", offset)
+
+	next := time.Date(year, month, day+1, 0, 0, 0, 0, zone)
+	if _, zoneEnd := local.ZoneBounds(); !zoneEnd.IsZero() && zoneEnd.Before(next) {
+		next = zoneEnd
+	}
+
+	for _, windows := range [][]ScanWindow{p.AllowedWindows, p.BlockedWindows} {
+		for _, window := range windows {
+			for _, minute := range []int{window.start, window.end} {
+				candidate := time.Date(year, month, day, minute/60, minute%60, 0, 0, zone)
+				if candidate.After(t) && candidate.Before(next) {
+					next = candidate
+				}
+			}
+		}
+	}
+	return next
+}
+
+// blockedReason returns why a scan may not run at the given time, or an
+// empty string when it may
+func (p *ScanPolicy) blockedReason(at time.Time) string {
+	local := at.In(p.Location)
+
+	date := local.Format("2006-01-02")
+	for _, freeze := range p.FreezeDates {
+		if date >= freeze.Start && date <= freeze.End {
+			if freeze.Reason != "" {
+				return fmt.Sprintf("change freeze from %s to %s (%s)", freeze.Start, freeze.End, freeze.Reason)
+			}
+			return fmt.Sprintf("change freeze from %s to %s", freeze.Start, freeze.End)
+		}
+	}
+
+	for _, window := range p.BlockedWindows {
+		if window.contains(local) {
+			return fmt.Sprintf("inside blocked window %s", window)
+		}
+	}
+
+	if len(p.AllowedWindows) == 0 {
+		return ""
+	}
+	for _, window := range p.AllowedWindows {
+		if window.contains(local) {
+			return ""
+		}
+	}
+	return "outside the allowed scan windows"
+}
+
+// parse validates the window and caches its days and times
+func (w *ScanWindow) parse() error {
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start time %q, expected HH:MM", w.Start)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return fmt.Errorf("invalid end time %q, expected HH:MM", w.End)
+	}
+	w.start = start.Hour()*60 + start.Minute()
+	w.end = end.Hour()*60 + end.Minute()
+
+	w.days = make(map[time.Weekday]bool)
+	for _, day := range w.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("invalid day %q", day)
+		}
+		w.days[weekday] = true
+	}
+	return nil
+}
+
+// contains reports whether a time, already in the policy's timezone, is inside the window
+func (w ScanWindow) contains(local time.Time) bool {
+	minute := local.Hour()*60 + local.Minute()
+	today := w.onDay(local.Weekday())
+
+	if w.start < w.end {
+		return today && minute >= w.start && minute < w.end
+	}
+
+	// The window runs past midnight, so its tail belongs to the previous day
+	yesterday := w.onDay((local.Weekday() + 6) % 7)
+	return (today && minute >= w.start) || (yesterday && minute < w.end)
+}
+
+func (w ScanWindow) onDay(day time.Weekday) bool {
+	return len(w.days) == 0 || w.days[day]
+}
+
+// String describes the window for decision logs
+func (w ScanWindow) String() string {
+	if len(w.Days) == 0 {
+		return fmt.Sprintf("%s-%s daily", w.Start, w.End)
+	}
+	return fmt.Sprintf("%s-%s on %s", w.Start, w.End, strings.Join(w.Days, ", "))
+}
+
+// RecordPolicyDecision logs a policy decision on a scan
+func RecordPolicyDecision(app *pocketbase.PocketBase, scanID string, policy *ScanPolicy, decision, source, reason string, nextAllowed time.Time) error {
+	collection, err := app.Dao().FindCollectionByNameOrId("scan_policy_decisions")
+	if err != nil {
+		return fmt.Errorf("failed to find scan_policy_decisions collection: %v", err)
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("scan", scanID)
+	record.Set("policy", policy.ID)
+	record.Set("source", source)
+	record.Set("decision", decision)
+	record.Set("reason", reason)
+	if !nextAllowed.IsZero() {
+		record.Set("next_allowed", nextAllowed)
+	}
+
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return fmt.Errorf("failed to save policy decision: %v", err)
+	}
+	return nil
+}
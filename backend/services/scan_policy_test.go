@@ -0,0 +1,253 @@
+package services
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testPolicy builds a policy in the named timezone with its windows parsed
+func testPolicy(t *testing.T, timezone string, allowed, blocked []ScanWindow, freezes []FreezePeriod) *ScanPolicy {
+	t.Helper()
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &ScanPolicy{
+		Location:       location,
+		AllowedWindows: allowed,
+		BlockedWindows: blocked,
+		FreezeDates:    freezes,
+	}
+	for _, windows := range [][]ScanWindow{policy.AllowedWindows, policy.BlockedWindows} {
+		for i := range windows {
+			if err := windows[i].parse(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i, freeze := range policy.FreezeDates {
+		if freeze.End == "" {
+			policy.FreezeDates[i].End = freeze.Start
+		}
+	}
+	return policy
+}
+
+func TestScanPolicyEvaluate(t *testing.T) {
+	tests := []struct {
+		name        string
+		timezone    string
+		allowed     []ScanWindow
+		blocked     []ScanWindow
+		freezes     []FreezePeriod
+		at          string // RFC3339
+		allowedNow  bool
+		nextAllowed string // RFC3339, empty when zero
+		closesAt    string // RFC3339, empty when zero
+	}{
+		{
+			name:       "inside a window past midnight",
+			timezone:   "Europe/Berlin",
+			allowed:    []ScanWindow{{Days: []string{"friday"}, Start: "22:00", End: "06:00"}},
+			at:         "2026-10-17T03:00:00+02:00", // Saturday
+			allowedNow: true,
+			closesAt:   "2026-10-17T06:00:00+02:00",
+		},
+		{
+			name:        "before a window past midnight",
+			timezone:    "Europe/Berlin",
+			allowed:     []ScanWindow{{Days: []string{"friday"}, Start: "22:00", End: "06:00"}},
+			at:          "2026-10-15T23:00:00+02:00", // Thursday
+			nextAllowed: "2026-10-16T22:00:00+02:00",
+		},
+		{
+			name:        "after a window past midnight",
+			timezone:    "Europe/Berlin",
+			allowed:     []ScanWindow{{Days: []string{"friday"}, Start: "22:00", End: "06:00"}},
+			at:          "2026-10-17T07:00:00+02:00", // Saturday
+			nextAllowed: "2026-10-23T22:00:00+02:00",
+		},
+		{
+			name:       "blocked window past midnight",
+			timezone:   "UTC",
+			blocked:    []ScanWindow{{Start: "23:00", End: "01:00"}},
+			at:         "2026-10-16T12:00:00Z",
+			allowedNow: true,
+			closesAt:   "2026-10-16T23:00:00Z",
+		},
+		{
+			name:        "window start skipped by the spring forward",
+			timezone:    "America/New_York",
+			allowed:     []ScanWindow{{Start: "02:00", End: "04:00"}},
+			at:          "2026-03-08T01:30:00-05:00",
+			nextAllowed: "2026-03-08T03:00:00-04:00",
+		},
+		{
+			name:       "window shortened by the spring forward",
+			timezone:   "America/New_York",
+			allowed:    []ScanWindow{{Start: "01:00", End: "04:00"}},
+			at:         "2026-03-08T01:30:00-05:00",
+			allowedNow: true,
+			closesAt:   "2026-03-08T04:00:00-04:00",
+		},
+		{
+			name:        "window repeated by the fall back",
+			timezone:    "America/New_York",
+			allowed:     []ScanWindow{{Start: "01:00", End: "01:30"}},
+			at:          "2026-11-01T01:45:00-04:00",
+			nextAllowed: "2026-11-01T01:00:00-05:00",
+		},
+		{
+			name:     "blocked window ending in the repeated hour",
+			timezone: "Europe/Berlin",
+			blocked:  []ScanWindow{{Start: "00:00", End: "02:00"}},
+			at:       "2026-10-25T01:45:00+02:00",
+			// The first 02:00, before the clocks go back to 02:00 again
+			nextAllowed: "2026-10-25T02:00:00+02:00",
+		},
+		{
+			name:       "day before a freeze",
+			timezone:   "Europe/Berlin",
+			freezes:    []FreezePeriod{{Start: "2026-12-24", End: "2026-12-26", Reason: "holidays"}},
+			at:         "2026-12-23T12:00:00+01:00",
+			allowedNow: true,
+			closesAt:   "2026-12-24T00:00:00+01:00",
+		},
+		{
+			name:        "last day of a freeze",
+			timezone:    "Europe/Berlin",
+			freezes:     []FreezePeriod{{Start: "2026-12-24", End: "2026-12-26"}},
+			at:          "2026-12-26T23:59:00+01:00",
+			nextAllowed: "2026-12-27T00:00:00+01:00",
+		},
+		{
+			name:        "single day freeze on a window",
+			timezone:    "UTC",
+			allowed:     []ScanWindow{{Start: "09:00", End: "17:00"}},
+			freezes:     []FreezePeriod{{Start: "2026-10-16"}},
+			at:          "2026-10-16T10:00:00Z",
+			nextAllowed: "2026-10-17T09:00:00Z",
+		},
+		{
+			name:     "nothing allowed within the lookahead",
+			timezone: "UTC",
+			freezes:  []FreezePeriod{{Start: "2026-10-01", End: "2026-12-31"}},
+			at:       "2026-10-16T10:00:00Z",
+		},
+	}
+
+	parse := func(t *testing.T, value string) time.Time {
+		if value == "" {
+			return time.Time{}
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := testPolicy(t, tt.timezone, tt.allowed, tt.blocked, tt.freezes)
+			decision := policy.Evaluate(parse(t, tt.at))
+
+			if decision.Allowed != tt.allowedNow {
+				t.Errorf("Allowed = %v, want %v (%s)", decision.Allowed, tt.allowedNow, decision.Reason)
+			}
+			if want := parse(t, tt.nextAllowed); !decision.NextAllowed.Equal(want) {
+				t.Errorf("NextAllowed = %v, want %v", decision.NextAllowed, want)
+			}
+			if want := parse(t, tt.closesAt); !decision.ClosesAt.Equal(want) {
+				t.Errorf("ClosesAt = %v, want %v", decision.ClosesAt, want)
+			}
+		})
+	}
+}
+
+// TestScanPolicyEvaluateMatchesMinuteSearch checks the boundaries Evaluate
+// jumps between against trying every minute of the lookahead
+func TestScanPolicyEvaluateMatchesMinuteSearch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("searches every minute of the lookahead")
+	}
+
+	random := rand.New(rand.NewSource(1))
+	timezones := []string{"UTC", "Europe/Berlin", "America/New_York", "Australia/Lord_Howe"}
+	dayNames := []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+	// Window edges are on the hour or half past, often within a few hours of
+	// the wall clock at the evaluated time, so they fall on the offset changes
+	randomMinute := func(near int) int {
+		if random.Intn(2) == 0 {
+			return random.Intn(48) * 30
+		}
+		return ((near/30+random.Intn(9)-4)*30 + 24*60) % (24 * 60)
+	}
+	randomWindows := func(max, near int) []ScanWindow {
+		windows := make([]ScanWindow, random.Intn(max+1))
+		for i := range windows {
+			start, end := randomMinute(near), randomMinute(near)
+			windows[i] = ScanWindow{
+				Start: fmt.Sprintf("%02d:%02d", start/60, start%60),
+				End:   fmt.Sprintf("%02d:%02d", end/60, end%60),
+			}
+			for _, day := range dayNames {
+				if random.Intn(3) == 0 {
+					windows[i].Days = append(windows[i].Days, day)
+				}
+			}
+		}
+		return windows
+	}
+
+	for i := 0; i < 300; i++ {
+		location, err := time.LoadLocation(timezones[random.Intn(len(timezones))])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Mostly around the next change of the zone's UTC offset
+		at := time.Date(2026, time.Month(1+random.Intn(12)), 1+random.Intn(28), 0, 0, 0, 0, location)
+		if _, zoneEnd := at.ZoneBounds(); !zoneEnd.IsZero() && random.Intn(4) != 0 {
+			at = zoneEnd
+		}
+		at = at.Add(time.Duration(random.Intn(48*60)-24*60) * time.Minute).Add(time.Duration(random.Intn(60)) * time.Second)
+
+		var freezes []FreezePeriod
+		if random.Intn(2) == 0 {
+			first := at.AddDate(0, 0, random.Intn(5)-1)
+			freezes = append(freezes, FreezePeriod{
+				Start: first.Format("2006-01-02"),
+				End:   first.AddDate(0, 0, random.Intn(4)).Format("2006-01-02"),
+			})
+		}
+		local := at.In(location)
+		near := local.Hour()*60 + local.Minute()
+		policy := testPolicy(t, location.String(), randomWindows(3, near), randomWindows(2, near), freezes)
+
+		// The first minute after at whose answer differs from at's
+		allowed := policy.blockedReason(at) == ""
+		var change time.Time
+		for m := at.Truncate(time.Minute).Add(time.Minute); m.Sub(at) <= policyLookahead; m = m.Add(time.Minute) {
+			if (policy.blockedReason(m) == "") != allowed {
+				change = m
+				break
+			}
+		}
+
+		decision := policy.Evaluate(at)
+		got := decision.NextAllowed
+		if allowed {
+			got = decision.ClosesAt
+		}
+		if decision.Allowed != allowed || !got.Equal(change) {
+			t.Errorf("case %d: %s in %s, allowed %v %+v %+v %+v: got allowed %v until %v, want %v",
+				i, at, policy.Location, allowed, policy.AllowedWindows, policy.BlockedWindows, policy.FreezeDates,
+				decision.Allowed, got, change)
+		}
+	}
+}
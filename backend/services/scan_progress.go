@@ -0,0 +1,144 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/daos"
+
+	"bitor/scan/lifecycle"
+)
+
+// NucleiProgress is the latest progress snapshot of a running nuclei scan,
+// built from the JSON stats nuclei prints with -stats -sj
+type NucleiProgress struct {
+	Requests   int64   `json:"requests"`
+	Total      int64   `json:"total"`
+	RPS        float64 `json:"rps"`
+	Errors     int64   `json:"errors"`
+	Matched    int64   `json:"matched"`
+	Hosts      int64   `json:"hosts"`
+	Templates  int64   `json:"templates"`
+	Percent    float64 `json:"percent"`
+	Duration   string  `json:"duration,omitempty"`
+	StartedAt  string  `json:"started_at,omitempty"`
+	ETASeconds int64   `json:"eta_seconds"`
+	ReportedAt string  `json:"reported_at"`
+}
+
+// ParseNucleiStats converts a nuclei stats line into a progress snapshot.
+// Depending on the version, nuclei reports counters as strings or numbers,
+// so both are accepted.
+func ParseNucleiStats(stats map[string]interface{}) (*NucleiProgress, error) {
+	progress := &NucleiProgress{
+		Duration:   statString(stats, "duration"),
+		StartedAt:  statString(stats, "startedAt"),
+		ReportedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	var err error
+	if progress.Requests, err = statInt(stats, "requests"); err != nil {
+		return nil, err
+	}
+	if progress.Total, err = statInt(stats, "total"); err != nil {
+		return nil, err
+	}
+	if progress.RPS, err = statFloat(stats, "rps"); err != nil {
+		return nil, err
+	}
+	if progress.Errors, err = statInt(stats, "errors"); err != nil {
+		return nil, err
+	}
+	if progress.Matched, err = statInt(stats, "matched"); err != nil {
+		return nil, err
+	}
+	if progress.Hosts, err = statInt(stats, "hosts"); err != nil {
+		return nil, err
+	}
+	if progress.Templates, err = statInt(stats, "templates"); err != nil {
+		return nil, err
+	}
+	if progress.Percent, err = statFloat(stats, "percent"); err != nil {
+		return nil, err
+	}
+
+	// Older nuclei versions don't report a percentage
+	if progress.Percent == 0 && progress.Total > 0 {
+		progress.Percent = math.Round(float64(progress.Requests)*10000/float64(progress.Total)) / 100
+	}
+
+	if progress.RPS > 0 && progress.Total > progress.Requests {
+		progress.ETASeconds = int64(float64(progress.Total-progress.Requests) / progress.RPS)
+	}
+
+	return progress, nil
+}
+
+// ErrScanNotRunning is returned when saving the progress of a scan that is no longer running
+var ErrScanNotRunning = errors.New("scan is no longer running")
+
+// SaveScanProgress stores the snapshot on the scan while it is running.
+// The status is checked in the same transaction as the save, so a report
+// racing a status change can't write the old status back. Saving the record
+// broadcasts the change to PocketBase realtime subscribers of the scan.
+func SaveScanProgress(app *pocketbase.PocketBase, scanID string, progress *NucleiProgress) error {
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		record, err := txDao.FindRecordById("nuclei_scans", scanID)
+		if err != nil {
+			return fmt.Errorf("failed to find scan: %v", err)
+		}
+
+		// A reporter that outlives nuclei must not overwrite the final snapshot
+		if !lifecycle.IsActive(record.GetString("status")) {
+			return ErrScanNotRunning
+		}
+
+		record.Set("nuclei_progress", progress)
+		if err := txDao.SaveRecord(record); err != nil {
+			return fmt.Errorf("failed to save scan progress: %v", err)
+		}
+		return nil
+	})
+}
+
+func statString(stats map[string]interface{}, key string) string {
+	if value, ok := stats[key].(string); ok {
+		return value
+	}
+	return ""
+}
+
+func statFloat(stats map[string]interface{}, key string) (float64, error) {
+	switch value := stats[key].(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return value, nil
+	case json.Number:
+		return value.Float64()
+	case string:
+		if value == "" {
+			return 0, nil
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %q", key, value)
+		}
+		return parsed, nil
+	default:
+		return 0, fmt.Errorf("invalid %s: %v", key, value)
+	}
+}
+
+func statInt(stats map[string]interface{}, key string) (int64, error) {
+	value, err := statFloat(stats, key)
+	if err != nil {
+		return 0, err
+	}
+	return int64(value), nil
+}
@@ -0,0 +1,537 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	pbModels "github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"bitor/scan/lifecycle"
+)
+
+// Scan job states stored in the scan_jobs collection
+const (
+	ScanJobQueued    = "queued"
+	ScanJobRunning   = "running"
+	ScanJobDone      = "done"
+	ScanJobFailed    = "failed"
+	ScanJobCancelled = "cancelled"
+)
+
+// Scan job sources
+const (
+	ScanJobSourceManual    = "manual"
+	ScanJobSourceScheduled = "scheduled"
+	ScanJobSourceRetry     = "retry"
+)
+
+// ErrScanJobActive is returned when a scan already has a queued or running job
+var ErrScanJobActive = errors.New("scan already has an active job")
+
+// ScanJobRunner runs a single scan job to completion
+type ScanJobRunner func(ctx context.Context, job *ScanJob) error
+
+// ScanJob is handed to the runner for the job being executed
+type ScanJob struct {
+	ID          string
+	ScanID      string
+	Source      string
+	Attempt     int
+	RequestedBy string
+	queue       *ScanQueue
+}
+
+// SetPhase records the current pipeline phase on the job record
+func (j *ScanJob) SetPhase(phase string) {
+	record, err := j.queue.app.Dao().FindRecordById("scan_jobs", j.ID)
+	if err != nil {
+		j.queue.logger.Printf("Failed to find job %s to set phase: %v", j.ID, err)
+		return
+	}
+
+	record.Set("phase", phase)
+	if err := j.queue.app.Dao().SaveRecord(record); err != nil {
+		j.queue.logger.Printf("Failed to set phase %s on job %s: %v", phase, j.ID, err)
+	}
+}
+
+// ScanJobStatus is the API view of a scan job
+type ScanJobStatus struct {
+	ID         string `json:"id"`
+	ScanID     string `json:"scan_id"`
+	Status     string `json:"status"`
+	Phase      string `json:"phase"`
+	Source     string `json:"source"`
+	Attempt    int    `json:"attempt"`
+	Position   int    `json:"position"`
+	Error      string `json:"error,omitempty"`
+	RetryOf    string `json:"retry_of,omitempty"`
+	Created    string `json:"created"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	NotBefore  string `json:"not_before,omitempty"`
+	NotAfter   string `json:"not_after,omitempty"`
+}
+
+// ScanQueue is a persistent queue of scan jobs backed by the scan_jobs collection.
+// Workers pick up queued jobs in creation order while honoring the
+// scan_concurrency value from system_settings.
+type ScanQueue struct {
+	app     *pocketbase.PocketBase
+	runner  ScanJobRunner
+	logger  *log.Logger
+	running map[string]context.CancelFunc
+	mutex   sync.Mutex
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+// NewScanQueue creates a new scan queue that executes jobs with the given runner
+func NewScanQueue(app *pocketbase.PocketBase, runner ScanJobRunner) *ScanQueue {
+	return &ScanQueue{
+		app:     app,
+		runner:  runner,
+		logger:  log.New(log.Writer(), "[ScanQueue] ", log.LstdFlags),
+		running: make(map[string]context.CancelFunc),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start recovers jobs interrupted by a restart and starts dispatching queued jobs
+func (q *ScanQueue) Start() {
+	q.recoverInterruptedJobs()
+	go q.loop()
+	q.notify()
+	q.logger.Printf("Scan queue started with concurrency %d", q.Concurrency())
+}
+
+// Stop stops dispatching new jobs and cancels the running ones
+func (q *ScanQueue) Stop() {
+	close(q.stop)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, cancel := range q.running {
+		cancel()
+	}
+}
+
+// Enqueue adds a scan to the queue and returns the job record
+func (q *ScanQueue) Enqueue(scanID, source, requestedBy string) (*pbModels.Record, error) {
+	return q.enqueue(scanID, source, requestedBy, "", 1, time.Time{}, time.Time{})
+}
+
+// EnqueueWithin adds a scan to the queue that must start before notAfter.
+// A job still queued at that time is cancelled instead of started.
+func (q *ScanQueue) EnqueueWithin(scanID, source, requestedBy string, notAfter time.Time) (*pbModels.Record, error) {
+	return q.enqueue(scanID, source, requestedBy, "", 1, time.Time{}, notAfter)
+}
+
+// EnqueueAt adds a scan to the queue that isn't started before notBefore.
+// A zero notAfter leaves the job queued until it can start.
+func (q *ScanQueue) EnqueueAt(scanID, source, requestedBy string, notBefore, notAfter time.Time) (*pbModels.Record, error) {
+	return q.enqueue(scanID, source, requestedBy, "", 1, notBefore, notAfter)
+}
+
+// Retry enqueues a new attempt of a finished or failed job
+func (q *ScanQueue) Retry(jobID, requestedBy string) (*pbModels.Record, error) {
+	previous, err := q.app.Dao().FindRecordById("scan_jobs", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find job: %v", err)
+	}
+
+	status := previous.GetString("status")
+	if status == ScanJobQueued || status == ScanJobRunning {
+		return nil, ErrScanJobActive
+	}
+
+	return q.enqueue(previous.GetString("scan"), ScanJobSourceRetry, requestedBy, previous.Id, previous.GetInt("attempt")+1, time.Time{}, time.Time{})
+}
+
+func (q *ScanQueue) enqueue(scanID, source, requestedBy, retryOf string, attempt int, notBefore, notAfter time.Time) (*pbModels.Record, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	active, err := q.ActiveJobForScan(scanID)
+	if err != nil {
+		return nil, err
+	}
+	if active != nil {
+		return active, ErrScanJobActive
+	}
+
+	collection, err := q.app.Dao().FindCollectionByNameOrId("scan_jobs")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scan_jobs collection: %v", err)
+	}
+
+	record := pbModels.NewRecord(collection)
+	record.Set("scan", scanID)
+	record.Set("status", ScanJobQueued)
+	record.Set("phase", "queued")
+	record.Set("source", source)
+	record.Set("attempt", attempt)
+	record.Set("retry_of", retryOf)
+	record.Set("requested_by", requestedBy)
+	if !notBefore.IsZero() {
+		record.Set("not_before", notBefore)
+	}
+	if !notAfter.IsZero() {
+		record.Set("not_after", notAfter)
+	}
+
+	if err := q.app.Dao().SaveRecord(record); err != nil {
+		return nil, fmt.Errorf("failed to save scan job: %v", err)
+	}
+
+	q.logger.Printf("Enqueued job %s for scan %s (source: %s, attempt: %d)", record.Id, scanID, source, attempt)
+	q.notify()
+
+	return record, nil
+}
+
+// CancelScan stops the jobs of a scan that is being stopped. Queued jobs,
+// including those deferred to a later time, are cancelled so they never
+// start, and the context of a running job is cancelled so the runner stops
+// before starting its next step. It reports whether a job was cancelled.
+func (q *ScanQueue) CancelScan(scanID string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	cancelled := false
+
+	queued, err := q.app.Dao().FindRecordsByFilter(
+		"scan_jobs",
+		"scan = {:scan} && status = {:queued}",
+		"created",
+		0,
+		0,
+		dbx.Params{"scan": scanID, "queued": ScanJobQueued},
+	)
+	if err != nil {
+		q.logger.Printf("Failed to find queued jobs for scan %s: %v", scanID, err)
+	}
+	for _, record := range queued {
+		record.Set("status", ScanJobCancelled)
+		record.Set("error", "scan was stopped before the job started")
+		record.Set("finished_at", time.Now())
+		if err := q.app.Dao().SaveRecord(record); err != nil {
+			q.logger.Printf("Failed to cancel queued job %s: %v", record.Id, err)
+			continue
+		}
+		q.logger.Printf("Cancelled queued job %s for scan %s", record.Id, scanID)
+		cancelled = true
+	}
+
+	running, err := findActiveScanJob(q.app, scanID, ScanJobRunning)
+	if err != nil || running == nil {
+		return cancelled
+	}
+	if cancel, ok := q.running[running.Id]; ok {
+		cancel()
+		q.logger.Printf("Cancelled running job %s for scan %s", running.Id, scanID)
+		cancelled = true
+	}
+	return cancelled
+}
+
+// ActiveJobForScan returns the queued or running job for a scan, or nil if there is none
+func (q *ScanQueue) ActiveJobForScan(scanID string) (*pbModels.Record, error) {
+	return findActiveScanJob(q.app, scanID, ScanJobQueued, ScanJobRunning)
+}
+
+// findActiveScanJob returns the oldest job of a scan in one of the given
+// statuses, or nil if there is none
+func findActiveScanJob(app *pocketbase.PocketBase, scanID string, statuses ...string) (*pbModels.Record, error) {
+	params := dbx.Params{"scan": scanID}
+	conditions := make([]string, 0, len(statuses))
+	for i, status := range statuses {
+		name := fmt.Sprintf("status%d", i)
+		params[name] = status
+		conditions = append(conditions, fmt.Sprintf("status = {:%s}", name))
+	}
+
+	records, err := app.Dao().FindRecordsByFilter(
+		"scan_jobs",
+		fmt.Sprintf("scan = {:scan} && (%s)", strings.Join(conditions, " || ")),
+		"created",
+		1,
+		0,
+		params,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scan jobs: %v", err)
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	return records[0], nil
+}
+
+// GetJobStatus returns the status of a job including its position in the queue
+func (q *ScanQueue) GetJobStatus(jobID string) (*ScanJobStatus, error) {
+	record, err := q.app.Dao().FindRecordById("scan_jobs", jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ScanJobStatus{
+		ID:      record.Id,
+		ScanID:  record.GetString("scan"),
+		Status:  record.GetString("status"),
+		Phase:   record.GetString("phase"),
+		Source:  record.GetString("source"),
+		Attempt: record.GetInt("attempt"),
+		Error:   record.GetString("error"),
+		RetryOf: record.GetString("retry_of"),
+		Created: record.GetDateTime("created").String(),
+	}
+
+	if startedAt := record.GetDateTime("started_at"); !startedAt.IsZero() {
+		status.StartedAt = startedAt.String()
+	}
+	if finishedAt := record.GetDateTime("finished_at"); !finishedAt.IsZero() {
+		status.FinishedAt = finishedAt.String()
+	}
+	if notBefore := record.GetDateTime("not_before"); !notBefore.IsZero() {
+		status.NotBefore = notBefore.String()
+	}
+	if notAfter := record.GetDateTime("not_after"); !notAfter.IsZero() {
+		status.NotAfter = notAfter.String()
+	}
+
+	if status.Status == ScanJobQueued {
+		ahead, err := q.app.Dao().FindRecordsByFilter(
+			"scan_jobs",
+			"status = {:queued} && created < {:created}",
+			"",
+			0,
+			0,
+			dbx.Params{
+				"queued":  ScanJobQueued,
+				"created": record.GetDateTime("created").String(),
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute queue position: %v", err)
+		}
+		status.Position = len(ahead) + 1
+	}
+
+	return status, nil
+}
+
+// Concurrency returns the number of scans allowed to run at the same time,
+// from generating their playbooks until they finish on their VMs
+func (q *ScanQueue) Concurrency() int {
+	settings, err := q.app.Dao().FindFirstRecordByFilter("system_settings", "id != ''")
+	if err != nil {
+		return 1
+	}
+
+	concurrency := settings.GetInt("scan_concurrency")
+	if concurrency < 1 {
+		return 1
+	}
+
+	return concurrency
+}
+
+// activeScansWithoutJob counts the scans generating, deploying or running
+// that no running job accounts for, mostly scans whose job ended after the
+// deploy. Shards run as part of their scan and aren't counted.
+func (q *ScanQueue) activeScansWithoutJob() (int, error) {
+	var count int
+	err := q.app.Dao().DB().NewQuery(`
+		SELECT COUNT(*) FROM nuclei_scans
+		WHERE shard_of = ''
+		AND status IN ({:generating}, {:deploying}, {:running})
+		AND id NOT IN (SELECT scan FROM scan_jobs WHERE status = {:jobRunning})
+	`).Bind(dbx.Params{
+		"generating": lifecycle.StatusGenerating,
+		"deploying":  lifecycle.StatusDeploying,
+		"running":    lifecycle.StatusRunning,
+		"jobRunning": ScanJobRunning,
+	}).Row(&count)
+	return count, err
+}
+
+// notify wakes the dispatch loop without blocking
+func (q *ScanQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *ScanQueue) loop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+
+		q.dispatch()
+	}
+}
+
+// dispatch starts as many queued jobs as the concurrency limit allows
+func (q *ScanQueue) dispatch() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// A job ends once its scan is deployed, so the scans still running on
+	// their VMs count against the limit too
+	deployed, err := q.activeScansWithoutJob()
+	if err != nil {
+		q.logger.Printf("Failed to count active scans: %v", err)
+		return
+	}
+	free := q.Concurrency() - len(q.running) - deployed
+	if free <= 0 {
+		return
+	}
+
+	// Deferred jobs wait in the queue until their not_before time
+	records, err := q.app.Dao().FindRecordsByFilter(
+		"scan_jobs",
+		"status = {:queued} && (not_before = '' || not_before <= {:now})",
+		"created",
+		free,
+		0,
+		dbx.Params{
+			"queued": ScanJobQueued,
+			"now":    types.NowDateTime().String(),
+		},
+	)
+	if err != nil {
+		q.logger.Printf("Failed to fetch queued jobs: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		// Drop jobs whose start window closed while they waited
+		if notAfter := record.GetDateTime("not_after"); !notAfter.IsZero() && notAfter.Time().Before(time.Now()) {
+			record.Set("status", ScanJobCancelled)
+			record.Set("error", "allowed start window closed before the job could start")
+			record.Set("finished_at", time.Now())
+			if err := q.app.Dao().SaveRecord(record); err != nil {
+				q.logger.Printf("Failed to cancel expired job %s: %v", record.Id, err)
+			} else {
+				q.logger.Printf("Cancelled job %s for scan %s: start window closed", record.Id, record.GetString("scan"))
+			}
+			continue
+		}
+
+		record.Set("status", ScanJobRunning)
+		record.Set("started_at", time.Now())
+		if err := q.app.Dao().SaveRecord(record); err != nil {
+			q.logger.Printf("Failed to mark job %s as running: %v", record.Id, err)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		q.running[record.Id] = cancel
+
+		job := &ScanJob{
+			ID:          record.Id,
+			ScanID:      record.GetString("scan"),
+			Source:      record.GetString("source"),
+			Attempt:     record.GetInt("attempt"),
+			RequestedBy: record.GetString("requested_by"),
+			queue:       q,
+		}
+
+		go q.execute(ctx, job)
+	}
+}
+
+// execute runs a job and stores its outcome
+func (q *ScanQueue) execute(ctx context.Context, job *ScanJob) {
+	q.logger.Printf("Running job %s for scan %s", job.ID, job.ScanID)
+
+	err := q.runJob(ctx, job)
+
+	q.mutex.Lock()
+	if cancel, ok := q.running[job.ID]; ok {
+		cancel()
+		delete(q.running, job.ID)
+	}
+	q.mutex.Unlock()
+
+	record, findErr := q.app.Dao().FindRecordById("scan_jobs", job.ID)
+	if findErr != nil {
+		q.logger.Printf("Failed to find job %s after run: %v", job.ID, findErr)
+	} else {
+		record.Set("finished_at", time.Now())
+		if err != nil {
+			q.logger.Printf("Job %s for scan %s failed: %v", job.ID, job.ScanID, err)
+			record.Set("status", ScanJobFailed)
+			record.Set("error", err.Error())
+		} else {
+			q.logger.Printf("Job %s for scan %s completed", job.ID, job.ScanID)
+			record.Set("status", ScanJobDone)
+			record.Set("phase", "deployed")
+		}
+		if saveErr := q.app.Dao().SaveRecord(record); saveErr != nil {
+			q.logger.Printf("Failed to save job %s result: %v", job.ID, saveErr)
+		}
+	}
+
+	q.notify()
+}
+
+// runJob calls the runner and turns a panic into a job failure
+func (q *ScanQueue) runJob(ctx context.Context, job *ScanJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return q.runner(ctx, job)
+}
+
+// recoverInterruptedJobs fails jobs that were running when the process stopped.
+// Queued jobs are left untouched and will be picked up by the workers.
+func (q *ScanQueue) recoverInterruptedJobs() {
+	records, err := q.app.Dao().FindRecordsByFilter(
+		"scan_jobs",
+		"status = {:running}",
+		"created",
+		0,
+		0,
+		dbx.Params{"running": ScanJobRunning},
+	)
+	if err != nil {
+		q.logger.Printf("Failed to find interrupted jobs: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		record.Set("status", ScanJobFailed)
+		record.Set("error", "interrupted by restart")
+		record.Set("finished_at", time.Now())
+		if err := q.app.Dao().SaveRecord(record); err != nil {
+			q.logger.Printf("Failed to mark job %s as interrupted: %v", record.Id, err)
+			continue
+		}
+		q.logger.Printf("Marked job %s for scan %s as interrupted", record.Id, record.GetString("scan"))
+	}
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/dbx"
+
+	"bitor/scan/lifecycle"
+)
+
+func TestCancelScanCancelsDeferredJob(t *testing.T) {
+	app := newTestApp(t)
+	scanID := createTestScan(t, app, lifecycle.StatusCreated, false, 0)
+
+	dispatched := make(chan string, 1)
+	queue := NewScanQueue(app, func(ctx context.Context, job *ScanJob) error {
+		dispatched <- job.ScanID
+		return nil
+	})
+	queue.logger = log.New(io.Discard, "", 0)
+
+	job, err := queue.EnqueueAt(scanID, ScanJobSourceScheduled, "tester", time.Now().Add(time.Hour), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !queue.CancelScan(scanID) {
+		t.Error("CancelScan reported no cancelled job")
+	}
+
+	// The deferred start time passes
+	_, err = app.Dao().DB().NewQuery("UPDATE scan_jobs SET not_before = {:past} WHERE id = {:id}").Bind(dbx.Params{
+		"past": time.Now().Add(-time.Minute).UTC().Format("2006-01-02 15:04:05.000Z"),
+		"id":   job.Id,
+	}).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.dispatch()
+
+	select {
+	case <-dispatched:
+		t.Fatal("job of a stopped scan was dispatched")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	record, err := app.Dao().FindRecordById("scan_jobs", job.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := record.GetString("status"); status != ScanJobCancelled {
+		t.Errorf("job status = %s, want %s", status, ScanJobCancelled)
+	}
+	if record.GetDateTime("finished_at").IsZero() {
+		t.Error("cancelled job has no finished_at")
+	}
+	if record.GetString("error") == "" {
+		t.Error("cancelled job has no reason")
+	}
+}
@@ -0,0 +1,363 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+	"bitor/scan/utils"
+	"bitor/services/notification"
+)
+
+// Actions taken by the reconciler for a scan
+const (
+	ReconcileActionResumed   = "resumed"
+	ReconcileActionFailed    = "failed"
+	ReconcileActionDestroyed = "destroyed"
+)
+
+// ActorReconciler is recorded on the transitions made by the reconciler
+const ActorReconciler = "reconciler"
+
+// vmProbeTimeout is how long the reconciler waits for a VM to accept an SSH connection
+const vmProbeTimeout = 5 * time.Second
+
+// ReconcileResult describes what the reconciler did with one scan
+type ReconcileResult struct {
+	ScanID   string `json:"scan_id"`
+	ScanName string `json:"scan_name"`
+	Status   string `json:"status"`
+	Action   string `json:"action"`
+	Detail   string `json:"detail"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ReconcileReport is the outcome of a reconciliation run
+type ReconcileReport struct {
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Results    []ReconcileResult `json:"results"`
+}
+
+// ScanReconciler revisits scans left mid-lifecycle by a restart. Scans whose
+// VM still answers keep running, the rest are cleaned up and marked failed.
+type ScanReconciler struct {
+	app                 *pocketbase.PocketBase
+	ansibleBasePath     string
+	notificationService *notification.NotificationService
+	logger              *log.Logger
+	lastReport          *ReconcileReport
+	mutex               sync.RWMutex
+}
+
+// NewScanReconciler creates a new scan reconciler
+func NewScanReconciler(app *pocketbase.PocketBase, ansibleBasePath string, notificationService *notification.NotificationService) *ScanReconciler {
+	return &ScanReconciler{
+		app:                 app,
+		ansibleBasePath:     ansibleBasePath,
+		notificationService: notificationService,
+		logger:              log.New(log.Writer(), "[ScanReconciler] ", log.LstdFlags),
+	}
+}
+
+// LastReport returns the report of the most recent run, or nil if none has completed
+func (r *ScanReconciler) LastReport() *ReconcileReport {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.lastReport
+}
+
+// Run reconciles every scan in a non-terminal status and sends the report to admins
+func (r *ScanReconciler) Run(ctx context.Context) (*ReconcileReport, error) {
+	report := &ReconcileReport{
+		StartedAt: time.Now(),
+		Results:   make([]ReconcileResult, 0),
+	}
+
+	scans, err := r.app.Dao().FindRecordsByFilter(
+		"nuclei_scans",
+		"shard_of = '' && (status = {:started} || status = {:generating} || status = {:deploying} || status = {:running} || status = {:stopping})",
+		"created",
+		0,
+		0,
+		dbx.Params{
+			"started":    lifecycle.StatusStarted,
+			"generating": lifecycle.StatusGenerating,
+			"deploying":  lifecycle.StatusDeploying,
+			"running":    lifecycle.StatusRunning,
+			"stopping":   lifecycle.StatusStopping,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find unfinished scans: %v", err)
+	}
+
+	r.logger.Printf("Found %d unfinished scans to reconcile", len(scans))
+
+	for _, scan := range scans {
+		// A queued job starts the scan itself once the queue runs
+		if job, err := findActiveScanJob(r.app, scan.Id, ScanJobQueued); err != nil {
+			r.logger.Printf("Failed to check the jobs of scan %s: %v", scan.Id, err)
+		} else if job != nil {
+			r.logger.Printf("Scan %s has queued job %s, leaving it to the scan queue", scan.Id, job.Id)
+			continue
+		}
+
+		// Shards are reconciled together with the scan they belong to
+		var results []ReconcileResult
+		if scan.GetInt("shard_count") > 0 {
+			results = r.reconcileShardedScan(ctx, scan)
+		} else {
+			results = []ReconcileResult{r.reconcileScan(ctx, scan)}
+		}
+
+		for _, result := range results {
+			if result.Error != "" {
+				r.logger.Printf("Scan %s (%s): %s - %s, error: %s", result.ScanID, result.Status, result.Action, result.Detail, result.Error)
+			} else {
+				r.logger.Printf("Scan %s (%s): %s - %s", result.ScanID, result.Status, result.Action, result.Detail)
+			}
+			report.Results = append(report.Results, result)
+		}
+	}
+
+	report.FinishedAt = time.Now()
+
+	r.mutex.Lock()
+	r.lastReport = report
+	r.mutex.Unlock()
+
+	r.notifyAdmins(ctx, report)
+
+	return report, nil
+}
+
+// reconcileScan decides what to do with a single scan from what is left on disk
+// and whether its VM still answers
+func (r *ScanReconciler) reconcileScan(ctx context.Context, scan *models.Record) ReconcileResult {
+	status := scan.GetString("status")
+	result := ReconcileResult{
+		ScanID:   scan.Id,
+		ScanName: scan.GetString("name"),
+		Status:   status,
+	}
+
+	scanDir := filepath.Join(r.ansibleBasePath, "scans", scan.Id)
+	hasState := r.hasTerraformState(scanDir)
+	vmIP := readInventoryHost(filepath.Join(scanDir, "inventory", "inventory"))
+
+	// Nothing was provisioned, so there is nothing to clean up
+	if !hasState && vmIP == "" {
+		next := lifecycle.StatusFailed
+		if status == lifecycle.StatusStopping {
+			next = lifecycle.StatusStopped
+		}
+		result.Action = ReconcileActionFailed
+		result.Detail = "interrupted by a restart before a VM was provisioned"
+		if scan.GetString("execution_mode") == "local" {
+			result.Detail = "local nuclei process was interrupted by a restart"
+		}
+		r.transition(scan.Id, next, result.Detail, &result)
+		return result
+	}
+
+	// A running scan whose VM still answers reports back on its own
+	if status == lifecycle.StatusRunning && vmIP != "" && vmAnswers(vmIP) {
+		result.Action = ReconcileActionResumed
+		result.Detail = fmt.Sprintf("VM %s is still reachable, monitoring resumed", vmIP)
+		return result
+	}
+
+	switch {
+	case status == lifecycle.StatusStopping:
+		result.Detail = "stop was interrupted by a restart"
+	case vmIP == "":
+		result.Detail = "interrupted by a restart before the inventory was written"
+	case status == lifecycle.StatusRunning:
+		result.Detail = fmt.Sprintf("VM %s no longer answers", vmIP)
+	default:
+		result.Detail = fmt.Sprintf("deployment was interrupted by a restart while %s", status)
+	}
+
+	if err := r.destroy(ctx, scan.Id, scanDir); err != nil {
+		// Leave the resources to the admin rather than dropping track of them
+		result.Action = ReconcileActionFailed
+		result.Error = err.Error()
+		r.transition(scan.Id, lifecycle.StatusFailed, fmt.Sprintf("%s; destroy failed: %v", result.Detail, err), &result)
+		return result
+	}
+
+	next := lifecycle.StatusFailed
+	if status == lifecycle.StatusStopping {
+		next = lifecycle.StatusStopped
+	}
+	result.Action = ReconcileActionDestroyed
+	r.transition(scan.Id, next, result.Detail+"; VM destroyed", &result, func(record *models.Record) {
+		record.Set("destroyed", true)
+		record.Set("vm_stop_time", time.Now().Format(time.RFC3339))
+	})
+	return result
+}
+
+// reconcileShardedScan reconciles a scan split across several VMs. A running
+// scan keeps the shards whose VM still answers. A scan interrupted while
+// deploying or stopping its shards has the VMs of all of them destroyed.
+func (r *ScanReconciler) reconcileShardedScan(ctx context.Context, scan *models.Record) []ReconcileResult {
+	status := scan.GetString("status")
+	result := ReconcileResult{
+		ScanID:   scan.Id,
+		ScanName: scan.GetString("name"),
+		Status:   status,
+	}
+
+	shards, err := FindScanShards(r.app, scan.Id)
+	if err != nil {
+		result.Action = ReconcileActionFailed
+		result.Error = err.Error()
+		return []ReconcileResult{result}
+	}
+
+	results := make([]ReconcileResult, 0, len(shards)+1)
+
+	if status == lifecycle.StatusRunning {
+		for _, shard := range shards {
+			if lifecycle.IsActive(shard.GetString("status")) {
+				results = append(results, r.reconcileScan(ctx, shard))
+			}
+		}
+		SettleShardedScan(r.app, r.ansibleBasePath, scan.Id)
+
+		result.Action = ReconcileActionResumed
+		result.Detail = fmt.Sprintf("%d shards reconciled", len(results))
+		return append(results, result)
+	}
+
+	// Shards left stopping have nobody left to finish the job
+	for _, shard := range shards {
+		if shard.GetString("status") == lifecycle.StatusStopping {
+			results = append(results, r.reconcileScan(ctx, shard))
+		}
+	}
+
+	result.Detail = fmt.Sprintf("interrupted by a restart while %s", status)
+	if err := TearDownShards(ctx, r.app, r.ansibleBasePath, scan.Id, ActorReconciler, result.Detail); err != nil {
+		result.Action = ReconcileActionFailed
+		result.Error = err.Error()
+		r.transition(scan.Id, lifecycle.StatusFailed, fmt.Sprintf("%s; destroy failed: %v", result.Detail, err), &result)
+		return append(results, result)
+	}
+
+	next := lifecycle.StatusFailed
+	if status == lifecycle.StatusStopping {
+		next = lifecycle.StatusStopped
+	}
+	result.Action = ReconcileActionDestroyed
+	r.transition(scan.Id, next, result.Detail+"; shard VMs destroyed", &result)
+	return append(results, result)
+}
+
+// transition moves the scan to a new status, recording any failure on the result
+func (r *ScanReconciler) transition(scanID, to, reason string, result *ReconcileResult, updates ...func(record *models.Record)) {
+	if _, err := lifecycle.Transition(r.app, scanID, to, ActorReconciler, reason, updates...); err != nil {
+		if result.Error != "" {
+			result.Error += "; "
+		}
+		result.Error += fmt.Sprintf("failed to update status: %v", err)
+	}
+}
+
+// destroy runs the scan's destroy playbook
+func (r *ScanReconciler) destroy(ctx context.Context, scanID, scanDir string) error {
+	playbookPath := filepath.Join(scanDir, "destroy.yml")
+	if _, err := os.Stat(playbookPath); err != nil {
+		return fmt.Errorf("destroy playbook not found: %v", err)
+	}
+
+	return utils.ExecuteAnsiblePlaybookContext(
+		ctx,
+		playbookPath,
+		filepath.Join(scanDir, "logs"),
+		filepath.Join(scanDir, "scan.yaml"),
+		filepath.Join(scanDir, "inventory"),
+		r.ansibleBasePath,
+		r.app,
+		scanID,
+	)
+}
+
+// hasTerraformState reports whether terraform has been initialised for the
+// scan. State itself lives in the S3 backend, so the local .terraform
+// directory is the sign that resources may exist.
+func (r *ScanReconciler) hasTerraformState(scanDir string) bool {
+	for _, path := range []string{
+		filepath.Join(scanDir, "terraform", ".terraform"),
+		filepath.Join(scanDir, "terraform", "terraform.tfstate"),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readInventoryHost returns the ansible_host written to the inventory by terraform
+func readInventoryHost(inventoryFile string) string {
+	file, err := os.Open(inventoryFile)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		for _, field := range strings.Fields(scanner.Text()) {
+			if host, ok := strings.CutPrefix(field, "ansible_host="); ok && host != "" {
+				return host
+			}
+		}
+	}
+	return ""
+}
+
+// vmAnswers reports whether the VM accepts SSH connections
+func vmAnswers(host string) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, "22"), vmProbeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// notifyAdmins sends a summary of the actions taken, if there were any
+func (r *ScanReconciler) notifyAdmins(ctx context.Context, report *ReconcileReport) {
+	if r.notificationService == nil || len(report.Results) == 0 {
+		return
+	}
+
+	var message strings.Builder
+	message.WriteString(fmt.Sprintf("Bitor reconciled %d scans left unfinished by a restart:\n", len(report.Results)))
+	for _, result := range report.Results {
+		message.WriteString(fmt.Sprintf("- %s (ID: %s, was %s): %s - %s", result.ScanName, result.ScanID, result.Status, result.Action, result.Detail))
+		if result.Error != "" {
+			message.WriteString(fmt.Sprintf(" (error: %s)", result.Error))
+		}
+		message.WriteString("\n")
+	}
+
+	if err := r.notificationService.Notify(ctx, "Scan Reconciliation Report", message.String()); err != nil {
+		r.logger.Printf("Failed to send reconciliation report: %v", err)
+	}
+}
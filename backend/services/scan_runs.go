@@ -0,0 +1,109 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+)
+
+// scanConfigFields are the nuclei_scans fields that describe what to scan and
+// where. Everything else (status, times, logs, cost, API key...) belongs to a
+// single run and starts empty on a new one.
+var scanConfigFields = []string{
+	"nuclei_profile",
+	"nuclei_targets",
+	"nuclei_interact",
+	"vm_provider",
+	"client",
+	"cron",
+	"state_bucket",
+	"scan_bucket",
+	"scan_profile",
+	"manual_targets",
+	"vm_size",
+	"created_by",
+	"preserve_vm",
+}
+
+// NewScanRun creates an unsaved nuclei_scans record with the configuration of
+// the given scan, so a scan can run again without overwriting the history of
+// the previous run
+func NewScanRun(app *pocketbase.PocketBase, source *models.Record, name string) (*models.Record, error) {
+	collection, err := app.Dao().FindCollectionByNameOrId("nuclei_scans")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find nuclei_scans collection: %v", err)
+	}
+
+	record := models.NewRecord(collection)
+	for _, field := range scanConfigFields {
+		record.Set(field, source.Get(field))
+	}
+	record.Set("name", name)
+
+	return record, nil
+}
+
+// CreateRerun creates and saves a new run of a scan's configuration. Reruns
+// point to the scan the configuration was first run as through parent_scan,
+// so every run of a configuration shares the same parent.
+func CreateRerun(app *pocketbase.PocketBase, source *models.Record, actor string) (*models.Record, error) {
+	original := source.GetString("parent_scan")
+	if original == "" {
+		original = source.Id
+	}
+
+	name := fmt.Sprintf("%s (%s)", originalScanName(app, source, original), time.Now().Format("2006-01-02 15:04"))
+	run, err := NewScanRun(app, source, name)
+	if err != nil {
+		return nil, err
+	}
+	run.Set("parent_scan", original)
+
+	if err := app.Dao().SaveRecord(run); err != nil {
+		return nil, fmt.Errorf("failed to save scan run: %v", err)
+	}
+
+	if _, err := lifecycle.Transition(app, run.Id, lifecycle.StatusCreated, actor, fmt.Sprintf("rerun of %s", source.Id)); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// FindScanRuns returns every run of a scan's configuration, newest first: the
+// original scan and all of its reruns
+func FindScanRuns(app *pocketbase.PocketBase, scan *models.Record) ([]*models.Record, error) {
+	original := scan.GetString("parent_scan")
+	if original == "" {
+		original = scan.Id
+	}
+
+	runs, err := app.Dao().FindRecordsByFilter(
+		"nuclei_scans",
+		"id = {:original} || parent_scan = {:original}",
+		"-created",
+		0,
+		0,
+		dbx.Params{"original": original},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scan runs: %v", err)
+	}
+	return runs, nil
+}
+
+// originalScanName returns the name of the original scan, so reruns of reruns
+// don't pile up timestamps in their names
+func originalScanName(app *pocketbase.PocketBase, source *models.Record, original string) string {
+	if original != source.Id {
+		if record, err := app.Dao().FindRecordById("nuclei_scans", original); err == nil {
+			return record.GetString("name")
+		}
+	}
+	return source.GetString("name")
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+)
+
+const (
+	// runtimeWatchdogInterval is how often running scans are checked against their profile's max runtime
+	runtimeWatchdogInterval = time.Minute
+	// ActorRuntimeWatchdog is recorded on transitions made by the runtime watchdog
+	ActorRuntimeWatchdog = "runtime_watchdog"
+)
+
+// ScanRuntimeWatchdog stops scans that have run longer than the max runtime
+// of their scan profile, so a hung nuclei process can't keep a VM alive
+type ScanRuntimeWatchdog struct {
+	app             *pocketbase.PocketBase
+	ansibleBasePath string
+	queue           *ScanQueue
+	logger          *log.Logger
+	stop            chan struct{}
+}
+
+// NewScanRuntimeWatchdog creates a new scan runtime watchdog
+func NewScanRuntimeWatchdog(app *pocketbase.PocketBase, ansibleBasePath string, queue *ScanQueue) *ScanRuntimeWatchdog {
+	return &ScanRuntimeWatchdog{
+		app:             app,
+		ansibleBasePath: ansibleBasePath,
+		queue:           queue,
+		logger:          log.New(log.Writer(), "[ScanRuntimeWatchdog] ", log.LstdFlags),
+		stop:            make(chan struct{}),
+	}
+}
+
+// Start checks running scans every minute until Stop is called
+func (w *ScanRuntimeWatchdog) Start() {
+	go func() {
+		ticker := time.NewTicker(runtimeWatchdogInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.Check(context.Background())
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic checks
+func (w *ScanRuntimeWatchdog) Stop() {
+	close(w.stop)
+}
+
+// Check times out every deploying or running scan that has been running for
+// longer than its profile's max runtime. Profiles without one aren't limited.
+func (w *ScanRuntimeWatchdog) Check(ctx context.Context) {
+	scans, err := w.app.Dao().FindRecordsByFilter(
+		"nuclei_scans",
+		"scan_profile != '' && shard_of = '' && (status = {:deploying} || status = {:running})",
+		"created",
+		0,
+		0,
+		dbx.Params{
+			"deploying": lifecycle.StatusDeploying,
+			"running":   lifecycle.StatusRunning,
+		},
+	)
+	if err != nil {
+		w.logger.Printf("Failed to find running scans: %v", err)
+		return
+	}
+
+	now := time.Now()
+	limits := make(map[string]time.Duration)
+	for _, scan := range scans {
+		profileID := scan.GetString("scan_profile")
+		limit, ok := limits[profileID]
+		if !ok {
+			profile, err := w.app.Dao().FindRecordById("scan_profiles", profileID)
+			if err != nil {
+				w.logger.Printf("Failed to find scan profile %s: %v", profileID, err)
+			} else {
+				limit = time.Duration(profile.GetInt("max_runtime")) * time.Minute
+			}
+			limits[profileID] = limit
+		}
+		if limit <= 0 {
+			continue
+		}
+
+		started, ok := runtimeStart(scan)
+		if !ok || now.Sub(started) <= limit {
+			continue
+		}
+
+		reason := fmt.Sprintf("max runtime of %d minutes exceeded after running for %s",
+			int(limit.Minutes()), now.Sub(started).Round(time.Minute))
+		w.logger.Printf("Timing out scan %s: %s", scan.Id, reason)
+
+		// Stop the queue worker first so it doesn't deploy a VM after the destroy
+		w.queue.CancelScan(scan.Id)
+		if err := TimeOutScan(ctx, w.app, w.ansibleBasePath, scan.Id, ActorRuntimeWatchdog, reason); err != nil {
+			w.logger.Printf("Failed to time out scan %s: %v", scan.Id, err)
+		}
+	}
+}
+
+// runtimeStart returns when a scan's runtime started counting: when its VM
+// started, or when nuclei started for local scans. Sharded scans have no VM
+// of their own and count from the start of the scan.
+func runtimeStart(scan *models.Record) (time.Time, bool) {
+	value := scan.GetString("vm_start_time")
+	if value == "" {
+		switch {
+		case scan.GetString("execution_mode") == "local":
+			value = scan.GetString("nuclei_start_time")
+		case scan.GetInt("shard_count") > 0:
+			value = scan.GetString("start_time")
+		}
+	}
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	started, err := parseScanTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return started, true
+}
@@ -0,0 +1,339 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+	"bitor/scan/utils"
+)
+
+// MaxScanShards is the largest number of VMs a single scan can be split across
+const MaxScanShards = 20
+
+// ShardStatus is the progress and cost of one shard of a scan
+type ShardStatus struct {
+	ScanID    string  `json:"scan_id"`
+	Name      string  `json:"name"`
+	Index     int     `json:"index"`
+	Status    string  `json:"status"`
+	Targets   int     `json:"targets"`
+	Cost      float64 `json:"cost"`
+	IPAddress string  `json:"ip_address"`
+	Destroyed bool    `json:"destroyed"`
+	StartTime string  `json:"start_time"`
+	EndTime   string  `json:"end_time"`
+}
+
+// ShardSummary is the combined progress and cost of a sharded scan
+type ShardSummary struct {
+	ScanID     string        `json:"scan_id"`
+	Status     string        `json:"status"`
+	ShardCount int           `json:"shard_count"`
+	Active     int           `json:"active"`
+	Finished   int           `json:"finished"`
+	Failed     int           `json:"failed"`
+	Stopped    int           `json:"stopped"`
+	Cost       float64       `json:"cost"`
+	Shards     []ShardStatus `json:"shards"`
+}
+
+// SplitTargets splits targets into at most n shards whose sizes differ by at
+// most one. Targets are dealt round-robin so hosts listed together end up on
+// different VMs. Fewer shards are returned when there are fewer targets than n.
+func SplitTargets(targets []string, n int) [][]string {
+	if n > len(targets) {
+		n = len(targets)
+	}
+	if n < 1 {
+		return nil
+	}
+
+	shards := make([][]string, n)
+	for i, target := range targets {
+		shards[i%n] = append(shards[i%n], target)
+	}
+	return shards
+}
+
+// NewScanShard creates and saves the scan record of one shard of a parent scan
+func NewScanShard(app *pocketbase.PocketBase, parent *models.Record, index, count, targets int) (*models.Record, error) {
+	name := fmt.Sprintf("%s [shard %d/%d]", parent.GetString("name"), index+1, count)
+	shard, err := NewScanRun(app, parent, name)
+	if err != nil {
+		return nil, err
+	}
+	shard.Set("shard_of", parent.Id)
+	shard.Set("shard_index", index)
+	shard.Set("target_count", targets)
+	shard.Set("scheduled_scan", parent.GetString("scheduled_scan"))
+
+	if err := app.Dao().SaveRecord(shard); err != nil {
+		return nil, fmt.Errorf("failed to save scan shard: %v", err)
+	}
+	return shard, nil
+}
+
+// FindScanShards returns the shards of a scan in shard order
+func FindScanShards(app *pocketbase.PocketBase, parentID string) ([]*models.Record, error) {
+	shards, err := app.Dao().FindRecordsByFilter("nuclei_scans", "shard_of = {:parent}", "shard_index", 0, 0, dbx.Params{"parent": parentID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scan shards: %v", err)
+	}
+	return shards, nil
+}
+
+// GetShardSummary returns the per-shard progress and the total cost of a sharded scan
+func GetShardSummary(app *pocketbase.PocketBase, parentID string) (*ShardSummary, error) {
+	parent, err := app.Dao().FindRecordById("nuclei_scans", parentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scan: %v", err)
+	}
+
+	shards, err := FindScanShards(app, parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ShardSummary{
+		ScanID:     parentID,
+		Status:     parent.GetString("status"),
+		ShardCount: len(shards),
+		Shards:     make([]ShardStatus, 0, len(shards)),
+	}
+	for _, shard := range shards {
+		status := shard.GetString("status")
+		switch {
+		case lifecycle.IsActive(status) || status == lifecycle.StatusCreated:
+			summary.Active++
+		case status == lifecycle.StatusFinished || status == lifecycle.StatusDestroyed:
+			summary.Finished++
+		case status == lifecycle.StatusFailed:
+			summary.Failed++
+		case status == lifecycle.StatusStopped:
+			summary.Stopped++
+		}
+		summary.Cost += shard.GetFloat("cost")
+
+		summary.Shards = append(summary.Shards, ShardStatus{
+			ScanID:    shard.Id,
+			Name:      shard.GetString("name"),
+			Index:     shard.GetInt("shard_index"),
+			Status:    status,
+			Targets:   shard.GetInt("target_count"),
+			Cost:      shard.GetFloat("cost"),
+			IPAddress: shard.GetString("ip_address"),
+			Destroyed: shard.GetBool("destroyed"),
+			StartTime: shard.GetString("start_time"),
+			EndTime:   shard.GetString("end_time"),
+		})
+	}
+
+	return summary, nil
+}
+
+// TearDownShards destroys the VM of every shard of a scan. Active shards are
+// stopped, and shards that ended without destroying their VM have it
+// destroyed. A shard that fails to tear down doesn't stop the others; all
+// errors are returned together.
+func TearDownShards(ctx context.Context, app *pocketbase.PocketBase, ansibleBasePath, parentID, actor, reason string) error {
+	shards, err := FindScanShards(app, parentID)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(shards))
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard *models.Record) {
+			defer wg.Done()
+			if err := tearDownShard(ctx, app, ansibleBasePath, shard, actor, reason); err != nil {
+				errs[i] = fmt.Errorf("shard %d (%s): %v", shard.GetInt("shard_index")+1, shard.Id, err)
+			}
+		}(i, shard)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// tearDownShard makes sure a single shard no longer has a VM
+func tearDownShard(ctx context.Context, app *pocketbase.PocketBase, ansibleBasePath string, shard *models.Record, actor, reason string) error {
+	status := shard.GetString("status")
+
+	switch status {
+	case lifecycle.StatusStopping:
+		// Someone else is already stopping it
+		return nil
+	case lifecycle.StatusCreated, lifecycle.StatusStarted, lifecycle.StatusGenerating, lifecycle.StatusDeploying, lifecycle.StatusRunning:
+		err := StopScan(ctx, app, ansibleBasePath, shard.Id, actor, reason)
+		if errors.Is(err, lifecycle.ErrInvalidTransition) {
+			// The shard ended or started stopping since it was loaded
+			return nil
+		}
+		return err
+	}
+
+	if shard.GetBool("destroyed") {
+		return nil
+	}
+
+	scanDir := filepath.Join(ansibleBasePath, "scans", shard.Id)
+	playbookPath := filepath.Join(scanDir, "destroy.yml")
+	if _, err := os.Stat(playbookPath); err != nil {
+		// Nothing was generated, so nothing was deployed
+		return nil
+	}
+
+	if err := utils.ExecuteAnsiblePlaybookContext(
+		ctx,
+		playbookPath,
+		filepath.Join(scanDir, "logs"),
+		filepath.Join(scanDir, "scan.yaml"),
+		filepath.Join(scanDir, "inventory"),
+		ansibleBasePath,
+		app,
+		shard.Id,
+	); err != nil {
+		return fmt.Errorf("failed to run destroy playbook: %v", err)
+	}
+
+	record, err := app.Dao().FindRecordById("nuclei_scans", shard.Id)
+	if err != nil {
+		return fmt.Errorf("failed to find shard: %v", err)
+	}
+	record.Set("destroyed", true)
+	record.Set("vm_stop_time", time.Now().Format(time.RFC3339))
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return fmt.Errorf("failed to mark shard as destroyed: %v", err)
+	}
+	return nil
+}
+
+// shardSettleMutex keeps shards that finish together from both deciding the outcome of their scan
+var shardSettleMutex sync.Mutex
+
+// RegisterShardHooks keeps sharded scans in step with their shards by
+// settling the parent scan whenever a shard ends
+func RegisterShardHooks(app *pocketbase.PocketBase, ansibleBasePath string) {
+	lifecycle.OnTransition().Add(func(e *lifecycle.TransitionEvent) error {
+		parentID := e.Scan.GetString("shard_of")
+		if parentID == "" {
+			return nil
+		}
+
+		switch e.To {
+		case lifecycle.StatusFinished, lifecycle.StatusFailed, lifecycle.StatusStopped, lifecycle.StatusDestroyed:
+			// Settling may destroy VMs, which must not block the transition
+			go SettleShardedScan(app, ansibleBasePath, parentID)
+		}
+		return nil
+	})
+}
+
+// SettleShardedScan brings a running sharded scan in line with its shards.
+// The scan finishes once every shard has. A failed shard fails the scan and
+// the VMs of all shards are destroyed. Until then only the cost is updated.
+func SettleShardedScan(app *pocketbase.PocketBase, ansibleBasePath, parentID string) {
+	reason := settleShardedScan(app, parentID)
+	if reason == "" {
+		return
+	}
+
+	if err := TearDownShards(context.Background(), app, ansibleBasePath, parentID, lifecycle.ActorSystem, reason); err != nil {
+		log.Printf("[ScanShards] Failed to tear down shards of scan %s: %v", parentID, err)
+	}
+	updateShardedScanCost(app, parentID)
+}
+
+// settleShardedScan updates the status and cost of a sharded scan from its
+// shards. It returns why the scan failed when its shards must be torn down.
+func settleShardedScan(app *pocketbase.PocketBase, parentID string) string {
+	shardSettleMutex.Lock()
+	defer shardSettleMutex.Unlock()
+
+	parent, err := app.Dao().FindRecordById("nuclei_scans", parentID)
+	if err != nil {
+		log.Printf("[ScanShards] Failed to find sharded scan %s: %v", parentID, err)
+		return ""
+	}
+	// While the scan is deploying, its queue job handles failures; once it has
+	// ended there is nothing left to settle
+	if parent.GetString("status") != lifecycle.StatusRunning {
+		return ""
+	}
+
+	summary, err := GetShardSummary(app, parentID)
+	if err != nil {
+		log.Printf("[ScanShards] Failed to summarize shards of scan %s: %v", parentID, err)
+		return ""
+	}
+
+	switch {
+	case summary.Failed > 0:
+		reason := "a shard failed"
+		for _, shard := range summary.Shards {
+			if shard.Status == lifecycle.StatusFailed {
+				reason = fmt.Sprintf("shard %d failed", shard.Index+1)
+				break
+			}
+		}
+		// Failing the scan first keeps other shards from settling it again
+		if _, err := lifecycle.Transition(app, parentID, lifecycle.StatusFailed, lifecycle.ActorSystem, reason+", destroying all shard VMs"); err != nil {
+			log.Printf("[ScanShards] Failed to mark scan %s as failed: %v", parentID, err)
+			return ""
+		}
+		return reason
+
+	case summary.Active == 0:
+		next := lifecycle.StatusFinished
+		reason := fmt.Sprintf("all %d shards finished", summary.ShardCount)
+		if summary.Stopped > 0 {
+			next = lifecycle.StatusStopped
+			reason = fmt.Sprintf("%d of %d shards were stopped", summary.Stopped, summary.ShardCount)
+		}
+		if _, err := lifecycle.Transition(app, parentID, next, lifecycle.ActorSystem, reason, func(record *models.Record) {
+			record.Set("cost", summary.Cost)
+			record.Set("end_time", time.Now().Format(time.RFC3339))
+		}); err != nil {
+			log.Printf("[ScanShards] Failed to complete scan %s: %v", parentID, err)
+		}
+
+	default:
+		parent.Set("cost", summary.Cost)
+		if err := app.Dao().SaveRecord(parent); err != nil {
+			log.Printf("[ScanShards] Failed to update cost of scan %s: %v", parentID, err)
+		}
+	}
+	return ""
+}
+
+// updateShardedScanCost sets the cost of a sharded scan to the sum of its shards' costs
+func updateShardedScanCost(app *pocketbase.PocketBase, parentID string) {
+	summary, err := GetShardSummary(app, parentID)
+	if err != nil {
+		log.Printf("[ScanShards] Failed to summarize shards of scan %s: %v", parentID, err)
+		return
+	}
+
+	parent, err := app.Dao().FindRecordById("nuclei_scans", parentID)
+	if err != nil {
+		log.Printf("[ScanShards] Failed to find sharded scan %s: %v", parentID, err)
+		return
+	}
+	parent.Set("cost", summary.Cost)
+	if err := app.Dao().SaveRecord(parent); err != nil {
+		log.Printf("[ScanShards] Failed to update cost of scan %s: %v", parentID, err)
+	}
+}
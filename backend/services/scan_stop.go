@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+	"bitor/scan/utils"
+)
+
+// StopScan stops a scan on behalf of an actor. The scan is moved to Stopping,
+// its final cost is recorded, the destroy playbook is run if the scan got far
+// enough to have one, and the scan ends up Stopped. A scan that can't be
+// stopped from its current status returns lifecycle.ErrInvalidTransition.
+func StopScan(ctx context.Context, app *pocketbase.PocketBase, ansibleBasePath, scanID, actor, reason string) error {
+	return stopScan(ctx, app, ansibleBasePath, scanID, actor, reason, lifecycle.StatusStopped, "stop request")
+}
+
+// TimeOutScan stops a scan that ran past its profile's maximum runtime the
+// same way StopScan does, but leaves it Timed out instead of Stopped.
+// Findings already imported from the scan are kept.
+func TimeOutScan(ctx context.Context, app *pocketbase.PocketBase, ansibleBasePath, scanID, actor, reason string) error {
+	return stopScan(ctx, app, ansibleBasePath, scanID, actor, reason, lifecycle.StatusTimedOut, reason)
+}
+
+// stopScan destroys a scan's VMs and moves it to finalStatus. trigger says
+// why the VMs were destroyed in the reason of the final transition.
+func stopScan(ctx context.Context, app *pocketbase.PocketBase, ansibleBasePath, scanID, actor, reason, finalStatus, trigger string) error {
+	event, err := lifecycle.Transition(app, scanID, lifecycle.StatusStopping, actor, reason)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		// Another stop is already in progress
+		return fmt.Errorf("%w: scan is already stopping", lifecycle.ErrInvalidTransition)
+	}
+
+	// Reload the scan so the fields saved below don't overwrite the new status
+	record, err := app.Dao().FindRecordById("nuclei_scans", scanID)
+	if err != nil {
+		return fmt.Errorf("failed to find scan: %v", err)
+	}
+
+	endTime := time.Now()
+	record.Set("end_time", endTime.Format(time.RFC3339))
+
+	// A sharded scan has no VM of its own; its cost is that of its shards
+	if record.GetInt("shard_count") > 0 {
+		if err := TearDownShards(ctx, app, ansibleBasePath, scanID, actor, reason); err != nil {
+			if _, transitionErr := lifecycle.Transition(app, scanID, lifecycle.StatusFailed, actor, fmt.Sprintf("failed to destroy shard VMs: %v", err)); transitionErr != nil {
+				log.Printf("Failed to mark scan %s as failed: %v", scanID, transitionErr)
+			}
+			return fmt.Errorf("failed to stop shards: %v", err)
+		}
+		summary, err := GetShardSummary(app, scanID)
+		if err != nil {
+			return err
+		}
+		record.Set("cost", summary.Cost)
+	} else if record.GetFloat("cost") == 0 && record.GetString("execution_mode") != "local" {
+		// Calculate and set the final cost if not already set
+		if cost, err := finalScanCost(app, record, endTime); err != nil {
+			log.Printf("Failed to calculate final cost of scan %s: %v", scanID, err)
+		} else if cost > 0 {
+			record.Set("cost", cost)
+		}
+	}
+
+	// Scans stopped before the generate step have nothing to destroy
+	scanDir := filepath.Join(ansibleBasePath, "scans", scanID)
+	playbookPath := filepath.Join(scanDir, "destroy.yml")
+	stoppedReason := fmt.Sprintf("VM destroyed after %s", trigger)
+	if _, err := os.Stat(playbookPath); err == nil {
+		if err := utils.ExecuteAnsiblePlaybookContext(
+			ctx,
+			playbookPath,
+			filepath.Join(scanDir, "logs"),
+			filepath.Join(scanDir, "scan.yaml"),
+			filepath.Join(scanDir, "inventory"),
+			ansibleBasePath,
+			app,
+			scanID,
+		); err != nil {
+			return fmt.Errorf("failed to run destroy playbook: %v", err)
+		}
+		record.Set("destroyed", true)
+	} else if record.GetInt("shard_count") > 0 {
+		stoppedReason = fmt.Sprintf("shard VMs destroyed after %s", trigger)
+	} else if record.GetString("execution_mode") == "local" {
+		stoppedReason = "local nuclei process stopped"
+	} else {
+		stoppedReason = "stopped before a VM was deployed"
+	}
+
+	// Save the record with end time and cost
+	if err := app.Dao().SaveRecord(record); err != nil {
+		return fmt.Errorf("failed to update end time and cost: %v", err)
+	}
+
+	// The stop notification is sent by the lifecycle hook
+	if _, err := lifecycle.Transition(app, scanID, finalStatus, actor, stoppedReason); err != nil {
+		return fmt.Errorf("failed to update scan status to %s: %v", finalStatus, err)
+	}
+
+	return nil
+}
+
+// finalScanCost returns the cost of a scan's VM from its start time until endTime
+func finalScanCost(app *pocketbase.PocketBase, record *models.Record, endTime time.Time) (float64, error) {
+	vmSize := record.GetString("vm_size")
+	providerID := record.GetString("vm_provider")
+	if vmSize == "" || providerID == "" {
+		return 0, nil
+	}
+
+	startTime, err := parseScanTime(record.GetString("start_time"))
+	if err != nil {
+		log.Printf("Failed to parse start time: %v", err)
+		startTime = endTime
+	}
+
+	provider, err := app.Dao().FindRecordById("providers", providerID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find provider: %v", err)
+	}
+
+	region, err := ProviderRegion(provider)
+	if err != nil {
+		return 0, err
+	}
+
+	hourlyPrice, err := utils.GetVMPrice(app, providerID, region, vmSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get VM price: %v", err)
+	}
+
+	return endTime.Sub(startTime).Hours() * hourlyPrice, nil
+}
+
+// ProviderRegion returns the region set in a provider's settings
+func ProviderRegion(provider *models.Record) (string, error) {
+	var settings struct {
+		Region string `json:"region"`
+	}
+	settingsData := provider.Get("settings")
+	if settingsData == nil {
+		return "", fmt.Errorf("settings not found in provider")
+	}
+	settingsBytes, err := json.Marshal(settingsData)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal settings: %v", err)
+	}
+	if err := json.Unmarshal(settingsBytes, &settings); err != nil {
+		return "", fmt.Errorf("failed to unmarshal settings: %v", err)
+	}
+	if settings.Region == "" {
+		return "", fmt.Errorf("region not found in provider settings")
+	}
+	return settings.Region, nil
+}
+
+// parseScanTime parses the times saved on scans, which are RFC3339 strings,
+// PocketBase dates or the UTC times without a zone sent by the deploy playbook
+func parseScanTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04:05", value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02 15:04:05.000Z", value)
+}
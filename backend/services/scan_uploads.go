@@ -0,0 +1,326 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pocketbase/pocketbase"
+	pbModels "github.com/pocketbase/pocketbase/models"
+)
+
+// Scan upload states stored in the scan_uploads collection
+const (
+	ScanUploadUploading = "uploading"
+	ScanUploadComplete  = "complete"
+)
+
+// MaxScanUploadChunkSize bounds the size of a single chunk, which is hashed in memory
+const MaxScanUploadChunkSize = 64 * 1024 * 1024
+
+// MaxScanUploadChunks bounds the number of chunks of an upload, whose
+// received and missing chunks are listed in its status
+const MaxScanUploadChunks = 10000
+
+// defaultMaxScanUploadSize bounds the size of an uploaded file when
+// SCAN_UPLOAD_MAX_SIZE doesn't set it, since the file is allocated up front
+const defaultMaxScanUploadSize = 20 * 1024 * 1024 * 1024
+
+var (
+	// ErrScanUploadInvalidChunk is returned for a chunk whose offset or size doesn't fit the upload
+	ErrScanUploadInvalidChunk = errors.New("chunk doesn't fit the upload")
+	// ErrScanUploadChecksumMismatch is returned when a chunk or the whole file doesn't match its SHA-256
+	ErrScanUploadChecksumMismatch = errors.New("checksum mismatch")
+	// ErrScanUploadIncomplete is returned when completing an upload that still misses chunks
+	ErrScanUploadIncomplete = errors.New("upload is missing chunks")
+	// ErrScanUploadClosed is returned when writing to an upload that has already been completed
+	ErrScanUploadClosed = errors.New("upload is already complete")
+)
+
+// ScanUploadStatus is the API view of an upload session
+type ScanUploadStatus struct {
+	ID          string `json:"upload_id"`
+	ScanID      string `json:"scan_id"`
+	Status      string `json:"status"`
+	TotalSize   int64  `json:"total_size"`
+	ChunkSize   int64  `json:"chunk_size"`
+	TotalChunks int    `json:"total_chunks"`
+	Received    int    `json:"received"`
+	Missing     []int  `json:"missing"`
+}
+
+// ScanUploadService stores resumable, checksummed uploads of scan results.
+// Sessions live in the scan_uploads collection and chunks are written at
+// their offset in a file under the data directory, so an upload survives a
+// restart and chunks may arrive in any order or more than once.
+type ScanUploadService struct {
+	app   *pocketbase.PocketBase
+	locks sync.Map
+}
+
+// NewScanUploadService creates a new scan upload service
+func NewScanUploadService(app *pocketbase.PocketBase) *ScanUploadService {
+	return &ScanUploadService{app: app}
+}
+
+// Create opens an upload session for a scan's results file
+func (s *ScanUploadService) Create(scanID, clientID, createdBy string, totalSize, chunkSize int64, checksum string) (*ScanUploadStatus, error) {
+	if totalSize <= 0 {
+		return nil, fmt.Errorf("total_size must be positive")
+	}
+	if maxSize := maxScanUploadSize(); totalSize > maxSize {
+		return nil, fmt.Errorf("total_size must be at most %d bytes", maxSize)
+	}
+	if chunkSize <= 0 || chunkSize > MaxScanUploadChunkSize {
+		return nil, fmt.Errorf("chunk_size must be between 1 and %d bytes", MaxScanUploadChunkSize)
+	}
+	totalChunks := (totalSize + chunkSize - 1) / chunkSize
+	if totalChunks > MaxScanUploadChunks {
+		return nil, fmt.Errorf("upload can have at most %d chunks, use a chunk_size of at least %d bytes", MaxScanUploadChunks, (totalSize+MaxScanUploadChunks-1)/MaxScanUploadChunks)
+	}
+	if !isSHA256(checksum) {
+		return nil, fmt.Errorf("sha256 must be a hex encoded SHA-256")
+	}
+
+	collection, err := s.app.Dao().FindCollectionByNameOrId("scan_uploads")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find scan_uploads collection: %v", err)
+	}
+
+	record := pbModels.NewRecord(collection)
+	record.Set("scan", scanID)
+	record.Set("client", clientID)
+	record.Set("created_by", createdBy)
+	record.Set("total_size", totalSize)
+	record.Set("chunk_size", chunkSize)
+	record.Set("total_chunks", int(totalChunks))
+	record.Set("sha256", strings.ToLower(checksum))
+	record.Set("received_chunks", []int{})
+	record.Set("status", ScanUploadUploading)
+
+	if err := s.app.Dao().SaveRecord(record); err != nil {
+		return nil, fmt.Errorf("failed to save upload: %v", err)
+	}
+
+	if err := os.MkdirAll(s.dir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+	file, err := os.Create(s.FilePath(record.Id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %v", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(totalSize); err != nil {
+		return nil, fmt.Errorf("failed to allocate upload file: %v", err)
+	}
+
+	return uploadStatus(record), nil
+}
+
+// maxScanUploadSize returns the largest file that can be uploaded, in bytes
+func maxScanUploadSize() int64 {
+	if value := os.Getenv("SCAN_UPLOAD_MAX_SIZE"); value != "" {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > 0 {
+			return size
+		}
+		log.Printf("[ScanUploadService] Ignoring invalid SCAN_UPLOAD_MAX_SIZE %q", value)
+	}
+	return defaultMaxScanUploadSize
+}
+
+// Find returns an upload session
+func (s *ScanUploadService) Find(uploadID string) (*pbModels.Record, error) {
+	return s.app.Dao().FindRecordById("scan_uploads", uploadID)
+}
+
+// Status returns the state of an upload session, including the chunks it still misses
+func (s *ScanUploadService) Status(uploadID string) (*ScanUploadStatus, error) {
+	record, err := s.Find(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	return uploadStatus(record), nil
+}
+
+// WriteChunk writes the chunk starting at offset after checking it against
+// its SHA-256. Writing a chunk that was already received overwrites it with
+// the same bytes, so retries are safe.
+func (s *ScanUploadService) WriteChunk(uploadID string, offset int64, checksum string, data io.Reader) (*ScanUploadStatus, error) {
+	unlock := s.lock(uploadID)
+	defer unlock()
+
+	record, err := s.Find(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if record.GetString("status") != ScanUploadUploading {
+		return nil, ErrScanUploadClosed
+	}
+
+	totalSize := int64(record.GetInt("total_size"))
+	chunkSize := int64(record.GetInt("chunk_size"))
+	if offset < 0 || offset >= totalSize || offset%chunkSize != 0 {
+		return nil, fmt.Errorf("%w: offset %d", ErrScanUploadInvalidChunk, offset)
+	}
+	index := int(offset / chunkSize)
+
+	expected := chunkSize
+	if offset+expected > totalSize {
+		expected = totalSize - offset
+	}
+
+	chunk, err := io.ReadAll(io.LimitReader(data, expected+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %v", err)
+	}
+	if int64(len(chunk)) != expected {
+		return nil, fmt.Errorf("%w: chunk %d is %d bytes, expected %d", ErrScanUploadInvalidChunk, index, len(chunk), expected)
+	}
+
+	sum := sha256.Sum256(chunk)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(checksum) {
+		return nil, fmt.Errorf("%w: chunk %d", ErrScanUploadChecksumMismatch, index)
+	}
+
+	file, err := os.OpenFile(s.FilePath(record.Id), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(chunk, offset); err != nil {
+		return nil, fmt.Errorf("failed to write chunk: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to write chunk: %v", err)
+	}
+
+	received := receivedChunks(record)
+	if !received[index] {
+		indexes := make([]int, 0, len(received)+1)
+		for i := range received {
+			indexes = append(indexes, i)
+		}
+		indexes = append(indexes, index)
+		sort.Ints(indexes)
+		record.Set("received_chunks", indexes)
+		if err := s.app.Dao().SaveRecord(record); err != nil {
+			return nil, fmt.Errorf("failed to save upload: %v", err)
+		}
+	}
+
+	return uploadStatus(record), nil
+}
+
+// Complete checks that every chunk arrived and that the assembled file
+// matches the upload's SHA-256, passes the file to register and closes the
+// session once register succeeds. If register fails, the session stays open
+// and the file in place, so the upload can be completed again. After a
+// successful completion the caller owns the returned file; completing an
+// upload twice returns ErrScanUploadClosed.
+func (s *ScanUploadService) Complete(uploadID string, register func(upload *pbModels.Record, path string) error) (*pbModels.Record, string, error) {
+	unlock := s.lock(uploadID)
+	defer unlock()
+
+	record, err := s.Find(uploadID)
+	if err != nil {
+		return nil, "", err
+	}
+	if record.GetString("status") != ScanUploadUploading {
+		return nil, "", ErrScanUploadClosed
+	}
+
+	status := uploadStatus(record)
+	if len(status.Missing) > 0 {
+		return nil, "", fmt.Errorf("%w: %d of %d chunks missing", ErrScanUploadIncomplete, len(status.Missing), status.TotalChunks)
+	}
+
+	path := s.FilePath(record.Id)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open upload file: %v", err)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	file.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to hash upload file: %v", err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != record.GetString("sha256") {
+		return nil, "", ErrScanUploadChecksumMismatch
+	}
+
+	if err := register(record, path); err != nil {
+		return nil, "", err
+	}
+
+	record.Set("status", ScanUploadComplete)
+	if err := s.app.Dao().SaveRecord(record); err != nil {
+		return nil, "", fmt.Errorf("failed to save upload: %v", err)
+	}
+
+	return record, path, nil
+}
+
+// FilePath returns where the chunks of an upload are assembled
+func (s *ScanUploadService) FilePath(uploadID string) string {
+	return filepath.Join(s.dir(), uploadID+".part")
+}
+
+func (s *ScanUploadService) dir() string {
+	return filepath.Join(s.app.DataDir(), "scan_uploads")
+}
+
+// lock serializes the updates of one upload and returns the unlock func
+func (s *ScanUploadService) lock(uploadID string) func() {
+	lock, _ := s.locks.LoadOrStore(uploadID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+func uploadStatus(record *pbModels.Record) *ScanUploadStatus {
+	status := &ScanUploadStatus{
+		ID:          record.Id,
+		ScanID:      record.GetString("scan"),
+		Status:      record.GetString("status"),
+		TotalSize:   int64(record.GetInt("total_size")),
+		ChunkSize:   int64(record.GetInt("chunk_size")),
+		TotalChunks: record.GetInt("total_chunks"),
+		Missing:     []int{},
+	}
+
+	received := receivedChunks(record)
+	status.Received = len(received)
+	for index := 0; index < status.TotalChunks; index++ {
+		if !received[index] {
+			status.Missing = append(status.Missing, index)
+		}
+	}
+	return status
+}
+
+func receivedChunks(record *pbModels.Record) map[int]bool {
+	var indexes []int
+	if err := record.UnmarshalJSONField("received_chunks", &indexes); err != nil {
+		indexes = nil
+	}
+
+	received := make(map[int]bool, len(indexes))
+	for _, index := range indexes {
+		received[index] = true
+	}
+	return received
+}
+
+func isSHA256(checksum string) bool {
+	decoded, err := hex.DecodeString(checksum)
+	return err == nil && len(decoded) == sha256.Size
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+
+	"bitor/scan/lifecycle"
+)
+
+// scanWindowCheckInterval is how often running scans are checked against their client's policy
+const scanWindowCheckInterval = time.Minute
+
+// ScanWindowEnforcer stops scans that are still running when their client's
+// scan window closes
+type ScanWindowEnforcer struct {
+	app             *pocketbase.PocketBase
+	ansibleBasePath string
+	queue           *ScanQueue
+	logger          *log.Logger
+	stop            chan struct{}
+}
+
+// NewScanWindowEnforcer creates a new scan window enforcer
+func NewScanWindowEnforcer(app *pocketbase.PocketBase, ansibleBasePath string, queue *ScanQueue) *ScanWindowEnforcer {
+	return &ScanWindowEnforcer{
+		app:             app,
+		ansibleBasePath: ansibleBasePath,
+		queue:           queue,
+		logger:          log.New(log.Writer(), "[ScanWindowEnforcer] ", log.LstdFlags),
+		stop:            make(chan struct{}),
+	}
+}
+
+// Start checks running scans every minute until Stop is called
+func (e *ScanWindowEnforcer) Start() {
+	go func() {
+		ticker := time.NewTicker(scanWindowCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				e.Check(context.Background())
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic checks
+func (e *ScanWindowEnforcer) Stop() {
+	close(e.stop)
+}
+
+// Check stops every deploying or running scan whose client's policy no longer
+// allows it to run
+func (e *ScanWindowEnforcer) Check(ctx context.Context) {
+	scans, err := e.app.Dao().FindRecordsByFilter(
+		"nuclei_scans",
+		"client != '' && shard_of = '' && (status = {:generating} || status = {:deploying} || status = {:running})",
+		"created",
+		0,
+		0,
+		dbx.Params{
+			"generating": lifecycle.StatusGenerating,
+			"deploying":  lifecycle.StatusDeploying,
+			"running":    lifecycle.StatusRunning,
+		},
+	)
+	if err != nil {
+		e.logger.Printf("Failed to find running scans: %v", err)
+		return
+	}
+
+	now := time.Now()
+	policies := make(map[string]*ScanPolicy)
+	for _, scan := range scans {
+		clientID := scan.GetString("client")
+		policy, ok := policies[clientID]
+		if !ok {
+			policy, err = LoadScanPolicy(e.app, clientID)
+			if err != nil {
+				e.logger.Printf("Failed to load scan policy of client %s: %v", clientID, err)
+			}
+			policies[clientID] = policy
+		}
+		if policy == nil {
+			continue
+		}
+
+		decision := policy.Evaluate(now)
+		if decision.Allowed {
+			continue
+		}
+
+		reason := fmt.Sprintf("scan window closed: %s", decision.Reason)
+		e.logger.Printf("Stopping scan %s: %s", scan.Id, reason)
+		if err := RecordPolicyDecision(e.app, scan.Id, policy, PolicyDecisionStopped, ActorScanPolicy, reason, decision.NextAllowed); err != nil {
+			e.logger.Printf("Failed to record policy decision for scan %s: %v", scan.Id, err)
+		}
+
+		// Stop the queue worker first so it doesn't deploy a VM after the destroy
+		e.queue.CancelScan(scan.Id)
+		if err := StopScan(ctx, e.app, e.ansibleBasePath, scan.Id, ActorScanPolicy, reason); err != nil {
+			e.logger.Printf("Failed to stop scan %s: %v", scan.Id, err)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/providers/aws"
+	"bitor/providers/digitalocean"
+	"bitor/scan/lifecycle"
+	"bitor/services/notification"
+)
+
+// Actions the reaper takes on orphaned VMs, set in system_settings.orphaned_vm_action
+const (
+	OrphanedVMActionReport    = "report"
+	OrphanedVMActionTerminate = "terminate"
+)
+
+const (
+	// vmReaperInterval is how often the cloud providers are checked for orphaned VMs
+	vmReaperInterval = time.Hour
+	// vmReaperGracePeriod is how long the VM of an ended scan may take to go
+	// away before it counts as orphaned, so destroys in progress aren't reported
+	vmReaperGracePeriod = 30 * time.Minute
+)
+
+// CloudInstance is a VM found at a cloud provider that was created for a scan
+type CloudInstance struct {
+	ProviderID   string    `json:"provider_id"`
+	ProviderName string    `json:"provider_name"`
+	ProviderType string    `json:"provider_type"`
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	ScanID       string    `json:"scan_id"`
+	Region       string    `json:"region"`
+	Created      time.Time `json:"created"`
+}
+
+// CloudCompute lists and terminates the VMs Bitor created at one cloud
+// provider. The reaper only talks to providers through it, so it can be run
+// against fakes.
+type CloudCompute interface {
+	ListInstances(ctx context.Context) ([]CloudInstance, error)
+	TerminateInstance(ctx context.Context, instance CloudInstance) error
+}
+
+// OrphanedVM is a VM whose scan no longer accounts for it
+type OrphanedVM struct {
+	CloudInstance
+	Reason     string `json:"reason"`
+	Terminated bool   `json:"terminated"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ReapReport is the outcome of a reaper run
+type ReapReport struct {
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Action     string       `json:"action"`
+	Checked    int          `json:"checked"`
+	Orphans    []OrphanedVM `json:"orphans"`
+	Errors     []string     `json:"errors"`
+}
+
+// VMReaper finds VMs that outlived their scan, for example because the
+// destroy playbook failed or Bitor crashed, and reports or terminates them
+type VMReaper struct {
+	app                 *pocketbase.PocketBase
+	notificationService *notification.NotificationService
+	logger              *log.Logger
+	stop                chan struct{}
+	lastReport          *ReapReport
+	reported            map[string]bool
+	mutex               sync.Mutex
+}
+
+// NewVMReaper creates a new orphaned VM reaper
+func NewVMReaper(app *pocketbase.PocketBase, notificationService *notification.NotificationService) *VMReaper {
+	return &VMReaper{
+		app:                 app,
+		notificationService: notificationService,
+		logger:              log.New(log.Writer(), "[VMReaper] ", log.LstdFlags),
+		stop:                make(chan struct{}),
+		reported:            make(map[string]bool),
+	}
+}
+
+// Start checks the cloud providers every hour until Stop is called
+func (r *VMReaper) Start() {
+	go func() {
+		ticker := time.NewTicker(vmReaperInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.Check(context.Background(), "")
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic checks
+func (r *VMReaper) Stop() {
+	close(r.stop)
+}
+
+// LastReport returns the report of the most recent run, or nil if none has completed
+func (r *VMReaper) LastReport() *ReapReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lastReport
+}
+
+// Check looks for orphaned VMs at every compute provider. An empty action
+// uses the one set in the system settings, which defaults to report.
+func (r *VMReaper) Check(ctx context.Context, action string) *ReapReport {
+	if action == "" {
+		action = OrphanedVMActionReport
+		if settings, err := r.app.Dao().FindFirstRecordByFilter("system_settings", "id != ''"); err == nil && settings.GetString("orphaned_vm_action") != "" {
+			action = settings.GetString("orphaned_vm_action")
+		}
+	}
+
+	clouds, errs := r.providerClouds()
+	report := r.Reap(ctx, clouds, action)
+	report.Errors = append(errs, report.Errors...)
+
+	r.notifyAdmins(ctx, report)
+	return report
+}
+
+// Reap lists the VMs at each cloud, cross-checks them against their scans
+// and terminates the orphans if the action says so
+func (r *VMReaper) Reap(ctx context.Context, clouds []CloudCompute, action string) *ReapReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	report := &ReapReport{
+		StartedAt: time.Now(),
+		Action:    action,
+		Orphans:   []OrphanedVM{},
+		Errors:    []string{},
+	}
+
+	for _, cloud := range clouds {
+		instances, err := cloud.ListInstances(ctx)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		for _, instance := range instances {
+			report.Checked++
+
+			reason := r.orphanReason(instance, report.StartedAt)
+			if reason == "" {
+				continue
+			}
+
+			orphan := OrphanedVM{CloudInstance: instance, Reason: reason}
+			if action == OrphanedVMActionTerminate {
+				r.logger.Printf("Terminating orphaned VM %s (%s) of scan %s: %s", instance.ID, instance.ProviderName, instance.ScanID, reason)
+				if err := cloud.TerminateInstance(ctx, instance); err != nil {
+					orphan.Error = err.Error()
+				} else {
+					orphan.Terminated = true
+				}
+			} else {
+				r.logger.Printf("Found orphaned VM %s (%s) of scan %s: %s", instance.ID, instance.ProviderName, instance.ScanID, reason)
+			}
+			report.Orphans = append(report.Orphans, orphan)
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	r.lastReport = report
+	return report
+}
+
+// orphanReason returns why a VM is orphaned, or an empty string if its scan
+// still accounts for it. A VM is orphaned when it has no scan, when its scan
+// ended or was destroyed, since a failed destroy leaves the VM behind, or
+// when its scan has been stopping for longer than a destroy takes.
+func (r *VMReaper) orphanReason(instance CloudInstance, now time.Time) string {
+	if instance.ScanID == "" {
+		return "VM has no scan ID tag"
+	}
+
+	scan, err := r.app.Dao().FindRecordById("nuclei_scans", instance.ScanID)
+	if err != nil {
+		return "scan no longer exists"
+	}
+
+	status := scan.GetString("status")
+	destroyed := scan.GetBool("destroyed")
+	switch {
+	case status == lifecycle.StatusStopping:
+	case lifecycle.IsActive(status):
+		return ""
+	case !destroyed && !lifecycle.IsTerminal(status):
+		return ""
+	}
+	if now.Sub(scan.GetDateTime("updated").Time()) < vmReaperGracePeriod {
+		return ""
+	}
+
+	switch {
+	case status == lifecycle.StatusStopping:
+		return fmt.Sprintf("scan has been stopping for more than %s, its destroy likely failed", vmReaperGracePeriod)
+	case destroyed:
+		return fmt.Sprintf("scan is %s and its VM was recorded as destroyed", status)
+	default:
+		return fmt.Sprintf("scan is %s and its VM was not destroyed", status)
+	}
+}
+
+// providerClouds returns the clouds of the AWS and DigitalOcean providers used for compute
+func (r *VMReaper) providerClouds() ([]CloudCompute, []string) {
+	providers, err := r.app.Dao().FindRecordsByFilter(
+		"providers",
+		"provider_type = 'aws' || provider_type = 'digitalocean'",
+		"",
+		0,
+		0,
+	)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("failed to find providers: %v", err)}
+	}
+
+	var clouds []CloudCompute
+	var errs []string
+	for _, provider := range providers {
+		if !contains(provider.GetStringSlice("use"), "compute") {
+			continue
+		}
+
+		switch provider.GetString("provider_type") {
+		case "aws":
+			region, err := ProviderRegion(provider)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("provider %s: %v", provider.GetString("name"), err))
+				continue
+			}
+			clouds = append(clouds, &awsCompute{app: r.app, provider: provider, region: region})
+		case "digitalocean":
+			apiKey, err := digitalocean.GetAPIKey(r.app, provider)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("provider %s: %v", provider.GetString("name"), err))
+				continue
+			}
+			clouds = append(clouds, &digitalOceanCompute{provider: provider, apiKey: apiKey})
+		}
+	}
+
+	return clouds, errs
+}
+
+// notifyAdmins reports orphaned VMs that haven't been reported before
+func (r *VMReaper) notifyAdmins(ctx context.Context, report *ReapReport) {
+	if r.notificationService == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	var orphans []OrphanedVM
+	for _, orphan := range report.Orphans {
+		key := orphan.ProviderID + "/" + orphan.ID
+		if orphan.Terminated || !r.reported[key] {
+			orphans = append(orphans, orphan)
+		}
+		r.reported[key] = !orphan.Terminated
+	}
+	r.mutex.Unlock()
+
+	if len(orphans) == 0 {
+		return
+	}
+
+	var message strings.Builder
+	message.WriteString(fmt.Sprintf("Bitor found %d VMs that outlived their scans:\n", len(orphans)))
+	for _, orphan := range orphans {
+		message.WriteString(fmt.Sprintf("- %s %s (%s, scan %s): %s", orphan.ProviderName, orphan.ID, orphan.Name, orphan.ScanID, orphan.Reason))
+		switch {
+		case orphan.Terminated:
+			message.WriteString(" - terminated")
+		case orphan.Error != "":
+			message.WriteString(fmt.Sprintf(" - termination failed: %s", orphan.Error))
+		}
+		message.WriteString("\n")
+	}
+	if report.Action != OrphanedVMActionTerminate {
+		message.WriteString("Set the orphaned VM action to terminate in the system settings to remove them automatically.\n")
+	}
+
+	if err := r.notificationService.Notify(ctx, "Orphaned VMs Found", message.String()); err != nil {
+		r.logger.Printf("Failed to send orphaned VM report: %v", err)
+	}
+}
+
+// awsCompute is the CloudCompute of an AWS provider in its configured region
+type awsCompute struct {
+	app      *pocketbase.PocketBase
+	provider *models.Record
+	region   string
+}
+
+func (c *awsCompute) ListInstances(ctx context.Context) ([]CloudInstance, error) {
+	instances, err := aws.ListScanInstances(ctx, c.app, c.provider.Id, c.region)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s: %v", c.provider.GetString("name"), err)
+	}
+
+	result := make([]CloudInstance, 0, len(instances))
+	for _, instance := range instances {
+		result = append(result, CloudInstance{
+			ProviderID:   c.provider.Id,
+			ProviderName: c.provider.GetString("name"),
+			ProviderType: "aws",
+			ID:           instance.ID,
+			Name:         instance.Name,
+			ScanID:       instance.ScanID,
+			Region:       c.region,
+			Created:      instance.LaunchTime,
+		})
+	}
+	return result, nil
+}
+
+func (c *awsCompute) TerminateInstance(ctx context.Context, instance CloudInstance) error {
+	return aws.TerminateScanInstance(ctx, c.app, c.provider.Id, c.region, instance.ID, instance.ScanID)
+}
+
+// digitalOceanCompute is the CloudCompute of a DigitalOcean provider
+type digitalOceanCompute struct {
+	provider *models.Record
+	apiKey   string
+}
+
+func (c *digitalOceanCompute) ListInstances(ctx context.Context) ([]CloudInstance, error) {
+	droplets, err := digitalocean.ListScanDroplets(ctx, c.apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s: %v", c.provider.GetString("name"), err)
+	}
+
+	result := make([]CloudInstance, 0, len(droplets))
+	for _, droplet := range droplets {
+		result = append(result, CloudInstance{
+			ProviderID:   c.provider.Id,
+			ProviderName: c.provider.GetString("name"),
+			ProviderType: "digitalocean",
+			ID:           strconv.Itoa(droplet.ID),
+			Name:         droplet.Name,
+			ScanID:       droplet.ScanID,
+			Region:       droplet.Region,
+			Created:      droplet.Created,
+		})
+	}
+	return result, nil
+}
+
+func (c *digitalOceanCompute) TerminateInstance(ctx context.Context, instance CloudInstance) error {
+	dropletID, err := strconv.Atoi(instance.ID)
+	if err != nil {
+		return fmt.Errorf("invalid droplet ID %q: %v", instance.ID, err)
+	}
+	return digitalocean.DeleteScanDroplet(ctx, c.apiKey, dropletID)
+}
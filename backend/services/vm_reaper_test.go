@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+
+	"bitor/scan/lifecycle"
+)
+
+// fakeCloud is a CloudCompute that lists fixed instances and records terminations
+type fakeCloud struct {
+	instances  []CloudInstance
+	listErr    error
+	terminated []string
+}
+
+func (c *fakeCloud) ListInstances(ctx context.Context) ([]CloudInstance, error) {
+	return c.instances, c.listErr
+}
+
+func (c *fakeCloud) TerminateInstance(ctx context.Context, instance CloudInstance) error {
+	c.terminated = append(c.terminated, instance.ID)
+	return nil
+}
+
+func newTestVMReaper(t *testing.T) *VMReaper {
+	t.Helper()
+
+	reaper := NewVMReaper(newTestApp(t), nil)
+	reaper.logger = log.New(io.Discard, "", 0)
+	return reaper
+}
+
+// createTestScan saves a scan in a status and backdates its last update
+func createTestScan(t *testing.T, app *pocketbase.PocketBase, status string, destroyed bool, age time.Duration) string {
+	t.Helper()
+
+	collection, err := app.Dao().FindCollectionByNameOrId("nuclei_scans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := models.NewRecord(collection)
+	record.Set("name", "scan "+status)
+	record.Set("status", status)
+	record.Set("destroyed", destroyed)
+	if err := app.Dao().SaveRecord(record); err != nil {
+		t.Fatalf("failed to save scan: %v", err)
+	}
+
+	_, err = app.Dao().DB().NewQuery("UPDATE nuclei_scans SET updated = {:updated} WHERE id = {:id}").Bind(dbx.Params{
+		"updated": time.Now().Add(-age).UTC().Format("2006-01-02 15:04:05.000Z"),
+		"id":      record.Id,
+	}).Execute()
+	if err != nil {
+		t.Fatalf("failed to backdate scan: %v", err)
+	}
+	return record.Id
+}
+
+func TestVMReaperOrphanReason(t *testing.T) {
+	reaper := newTestVMReaper(t)
+	old := 2 * vmReaperGracePeriod
+	recent := vmReaperGracePeriod / 2
+
+	tests := []struct {
+		name      string
+		status    string
+		destroyed bool
+		age       time.Duration
+		orphaned  bool
+	}{
+		{"running", lifecycle.StatusRunning, false, old, false},
+		{"deploying", lifecycle.StatusDeploying, false, old, false},
+		{"created", lifecycle.StatusCreated, false, old, false},
+		{"finished, destroy failed", lifecycle.StatusFinished, false, old, true},
+		{"failed, destroy failed", lifecycle.StatusFailed, false, old, true},
+		{"stopped, destroy failed", lifecycle.StatusStopped, false, old, true},
+		{"timed out, destroy failed", lifecycle.StatusTimedOut, false, old, true},
+		{"finished recently", lifecycle.StatusFinished, false, recent, false},
+		{"destroyed", lifecycle.StatusDestroyed, true, old, true},
+		{"destroyed recently", lifecycle.StatusDestroyed, true, recent, false},
+		{"stuck stopping", lifecycle.StatusStopping, false, old, true},
+		{"stopping", lifecycle.StatusStopping, false, recent, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanID := createTestScan(t, reaper.app, tt.status, tt.destroyed, tt.age)
+
+			reason := reaper.orphanReason(CloudInstance{ID: "vm-1", ScanID: scanID}, time.Now())
+			if orphaned := reason != ""; orphaned != tt.orphaned {
+				t.Errorf("orphaned = %v (%q), want %v", orphaned, reason, tt.orphaned)
+			}
+		})
+	}
+
+	if reason := reaper.orphanReason(CloudInstance{ID: "vm-2"}, time.Now()); reason == "" {
+		t.Error("VM without a scan ID tag isn't orphaned")
+	}
+	if reason := reaper.orphanReason(CloudInstance{ID: "vm-3", ScanID: "missingscan0001"}, time.Now()); reason == "" {
+		t.Error("VM of a deleted scan isn't orphaned")
+	}
+}
+
+func TestVMReaperReap(t *testing.T) {
+	reaper := newTestVMReaper(t)
+	old := 2 * vmReaperGracePeriod
+
+	running := createTestScan(t, reaper.app, lifecycle.StatusRunning, false, old)
+	finished := createTestScan(t, reaper.app, lifecycle.StatusFinished, false, old)
+	stopping := createTestScan(t, reaper.app, lifecycle.StatusStopping, false, old)
+
+	newClouds := func() []*fakeCloud {
+		return []*fakeCloud{
+			{instances: []CloudInstance{
+				{ID: "vm-running", ScanID: running},
+				{ID: "vm-finished", ScanID: finished},
+			}},
+			{instances: []CloudInstance{
+				{ID: "vm-stopping", ScanID: stopping},
+			}},
+			{listErr: errors.New("provider unreachable")},
+		}
+	}
+	asCompute := func(clouds []*fakeCloud) []CloudCompute {
+		result := make([]CloudCompute, len(clouds))
+		for i, cloud := range clouds {
+			result[i] = cloud
+		}
+		return result
+	}
+
+	t.Run("report", func(t *testing.T) {
+		clouds := newClouds()
+		report := reaper.Reap(context.Background(), asCompute(clouds), OrphanedVMActionReport)
+
+		if report.Checked != 3 {
+			t.Errorf("checked %d VMs, want 3", report.Checked)
+		}
+		if len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "provider unreachable") {
+			t.Errorf("errors = %v, want the list error", report.Errors)
+		}
+		if got := orphanIDs(report); got != "vm-finished,vm-stopping" {
+			t.Errorf("orphans = %s, want vm-finished,vm-stopping", got)
+		}
+		for _, cloud := range clouds {
+			if len(cloud.terminated) > 0 {
+				t.Errorf("report terminated %v", cloud.terminated)
+			}
+		}
+	})
+
+	t.Run("terminate", func(t *testing.T) {
+		clouds := newClouds()
+		report := reaper.Reap(context.Background(), asCompute(clouds), OrphanedVMActionTerminate)
+
+		if got := orphanIDs(report); got != "vm-finished,vm-stopping" {
+			t.Errorf("orphans = %s, want vm-finished,vm-stopping", got)
+		}
+		for _, orphan := range report.Orphans {
+			if !orphan.Terminated {
+				t.Errorf("orphan %s wasn't terminated", orphan.ID)
+			}
+		}
+		if got := strings.Join(clouds[0].terminated, ","); got != "vm-finished" {
+			t.Errorf("terminated %s at the first cloud, want vm-finished", got)
+		}
+		if got := strings.Join(clouds[1].terminated, ","); got != "vm-stopping" {
+			t.Errorf("terminated %s at the second cloud, want vm-stopping", got)
+		}
+	})
+}
+
+// orphanIDs joins the VM IDs of the orphans of a report
+func orphanIDs(report *ReapReport) string {
+	ids := make([]string, 0, len(report.Orphans))
+	for _, orphan := range report.Orphans {
+		ids = append(ids, orphan.ID)
+	}
+	return strings.Join(ids, ",")
+}